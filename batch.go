@@ -0,0 +1,110 @@
+package meim
+
+import (
+	"net"
+
+	"github.com/ipiao/meim/log"
+)
+
+const DefaultWriteBatchSize = 64 * 1024 // 一次合并写出的最大字节数
+
+// 合并写出的消息,只在写协程中使用
+// 所有消息编码到同一块内存,写出时每个消息一个buffer
+type writeBatch struct {
+	buf      []byte      // 编码后的消息,批次间复用
+	ends     []int       // 每个消息在buf中的结束位置
+	bufs     net.Buffers //
+	reliable []*Message  // 批次中等待确认的可靠消息,写出后开始计算确认超时
+}
+
+func (b *writeBatch) len() int {
+	return len(b.ends)
+}
+
+func (b *writeBatch) reset(limit int) {
+	// 偶尔出现的大消息不长期占用内存
+	if cap(b.buf) > 4*limit {
+		b.buf = nil
+	}
+	b.buf = b.buf[:0]
+	b.ends = b.ends[:0]
+	for i := range b.reliable {
+		b.reliable[i] = nil
+	}
+	b.reliable = b.reliable[:0]
+}
+
+// 编码并加入批次,编码失败的消息被丢弃
+func (client *Client) appendBatch(msg *Message) {
+	client.plugin.HandleBeforeWriteMessage(client, msg)
+	start := len(client.batch.buf)
+	buf, err := AppendMessage(client.batch.buf, msg)
+	if err != nil {
+		log.Warnf("[encode-err] client %s, msg : %s, err: %s", client.Log(), msg, err)
+		return
+	}
+	client.batch.buf = buf
+	// 合并的消息按原消息分开写出,websocket等按帧传输的连接每个消息一帧
+	for _, end := range msg.parts {
+		client.batch.ends = append(client.batch.ends, start+end)
+	}
+	if len(msg.parts) == 0 {
+		client.batch.ends = append(client.batch.ends, len(buf))
+	}
+	if msg.pending {
+		client.batch.reliable = append(client.batch.reliable, msg)
+	}
+}
+
+func (client *Client) batchFull() bool {
+	return len(client.batch.buf) >= client.batchSize
+}
+
+// 从发送队列中收集消息直到达到批次大小,未取完时重新发出信号
+func (client *Client) collectBatch() {
+	for !client.batchFull() {
+		msg := client.nextMessage()
+		if msg == nil {
+			return
+		}
+		client.appendBatch(msg)
+	}
+	for _, q := range client.lanes {
+		if q.renotify() {
+			return
+		}
+	}
+}
+
+// 一次写出批次中的所有消息
+func (client *Client) flushBatch() error {
+	b := &client.batch
+	if b.len() == 0 {
+		return nil
+	}
+	b.bufs = b.bufs[:0]
+	start := 0
+	for _, end := range b.ends {
+		b.bufs = append(b.bufs, b.buf[start:end])
+		start = end
+	}
+	// WriteTo会修改bufs,使用副本以便复用
+	bufs := b.bufs
+	err := writeBuffers(client.conn, bufs)
+	if err == nil && len(b.reliable) > 0 {
+		client.rel.dequeued(b.reliable, true)
+	}
+	b.reset(client.batchSize)
+	for _, q := range client.lanes {
+		q.written()
+	}
+	return err
+}
+
+// 收集并写出消息,返回写出的消息数
+func (client *Client) writeBatch() (n int, err error) {
+	client.collectBatch()
+	n = client.batch.len()
+	err = client.flushBatch()
+	return
+}
@@ -0,0 +1,148 @@
+package meim
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 记录写调用的连接
+type recordConn struct {
+	net.Conn
+	writes  int
+	record  bool
+	buffers []net.Buffers
+}
+
+func (c *recordConn) Write(b []byte) (int, error) {
+	c.writes++
+	return c.Conn.Write(b)
+}
+
+func (c *recordConn) WriteBuffers(bufs net.Buffers) (int64, error) {
+	c.writes++
+	if c.record {
+		c.buffers = append(c.buffers, append(net.Buffers(nil), bufs...))
+	}
+	return bufs.WriteTo(c.Conn)
+}
+
+func newBatchTestClient(t testing.TB) (*Client, *recordConn) {
+	server, peer := net.Pipe()
+	go io.Copy(ioutil.Discard, peer)
+	t.Cleanup(func() { peer.Close() })
+
+	conn := &recordConn{Conn: server, record: true}
+	client := NewClient(conn)
+	client.plugin = newEchoPlugin()
+	client.DC = testDC
+	return client, conn
+}
+
+func TestClientWriteBatch(t *testing.T) {
+	client, conn := newBatchTestClient(t)
+	for i := 1; i <= 3; i++ {
+		client.EnqueueMessage(newTestMessage(i, "blocking"))
+	}
+	client.EnqueueNonBlockMessage(newTestMessage(4, "nonblock"))
+	client.EnqueueNonBlockMessage(newTestMessage(5, "nonblock"))
+
+	n, err := client.writeBatch()
+	assert.NoError(t, err)
+	assert.Equal(t, 5, n)
+	assert.Equal(t, 1, conn.writes)
+
+	// 每个buffer是一个完整的消息
+	for i, b := range conn.buffers[0] {
+		msg, err := DecodeMessage(b, testDC)
+		assert.NoError(t, err)
+		assert.Equal(t, i+1, msg.Header.Cmd())
+	}
+}
+
+func TestClientWriteBatchSize(t *testing.T) {
+	client, conn := newBatchTestClient(t)
+	size := len(mustEncode(t, newTestMessage(1, "0123456789")))
+	client.batchSize = size * 2
+
+	for i := 0; i < 5; i++ {
+		client.EnqueueNonBlockMessage(newTestMessage(i, "0123456789"))
+	}
+	client.SendLMessages()
+	assert.Equal(t, 3, conn.writes)
+	assert.Len(t, conn.buffers[0], 2)
+	assert.Len(t, conn.buffers[2], 1)
+}
+
+func TestWithWriteBatchSize(t *testing.T) {
+	for _, n := range []int{0, -1} {
+		s := NewServer(WithWriteBatchSize(n))
+		assert.Equal(t, DefaultWriteBatchSize, s.batchSize)
+	}
+	assert.Equal(t, 1024, NewServer(WithWriteBatchSize(1024)).batchSize)
+}
+
+func mustEncode(t testing.TB, msg *Message) []byte {
+	b, err := AppendMessage(nil, msg)
+	assert.NoError(t, err)
+	return b
+}
+
+// 对比逐条写出和合并写出,writes/op为每批消息的写调用次数
+func BenchmarkClientWrite(b *testing.B) {
+	const burst = 64
+	msg := newTestMessage(1, "a group message with some payload for fan-out benchmark")
+
+	dial := func(b *testing.B) (*recordConn, func()) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			b.Fatal(err)
+		}
+		go func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			io.Copy(ioutil.Discard, conn)
+		}()
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			b.Fatal(err)
+		}
+		return &recordConn{Conn: conn}, func() {
+			conn.Close()
+			ln.Close()
+		}
+	}
+
+	b.Run("single", func(b *testing.B) {
+		conn, closeFn := dial(b)
+		defer closeFn()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			for j := 0; j < burst; j++ {
+				data, _ := AppendMessage(nil, msg)
+				conn.Write(data)
+			}
+		}
+		b.ReportMetric(float64(conn.writes)/float64(b.N), "writes/op")
+	})
+
+	b.Run("coalesced", func(b *testing.B) {
+		conn, closeFn := dial(b)
+		defer closeFn()
+		client := NewClient(conn)
+		client.plugin = newEchoPlugin()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			for j := 0; j < burst; j++ {
+				client.EnqueueNonBlockMessage(msg)
+			}
+			client.SendLMessages()
+		}
+		b.ReportMetric(float64(conn.writes)/float64(b.N), "writes/op")
+	})
+}
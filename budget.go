@@ -0,0 +1,188 @@
+package meim
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/ipiao/meim/log"
+	"go.uber.org/atomic"
+)
+
+// 所有客户端发送队列共享的内存预算,消息大小见MessageSize
+// 消息在写出连接后才释放预算,已编码但还没有写出的消息仍然计入
+
+const (
+	DefaultShedTarget   = 0.8
+	DefaultShedInterval = time.Millisecond * 100
+)
+
+// ShedPolicy 超出内存预算时断开客户端的策略
+type ShedPolicy int
+
+const (
+	ShedNone    ShedPolicy = iota // 不断开客户端,只拒绝新消息
+	ShedLargest                   // 优先断开队列占用最多的客户端
+	ShedIdlest                    // 优先断开最久没有收到消息的客户端
+)
+
+func (p ShedPolicy) String() string {
+	switch p {
+	case ShedNone:
+		return "none"
+	case ShedLargest:
+		return "largest"
+	case ShedIdlest:
+		return "idlest"
+	}
+	return fmt.Sprintf("shed-%d", int(p))
+}
+
+// MemoryBudgetConfig 内存预算配置
+// 超出预算时拒绝新消息(PriorityControl除外),被拒绝的消息按队列的溢出处理,见QueueConfig
+type MemoryBudgetConfig struct {
+	MaxBytes     int64         // 所有客户端发送队列的总字节数上限
+	Shed         ShedPolicy    // 超出预算时断开哪些客户端
+	ShedTarget   float64       // 断开客户端直到使用量不超过MaxBytes*ShedTarget,默认DefaultShedTarget
+	ShedInterval time.Duration // 两次断开之间的最小间隔,默认DefaultShedInterval
+}
+
+func (cfg *MemoryBudgetConfig) init() {
+	if cfg.ShedTarget <= 0 || cfg.ShedTarget > 1 {
+		cfg.ShedTarget = DefaultShedTarget
+	}
+	if cfg.ShedInterval <= 0 {
+		cfg.ShedInterval = DefaultShedInterval
+	}
+}
+
+// MemoryStats 内存预算使用情况
+type MemoryStats struct {
+	MaxBytes int64 // 预算
+	Used     int64 // 当前使用
+	Peak     int64 // 最高使用
+	Rejected int64 // 因超出预算被拒绝的消息数
+	Shed     int64 // 因超出预算被断开的客户端数
+}
+
+type memoryBudget struct {
+	cfg MemoryBudgetConfig
+
+	used     atomic.Int64
+	peak     atomic.Int64
+	rejected atomic.Int64
+	shed     atomic.Int64
+
+	shedding atomic.Bool  // 正在断开客户端
+	lastShed atomic.Int64 // 上一次断开的时间,UnixNano
+	onShed   func(need int64) int
+}
+
+func newMemoryBudget(cfg MemoryBudgetConfig, onShed func(need int64) int) *memoryBudget {
+	cfg.init()
+	return &memoryBudget{cfg: cfg, onShed: onShed}
+}
+
+// 申请n字节,force为true时不检查预算
+// nil表示不限制
+func (b *memoryBudget) acquire(n int, force bool) bool {
+	if b == nil {
+		return true
+	}
+	for {
+		used := b.used.Load()
+		if !force && used+int64(n) > b.cfg.MaxBytes {
+			b.rejected.Inc()
+			b.triggerShed()
+			return false
+		}
+		if b.used.CAS(used, used+int64(n)) {
+			used += int64(n)
+			for peak := b.peak.Load(); used > peak && !b.peak.CAS(peak, used); peak = b.peak.Load() {
+			}
+			return true
+		}
+	}
+}
+
+func (b *memoryBudget) release(n int) {
+	if b == nil {
+		return
+	}
+	b.used.Sub(int64(n))
+}
+
+// 异步断开客户端,同一时间只有一个,并且限制频率
+func (b *memoryBudget) triggerShed() {
+	if b.cfg.Shed == ShedNone || b.onShed == nil {
+		return
+	}
+	if time.Now().UnixNano()-b.lastShed.Load() < int64(b.cfg.ShedInterval) {
+		return
+	}
+	if !b.shedding.CAS(false, true) {
+		return
+	}
+	go func() {
+		defer b.shedding.Store(false)
+		need := b.used.Load() - int64(float64(b.cfg.MaxBytes)*b.cfg.ShedTarget)
+		if need > 0 {
+			n := b.onShed(need)
+			b.shed.Add(int64(n))
+		}
+		b.lastShed.Store(time.Now().UnixNano())
+	}()
+}
+
+func (b *memoryBudget) stats() MemoryStats {
+	if b == nil {
+		return MemoryStats{}
+	}
+	return MemoryStats{
+		MaxBytes: b.cfg.MaxBytes,
+		Used:     b.used.Load(),
+		Peak:     b.peak.Load(),
+		Rejected: b.rejected.Load(),
+		Shed:     b.shed.Load(),
+	}
+}
+
+// 按策略选择并断开客户端,直到释放need字节,返回断开的客户端数
+func (s *Server) shedClients(need int64) int {
+	type candidate struct {
+		client *Client
+		bytes  int64
+		active time.Time
+	}
+	var candidates []candidate
+	s.clientsMu.RLock()
+	for client := range s.clients {
+		if _, bytes := client.QueueLen(); bytes > 0 {
+			candidates = append(candidates, candidate{client, int64(bytes), client.LastActive()})
+		}
+	}
+	s.clientsMu.RUnlock()
+
+	switch s.budget.cfg.Shed {
+	case ShedLargest:
+		sort.Slice(candidates, func(i, j int) bool { return candidates[i].bytes > candidates[j].bytes })
+	case ShedIdlest:
+		sort.Slice(candidates, func(i, j int) bool { return candidates[i].active.Before(candidates[j].active) })
+	}
+
+	n := 0
+	for _, c := range candidates {
+		if need <= 0 {
+			break
+		}
+		log.Warnf("client %s shed for memory budget, queued %d bytes", c.client.Log(), c.bytes)
+		need -= int64(c.client.shed())
+		n++
+	}
+	return n
+}
+
+// MemoryStats 返回内存预算使用情况,未设置预算时返回零值
+func (s *Server) MemoryStats() MemoryStats {
+	return s.budget.stats()
+}
@@ -0,0 +1,105 @@
+package meim
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryBudget(t *testing.T) {
+	size := MessageSize(newTestMessage(1, "0123456789"))
+	b := newMemoryBudget(MemoryBudgetConfig{MaxBytes: int64(size * 3)}, nil)
+
+	c1 := newQueueTestClient(QueueConfig{})
+	c1.setBudget(b)
+	c2 := newQueueTestClient(QueueConfig{})
+	c2.setBudget(b)
+
+	assert.True(t, c1.EnqueueMessage(newTestMessage(1, "0123456789")))
+	assert.True(t, c1.EnqueueNonBlockMessage(newTestMessage(2, "0123456789")))
+	assert.True(t, c2.EnqueueMessage(newTestMessage(3, "0123456789")))
+	// 超出预算
+	assert.False(t, c2.EnqueueMessage(newTestMessage(4, "0123456789")))
+	// 控制消息不受限制
+	assert.True(t, c2.EnqueuePriorityMessage(newTestMessage(5, "0123456789"), PriorityControl, false))
+
+	stats := b.stats()
+	assert.Equal(t, int64(size*4), stats.Used)
+	assert.Equal(t, int64(size*4), stats.Peak)
+	assert.Equal(t, int64(1), stats.Rejected)
+
+	// 出队后写出前仍计入预算,写出和关闭时释放
+	assert.NotNil(t, c1.nextMessage())
+	assert.Equal(t, int64(size*4), b.stats().Used)
+	for _, q := range c1.lanes {
+		q.written()
+	}
+	c2.closeQueues()
+	assert.Equal(t, int64(size), b.stats().Used)
+	assert.False(t, c2.EnqueueMessage(newTestMessage(6, "0123456789")))
+	assert.True(t, c1.EnqueueMessage(newTestMessage(7, "0123456789")))
+}
+
+func TestMemoryBudgetDropOldest(t *testing.T) {
+	size := MessageSize(newTestMessage(1, "0123456789"))
+	b := newMemoryBudget(MemoryBudgetConfig{MaxBytes: int64(size * 3)}, nil)
+
+	c1 := newQueueTestClient(QueueConfig{Policy: OverflowDropOldest, MaxMessages: 1})
+	c1.setBudget(b)
+	c2 := newQueueTestClient(QueueConfig{})
+	c2.setBudget(b)
+	var dropped []int
+	c1.SetQueueConfig(QueueConfig{Policy: OverflowDropOldest, MaxMessages: 1, OnOverflow: func(client *Client, msgs []*Message, policy OverflowPolicy) {
+		for _, msg := range msgs {
+			dropped = append(dropped, msg.Header.Cmd())
+		}
+	}})
+
+	assert.True(t, c1.EnqueueMessage(newTestMessage(1, "0123456789")))
+	assert.True(t, c2.EnqueueMessage(newTestMessage(2, "0123456789")))
+	assert.True(t, c2.EnqueueMessage(newTestMessage(3, "0123456789")))
+	// 丢弃最早的消息后仍超出预算,保留原来的消息
+	assert.False(t, c1.EnqueueMessage(newTestMessage(4, "0123456789012345678901")))
+	assert.Equal(t, []int{4}, dropped)
+	// 大小相同的消息替换最早的消息
+	assert.True(t, c1.EnqueueMessage(newTestMessage(5, "0123456789")))
+	assert.Equal(t, []int{4, 1}, dropped)
+	assert.Equal(t, []int{5}, queuedCmds(c1))
+	assert.Equal(t, int64(size*3), b.stats().Used)
+}
+
+func TestMemoryBudgetShed(t *testing.T) {
+	size := MessageSize(newTestMessage(1, "0123456789"))
+	s := NewServer(WithMemoryBudget(MemoryBudgetConfig{
+		MaxBytes:   int64(size * 4),
+		Shed:       ShedLargest,
+		ShedTarget: 0.5,
+	}), WithExternalPlugin(newEchoPlugin()))
+	assert.NoError(t, s.prepare())
+
+	small := newQueueTestClient(QueueConfig{})
+	large := newQueueTestClient(QueueConfig{})
+	var overflowed int
+	large.SetQueueConfig(QueueConfig{OnOverflow: func(client *Client, dropped []*Message, policy OverflowPolicy) {
+		overflowed += len(dropped)
+	}})
+	for _, c := range []*Client{small, large} {
+		c.setBudget(s.budget)
+		s.clients.Add(c)
+	}
+
+	assert.True(t, small.EnqueueMessage(newTestMessage(1, "0123456789")))
+	for i := 0; i < 3; i++ {
+		assert.True(t, large.EnqueueMessage(newTestMessage(1, "0123456789")))
+	}
+	assert.False(t, small.EnqueueMessage(newTestMessage(1, "0123456789")))
+
+	assert.Eventually(t, func() bool {
+		return s.MemoryStats().Shed == 1
+	}, time.Second, time.Millisecond*10)
+	assert.Equal(t, CloseReasonSlowConsumer, large.CloseReason())
+	assert.Equal(t, CloseReasonNone, small.CloseReason())
+	assert.Equal(t, 3, overflowed)
+	assert.Equal(t, int64(size), s.MemoryStats().Used)
+}
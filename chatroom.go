@@ -0,0 +1,375 @@
+package meim
+
+// 大型聊天室,适用于直播间等成员很多、消息可以丢弃的场景
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ipiao/meim/log"
+	"go.uber.org/atomic"
+)
+
+const (
+	DefaultChatroomInterval = time.Millisecond * 200
+	DefaultChatroomMaxBatch = 100
+)
+
+// ChatPriority 聊天室消息优先级
+type ChatPriority int
+
+const (
+	ChatPriorityNormal ChatPriority = iota // 普通消息,合并发送,受速率限制
+	ChatPriorityLow                        // 低优先级,只使用普通消息剩余的配额,如进入房间提示
+	ChatPriorityHigh                       // 高优先级,立即发送,不受限制,如主播消息、礼物
+)
+
+// SamplePolicy 一个周期内的消息超过配额时保留哪些消息
+type SamplePolicy int
+
+const (
+	SampleLatest   SamplePolicy = iota // 保留最新的消息
+	SampleEarliest                     // 保留最早的消息,丢弃之后的
+	SampleRandom                       // 均匀随机采样
+)
+
+func (p SamplePolicy) String() string {
+	switch p {
+	case SampleLatest:
+		return "latest"
+	case SampleEarliest:
+		return "earliest"
+	case SampleRandom:
+		return "random"
+	}
+	return fmt.Sprintf("sample-%d", int(p))
+}
+
+// ChatroomConfig 聊天室配置
+type ChatroomConfig struct {
+	Interval time.Duration // 合并发送的周期
+	MaxRate  int           // 每秒最多发送的普通和低优先级消息数,0表示只受MaxBatch限制
+	MaxBatch int           // 每个周期最多合并发送的消息数
+	Sample   SamplePolicy  // 超过配额时的采样策略
+}
+
+func (cfg *ChatroomConfig) init() {
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultChatroomInterval
+	}
+	if cfg.MaxBatch <= 0 {
+		cfg.MaxBatch = DefaultChatroomMaxBatch
+	}
+}
+
+// 每个周期的配额
+func (cfg *ChatroomConfig) quota() int {
+	n := cfg.MaxBatch
+	if cfg.MaxRate > 0 {
+		q := int(int64(cfg.MaxRate) * int64(cfg.Interval) / int64(time.Second))
+		if q < 1 {
+			q = 1
+		}
+		if q < n {
+			n = q
+		}
+	}
+	return n
+}
+
+// ChatroomStats 聊天室统计
+type ChatroomStats struct {
+	Members  int   // 成员数
+	Received int64 // 收到的消息数
+	Sent     int64 // 发送的消息数,不含高优先级消息
+	Priority int64 // 发送的高优先级消息数
+	Dropped  int64 // 超过配额被丢弃的消息数
+	Frames   int64 // 合并发送的次数
+}
+
+// 一个周期内有上限的消息缓冲
+type sampleBuffer struct {
+	msgs []*Message
+	head int // SampleLatest缓冲满后msgs作为环形缓冲,head为最早的消息
+	seen int // 本周期收到的消息数,用于随机采样
+}
+
+// 加入消息,返回被丢弃的消息数
+func (b *sampleBuffer) add(msg *Message, limit int, policy SamplePolicy, rnd *rand.Rand) int {
+	b.seen++
+	if len(b.msgs) < limit {
+		b.msgs = append(b.msgs, msg)
+		return 0
+	}
+	if limit == 0 {
+		return 1
+	}
+	switch policy {
+	case SampleLatest:
+		b.msgs[b.head] = msg
+		b.head = (b.head + 1) % len(b.msgs)
+	case SampleRandom:
+		// 蓄水池采样,保持顺序
+		if i := rnd.Intn(b.seen); i < limit {
+			copy(b.msgs[i:], b.msgs[i+1:])
+			b.msgs[len(b.msgs)-1] = msg
+		}
+	}
+	return 1
+}
+
+// 从msgs中按策略保留n条消息,保持顺序
+func sampleMessages(msgs []*Message, n int, policy SamplePolicy, rnd *rand.Rand) []*Message {
+	if len(msgs) <= n {
+		return msgs
+	}
+	switch policy {
+	case SampleEarliest:
+		return msgs[:n]
+	case SampleRandom:
+		idx := rnd.Perm(len(msgs))[:n]
+		sort.Ints(idx)
+		res := make([]*Message, n)
+		for i, j := range idx {
+			res[i] = msgs[j]
+		}
+		return res
+	}
+	return msgs[len(msgs)-n:]
+}
+
+// 取出本周期的消息,环形缓冲按顺序重新排列
+func (b *sampleBuffer) take() []*Message {
+	msgs := b.msgs
+	if b.head > 0 {
+		msgs = append(msgs[b.head:len(msgs):len(msgs)], msgs[:b.head]...)
+	}
+	b.msgs = nil
+	b.head = 0
+	b.seen = 0
+	return msgs
+}
+
+// Chatroom 大型聊天室,普通消息按周期合并后发送给所有成员,
+// 每种DataCreator只编码一次,每个成员每个周期只入队一次(PriorityBulk)
+// 高优先级消息立即发送(PriorityRealtime),关闭的成员在发送时自动移除
+type Chatroom struct {
+	cfg ChatroomConfig
+
+	mu      sync.Mutex
+	members []*Client
+	index   map[*Client]int // 成员在members中的位置
+	normal  sampleBuffer
+	low     sampleBuffer
+	rnd     *rand.Rand
+
+	received atomic.Int64
+	sent     atomic.Int64
+	priority atomic.Int64
+	dropped  atomic.Int64
+	frames   atomic.Int64
+
+	closeCh   chan struct{}
+	closeOnce sync.Once
+}
+
+// NewChatroom 新建聊天室并开始周期发送,不再使用时调用Close
+func NewChatroom(cfg ChatroomConfig) *Chatroom {
+	cfg.init()
+	cr := &Chatroom{
+		cfg:     cfg,
+		index:   make(map[*Client]int),
+		rnd:     rand.New(rand.NewSource(time.Now().UnixNano())),
+		closeCh: make(chan struct{}),
+	}
+	go cr.run()
+	return cr
+}
+
+func (cr *Chatroom) run() {
+	ticker := time.NewTicker(cr.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			cr.Flush()
+		case <-cr.closeCh:
+			return
+		}
+	}
+}
+
+// Close 停止周期发送,未发送的消息被丢弃
+func (cr *Chatroom) Close() {
+	cr.closeOnce.Do(func() {
+		close(cr.closeCh)
+	})
+}
+
+// Join 加入聊天室,已经加入时返回false
+func (cr *Chatroom) Join(client *Client) bool {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if _, ok := cr.index[client]; ok {
+		return false
+	}
+	cr.index[client] = len(cr.members)
+	cr.members = append(cr.members, client)
+	return true
+}
+
+// Leave 退出聊天室,不在聊天室中时返回false
+func (cr *Chatroom) Leave(client *Client) bool {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	return cr.removeLocked(client)
+}
+
+func (cr *Chatroom) removeLocked(client *Client) bool {
+	i, ok := cr.index[client]
+	if !ok {
+		return false
+	}
+	last := len(cr.members) - 1
+	cr.members[i] = cr.members[last]
+	cr.index[cr.members[i]] = i
+	cr.members[last] = nil
+	cr.members = cr.members[:last]
+	delete(cr.index, client)
+	return true
+}
+
+// Count 成员数
+func (cr *Chatroom) Count() int {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	return len(cr.members)
+}
+
+// Send 发送消息,高优先级消息立即发送,其他消息在下一个周期合并发送
+// 返回false表示消息超过配额被丢弃(采样时可能是之前的消息被替换)
+func (cr *Chatroom) Send(msg *Message, p ChatPriority) bool {
+	cr.received.Inc()
+	if p == ChatPriorityHigh {
+		cr.priority.Inc()
+		cache := newMessageEncodeCache(msg)
+		for _, c := range cr.snapshot() {
+			if !c.closed.Load() && c.DC != nil {
+				if m := cache.get(c.DC); m != nil {
+					c.EnqueuePriorityMessage(m.share(), PriorityRealtime, false)
+				}
+			}
+		}
+		return true
+	}
+
+	cr.mu.Lock()
+	quota := cr.cfg.quota()
+	var dropped int
+	if p == ChatPriorityLow {
+		dropped = cr.low.add(msg, quota, cr.cfg.Sample, cr.rnd)
+	} else {
+		dropped = cr.normal.add(msg, quota, cr.cfg.Sample, cr.rnd)
+	}
+	cr.mu.Unlock()
+	if dropped > 0 {
+		cr.dropped.Add(int64(dropped))
+		return false
+	}
+	return true
+}
+
+func (cr *Chatroom) snapshot() []*Client {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	members := make([]*Client, len(cr.members))
+	copy(members, cr.members)
+	return members
+}
+
+// Flush 立即合并发送缓冲的消息,一般由周期发送调用,返回发送的消息数
+// 没有消息时也会移除已关闭的成员
+func (cr *Chatroom) Flush() int {
+	cr.mu.Lock()
+	for i := len(cr.members) - 1; i >= 0; i-- {
+		if c := cr.members[i]; c.closed.Load() {
+			cr.removeLocked(c)
+		}
+	}
+	msgs := cr.normal.take()
+	low := cr.low.take()
+	if n := cr.cfg.quota() - len(msgs); n > 0 {
+		if len(low) > n {
+			cr.dropped.Add(int64(len(low) - n))
+			low = sampleMessages(low, n, cr.cfg.Sample, cr.rnd)
+		}
+		msgs = append(msgs, low...)
+	} else {
+		cr.dropped.Add(int64(len(low)))
+	}
+	if len(msgs) == 0 {
+		cr.mu.Unlock()
+		return 0
+	}
+	members := make([]*Client, len(cr.members))
+	copy(members, cr.members)
+	cr.mu.Unlock()
+
+	frames := make(map[DataCreator]*Message)
+	for _, c := range members {
+		if c.DC == nil {
+			continue
+		}
+		frame, ok := frames[c.DC]
+		if !ok {
+			frame = encodeBatch(c.DC, msgs)
+			frames[c.DC] = frame
+		}
+		if frame != nil {
+			c.EnqueuePriorityMessage(frame.share(), PriorityBulk, false)
+		}
+	}
+	cr.sent.Add(int64(len(msgs)))
+	cr.frames.Inc()
+	return len(msgs)
+}
+
+// 多个消息按dc编码到同一个预编码消息中,只占用一个队列位置
+// 写出时每个消息单独一个buffer,客户端按顺序读到多个消息
+func encodeBatch(dc DataCreator, msgs []*Message) *Message {
+	var b []byte
+	var hdr ProtocolHeader
+	var parts []int
+	for _, msg := range msgs {
+		m := &Message{Header: copyHeader(dc, msg.Header), Body: msg.Body}
+		data, err := AppendMessage(b, m)
+		if err != nil {
+			log.Warnf("[encode-err] cmd: %d, err: %s", msg.Header.Cmd(), err)
+			continue
+		}
+		b = data
+		parts = append(parts, len(b))
+		if hdr == nil {
+			hdr = m.Header
+		}
+	}
+	if hdr == nil {
+		return nil
+	}
+	return &Message{Header: hdr, encoded: b, parts: parts}
+}
+
+// Stats 聊天室统计
+func (cr *Chatroom) Stats() ChatroomStats {
+	return ChatroomStats{
+		Members:  cr.Count(),
+		Received: cr.received.Load(),
+		Sent:     cr.sent.Load(),
+		Priority: cr.priority.Load(),
+		Dropped:  cr.dropped.Load(),
+		Frames:   cr.frames.Load(),
+	}
+}
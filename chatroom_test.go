@@ -0,0 +1,262 @@
+package meim
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 读取合并帧中的所有消息
+func frameBodies(t *testing.T, msg *Message) []string {
+	data, err := AppendMessage(nil, msg)
+	assert.NoError(t, err)
+	r := bytes.NewReader(data)
+	var bodies []string
+	for r.Len() > 0 {
+		m, err := ReadMessage(r, testDC)
+		if !assert.NoError(t, err) {
+			break
+		}
+		bodies = append(bodies, string(*m.Body.(*plainData)))
+	}
+	return bodies
+}
+
+func newTestChatroom(cfg ChatroomConfig) (*Chatroom, *Client) {
+	cfg.Interval = time.Hour // 手动Flush
+	cr := NewChatroom(cfg)
+	member := newQueueTestClient(QueueConfig{})
+	cr.Join(member)
+	return cr, member
+}
+
+func sendChat(cr *Chatroom, p ChatPriority, bodies ...string) (accepted int) {
+	for _, body := range bodies {
+		if cr.Send(newTestMessage(1, body), p) {
+			accepted++
+		}
+	}
+	return
+}
+
+func TestChatroomSample(t *testing.T) {
+	for _, tc := range []struct {
+		policy SamplePolicy
+		send   []string
+		expect []string
+	}{
+		{SampleLatest, []string{"a", "b", "c", "d", "e"}, []string{"c", "d", "e"}},
+		{SampleLatest, []string{"a", "b", "c", "d", "e", "f", "g", "h"}, []string{"f", "g", "h"}},
+		{SampleEarliest, []string{"a", "b", "c", "d", "e"}, []string{"a", "b", "c"}},
+	} {
+		cr, member := newTestChatroom(ChatroomConfig{MaxBatch: 3, Sample: tc.policy})
+		assert.Equal(t, 3, sendChat(cr, ChatPriorityNormal, tc.send...), tc.policy)
+		assert.Equal(t, 3, cr.Flush())
+		assert.Equal(t, tc.expect, frameBodies(t, member.nextMessage()), tc.policy)
+		assert.Nil(t, member.nextMessage())
+		assert.Equal(t, int64(len(tc.send)-3), cr.Stats().Dropped)
+		// 下一个周期重新开始
+		sendChat(cr, ChatPriorityNormal, "x", "y")
+		assert.Equal(t, 2, cr.Flush())
+		assert.Equal(t, []string{"x", "y"}, frameBodies(t, member.nextMessage()), tc.policy)
+		cr.Close()
+	}
+
+	// 随机采样保持顺序
+	cr, member := newTestChatroom(ChatroomConfig{MaxBatch: 10, Sample: SampleRandom})
+	defer cr.Close()
+	for i := 0; i < 100; i++ {
+		cr.Send(newTestMessage(1, fmt.Sprintf("%03d", i)), ChatPriorityNormal)
+	}
+	cr.Flush()
+	bodies := frameBodies(t, member.nextMessage())
+	assert.Len(t, bodies, 10)
+	assert.True(t, sort.StringsAreSorted(bodies))
+}
+
+func TestChatroomPriority(t *testing.T) {
+	// 每周期的配额
+	assert.Equal(t, 2, (&ChatroomConfig{Interval: time.Millisecond * 100, MaxRate: 20, MaxBatch: 10}).quota())
+	assert.Equal(t, 1, (&ChatroomConfig{Interval: time.Millisecond * 100, MaxRate: 1, MaxBatch: 10}).quota())
+	assert.Equal(t, 10, (&ChatroomConfig{Interval: time.Millisecond * 100, MaxBatch: 10}).quota())
+
+	cr, member := newTestChatroom(ChatroomConfig{MaxBatch: 2})
+	defer cr.Close()
+
+	sendChat(cr, ChatPriorityLow, "enter1", "enter2")
+	sendChat(cr, ChatPriorityNormal, "chat")
+	// 高优先级立即发送
+	assert.Equal(t, 1, sendChat(cr, ChatPriorityHigh, "gift"))
+	assert.Equal(t, []string{"gift"}, frameBodies(t, member.nextMessage()))
+	assert.Nil(t, member.nextMessage())
+
+	// 低优先级只使用剩余配额
+	assert.Equal(t, 2, cr.Flush())
+	assert.Equal(t, []string{"chat", "enter2"}, frameBodies(t, member.nextMessage()))
+	assert.Equal(t, 0, cr.Flush())
+
+	stats := cr.Stats()
+	assert.Equal(t, int64(4), stats.Received)
+	assert.Equal(t, int64(2), stats.Sent)
+	assert.Equal(t, int64(1), stats.Priority)
+	assert.Equal(t, int64(1), stats.Dropped)
+	assert.Equal(t, int64(1), stats.Frames)
+}
+
+func TestChatroomMembers(t *testing.T) {
+	cr := NewChatroom(ChatroomConfig{Interval: time.Millisecond * 20})
+	defer cr.Close()
+	var members []*Client
+	for i := 0; i < 3; i++ {
+		c := newQueueTestClient(QueueConfig{})
+		assert.True(t, cr.Join(c))
+		members = append(members, c)
+	}
+	assert.False(t, cr.Join(members[0]))
+	assert.True(t, cr.Leave(members[1]))
+	assert.False(t, cr.Leave(members[1]))
+	members[2].flushMessage() // 连接已关闭
+
+	// 周期发送,移除已关闭的成员
+	cr.Send(newTestMessage(1, "hello"), ChatPriorityNormal)
+	assert.Eventually(t, func() bool {
+		return cr.Stats().Frames == 1
+	}, time.Second, time.Millisecond*10)
+	assert.Equal(t, 1, cr.Count())
+	assert.Equal(t, []string{"hello"}, frameBodies(t, members[0].nextMessage()))
+	assert.Nil(t, members[1].nextMessage())
+}
+
+func TestChatroomLowSample(t *testing.T) {
+	cr, member := newTestChatroom(ChatroomConfig{MaxBatch: 2, Sample: SampleEarliest})
+	defer cr.Close()
+	sendChat(cr, ChatPriorityLow, "enter1", "enter2")
+	sendChat(cr, ChatPriorityNormal, "chat")
+	assert.Equal(t, 2, cr.Flush())
+	assert.Equal(t, []string{"chat", "enter1"}, frameBodies(t, member.nextMessage()))
+}
+
+func TestChatroomHeader(t *testing.T) {
+	cr, member := newTestChatroom(ChatroomConfig{})
+	defer cr.Close()
+	readSeqs := func(msg *Message) []int {
+		data, err := AppendMessage(nil, msg)
+		assert.NoError(t, err)
+		r := bytes.NewReader(data)
+		var seqs []int
+		for r.Len() > 0 {
+			m, err := ReadMessage(r, testDC)
+			if !assert.NoError(t, err) {
+				break
+			}
+			seqs = append(seqs, m.Header.Seq())
+		}
+		return seqs
+	}
+
+	// 合并发送和高优先级消息都保留消息头的其他字段
+	for i, p := range []ChatPriority{ChatPriorityNormal, ChatPriorityHigh} {
+		msg := newTestMessage(1, "seq")
+		msg.Header.SetSeq(10 + i)
+		cr.Send(msg, p)
+	}
+	assert.Equal(t, []int{11}, readSeqs(member.nextMessage()))
+	cr.Flush()
+	assert.Equal(t, []int{10}, readSeqs(member.nextMessage()))
+}
+
+// 只有高优先级消息时也会移除已关闭的成员
+func TestChatroomPruneWithoutMessages(t *testing.T) {
+	cr, member := newTestChatroom(ChatroomConfig{})
+	defer cr.Close()
+	closed := newQueueTestClient(QueueConfig{})
+	cr.Join(closed)
+	closed.flushMessage()
+	sendChat(cr, ChatPriorityHigh, "gift")
+	assert.Equal(t, 0, cr.Flush())
+	assert.Equal(t, 1, cr.Count())
+	assert.Equal(t, []string{"gift"}, frameBodies(t, member.nextMessage()))
+}
+
+// 10000个成员,每次发送100条消息
+func BenchmarkChatroom(b *testing.B) {
+	const members = 10000
+	set := NewClientSet()
+	cr := NewChatroom(ChatroomConfig{Interval: time.Hour, MaxBatch: 100})
+	defer cr.Close()
+	for i := 0; i < members; i++ {
+		c := newQueueTestClient(QueueConfig{MaxMessages: 1000})
+		set.Add(c)
+		cr.Join(c)
+	}
+	drain := func() {
+		for c := range set {
+			for c.nextMessage() != nil {
+			}
+		}
+	}
+	body := plainData("a chat message body of typical size for the benchmark")
+
+	b.Run("fanout", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for j := 0; j < 100; j++ {
+				set.BroadcastPriority(1, &body, PriorityBulk)
+			}
+			b.StopTimer()
+			drain()
+			b.StartTimer()
+		}
+	})
+	b.Run("chatroom", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for j := 0; j < 100; j++ {
+				cr.Send(&Message{Header: NewCmdMessage(testDC, 1).Header, Body: &body}, ChatPriorityNormal)
+			}
+			cr.Flush()
+			b.StopTimer()
+			drain()
+			b.StartTimer()
+		}
+	})
+}
+
+func TestChatroomWebSocket(t *testing.T) {
+	cr := NewChatroom(ChatroomConfig{Interval: time.Hour})
+	defer cr.Close()
+	imp := newEchoPlugin()
+	imp.SetOnAuthClient(func(client *Client) bool {
+		client.DC = testDC
+		cr.Join(client)
+		return true
+	})
+	s := newTestServer(t, WithExternalPlugin(imp), WithListenerConfig(&ListenerConfig{
+		Network: "ws",
+		Address: "127.0.0.1:0",
+		Options: map[string]interface{}{"Path": "/im"},
+	}))
+	defer s.Stop()
+
+	conn, br := dialWS(t, s.Addrs()[1].String())
+	defer conn.Close()
+	assert.Eventually(t, func() bool {
+		return cr.Count() == 1
+	}, time.Second, time.Millisecond*10)
+
+	// 合并发送的消息每个一帧
+	sendChat(cr, ChatPriorityNormal, "a", "b", "c")
+	assert.Equal(t, 3, cr.Flush())
+	for _, body := range []string{"a", "b", "c"} {
+		op, payload, err := readServerFrame(br)
+		assert.NoError(t, err)
+		assert.Equal(t, byte(wsOpBinary), op)
+		msg, err := DecodeMessage(payload, testDC)
+		assert.NoError(t, err)
+		assert.Equal(t, body, string(*msg.Body.(*plainData)))
+	}
+}
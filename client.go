@@ -1,7 +1,6 @@
 package meim
 
 import (
-	"container/list"
 	"fmt"
 	"io"
 	"net"
@@ -13,22 +12,106 @@ import (
 )
 
 const (
-	MessageQueueLimit = 1000
+	MessageQueueLimit = 1000       // 默认发送队列的最大消息数
+	DefaultReadLimit  = 128 * 1024 // 默认读取消息body的最大长度
 )
 
+// CloseReason 客户端关闭原因,在HandleClientClosed中通过client.CloseReason()获取
+type CloseReason int32
+
+const (
+	CloseReasonNone            CloseReason = iota // 未关闭
+	CloseReasonNormal                             // 调用Close关闭
+	CloseReasonReadError                          // 读错误,一般是客户端断开
+	CloseReasonWriteError                         // 写错误
+	CloseReasonServerShutdown                     // 服务关闭
+	CloseReasonIdleTimeout                        // 心跳超时
+	CloseReasonSlowConsumer                       // 发送队列溢出,见OverflowDisconnect
+	CloseReasonMessageTooLarge                    // 消息超过读取限制
+	CloseReasonAckTimeout                         // 可靠推送的消息重传后仍未确认
+	CloseReasonSessionTakeover                    // 会话被新连接恢复
+	CloseReasonKicked                             // 被踢下线,见LoginConfig和Kick
+
+	CloseReasonUser CloseReason = 100 // 业务自定义的原因从这里开始
+)
+
+func (r CloseReason) String() string {
+	switch r {
+	case CloseReasonNone:
+		return "none"
+	case CloseReasonNormal:
+		return "normal"
+	case CloseReasonReadError:
+		return "read error"
+	case CloseReasonWriteError:
+		return "write error"
+	case CloseReasonServerShutdown:
+		return "server shutdown"
+	case CloseReasonIdleTimeout:
+		return "idle timeout"
+	case CloseReasonSlowConsumer:
+		return "slow consumer"
+	case CloseReasonMessageTooLarge:
+		return "message too large"
+	case CloseReasonAckTimeout:
+		return "ack timeout"
+	case CloseReasonSessionTakeover:
+		return "session takeover"
+	case CloseReasonKicked:
+		return "kicked"
+	}
+	return fmt.Sprintf("reason-%d", int32(r))
+}
+
 type Client struct {
 	conn           Conn
-	closed         atomic.Bool        // 是否关闭
-	mch            chan *Message      // 一般消息下发通道, message channel
-	lmsch          chan int           // 长消息下发(信号),long message signal channel
-	lmessages      *list.List         // 长消息存储队列(非阻塞消息下发)
-	extch          chan func(*Client) // 外部时间队列, external event channel
-	mu             sync.Mutex         // 锁
-	enqueueTimeout time.Duration      // 消息/事件入队超时时间
+	reader         *MessageReader               // 带缓冲的读取,只在读协程(认证阶段为认证协程)中使用
+	readLimitFn    func(ProtocolHeader) int     // 按消息头返回读取限制
+	closed         atomic.Bool                  // 是否关闭
+	authed         atomic.Bool                  // 是否已通过认证
+	closeReason    atomic.Int32                 // 关闭原因,第一次设置的有效
+	lanes          [priorityCount]*messageQueue // 各优先级的消息发送队列
+	notify         chan struct{}                // 有消息入队(信号)
+	sched          scheduler                    // 优先级调度,只在写协程中使用
+	closeCh        chan struct{}                // 关闭(信号)
+	closeOnce      sync.Once                    //
+	extch          chan func(*Client)           // 外部时间队列, external event channel
+	enqueueTimeout time.Duration                // 事件入队超时时间
+	batch          writeBatch                   // 合并写出的消息
+	batchSize      int                          // 一次合并写出的最大字节数
+
+	drainCh   chan *Message // 清空队列后关闭(信号),携带最后一条消息
+	drainOnce sync.Once     //
+	drained   atomic.Bool   // 关闭服务时已写完队列中的消息
+	done      chan struct{} // 客户端处理完全结束
+	writeDone chan struct{} // 写协程结束,连接已关闭
+
+	kickNotice  func(*Client, CloseReason) *Message // 踢下线的通知消息
+	controlOnly atomic.Bool                         // 关闭时只写出控制消息,见CloseWithReason
+
+	hb         *HeartbeatConfig // 心跳配置,nil表示不开启
+	hbInterval atomic.Int64     // 心跳间隔
+	lastRead   atomic.Int64     // 最后一次收到消息的时间,UnixNano
+
+	rel     *reliable    // 可靠推送,nil表示不开启
+	offline OfflineStore // 离线消息存储,投递的离线消息确认后从中删除
+
+	sessions     *sessionManager // 会话管理,nil表示不开启会话恢复
+	sessionToken string          // 会话token
+	session      *session        // 当前会话,由sessions.mu保护
+	resume       *session        // 认证时请求恢复的会话,认证成功后绑定,由sessions.mu保护
+	resumeSeq    int             // 请求恢复时客户端最后收到的序号
+	endSession   atomic.Bool     // 关闭后不保留会话
+
+	readLimit     atomic.Int64                                // 认证后读取body的最大长度
+	authReadLimit int                                         // 认证阶段读取body的最大长度,0表示与认证后相同
+	limitReply    func(*Client, ProtocolHeader, int) *Message // 超过读取限制时的默认回复
 
 	plugin ExternalPlugin
+	lncfg  *ListenerConfig // 客户端连接所在的监听
 
 	UID      int64       // 用户id
+	Platform string      // 设备平台,在认证时设置,用于多端登录策略
 	UserData interface{} // 用户其他私有数据
 	DC       DataCreator // 协议数据构建器
 	Version  int32
@@ -37,11 +120,21 @@ type Client struct {
 func NewClient(conn Conn) *Client {
 	client := new(Client)
 	client.conn = conn
-	client.mch = make(chan *Message, 16)
-	client.lmsch = make(chan int, 1)
-	client.lmessages = list.New()
+	client.reader = NewMessageReader(conn, 0)
+	client.readLimitFn = client.headerReadLimit
+	client.notify = make(chan struct{}, 1)
+	for i := range client.lanes {
+		client.lanes[i] = newMessageQueue(QueueConfig{}, client.notify)
+	}
+	client.SetSchedule(ScheduleConfig{})
+	client.closeCh = make(chan struct{})
 	client.extch = make(chan func(*Client), 1)
 	client.enqueueTimeout = time.Second * 10
+	client.batchSize = DefaultWriteBatchSize
+	client.drainCh = make(chan *Message, 1)
+	client.done = make(chan struct{})
+	client.writeDone = make(chan struct{})
+	client.readLimit.Store(DefaultReadLimit)
 	return client
 }
 
@@ -63,50 +156,157 @@ func (client *Client) EnqueueData(data []byte) bool {
 	return client.EnqueueMessage(msg)
 }
 
-// 发送一般消息
+// 发送一般消息,使用PriorityRealtime,队列满时按队列的溢出策略处理
+// 默认在积压MessageQueueLimit条消息后才阻塞,原来为16条,见CHANGELOG.md
+// 返回false表示客户端已关闭或消息被丢弃
 func (client *Client) EnqueueMessage(msg *Message) bool {
+	return client.enqueue(msg, PriorityRealtime, true)
+}
+
+// 发送非阻塞消息,使用PriorityBulk,OverflowBlock策略下队列满时丢弃最早的消息
+func (client *Client) EnqueueNonBlockMessage(msg *Message) bool {
+	return client.enqueue(msg, PriorityBulk, false)
+}
+
+// 按优先级发送消息,block为false时不会阻塞
+func (client *Client) EnqueuePriorityMessage(msg *Message, p Priority, block bool) bool {
+	if !p.valid() {
+		log.Warnf("client %s enqueue message with invalid priority %d", client.Log(), p)
+		p = PriorityBulk
+	}
+	return client.enqueue(msg, p, block)
+}
+
+func (client *Client) enqueue(msg *Message, p Priority, block bool) bool {
 	if client.closed.Load() { // 已关闭
 		log.Infof("can't send message to closed client %s", client.Log())
 		return false
 	}
 
-	select {
-	case client.mch <- msg:
-		return true
-	case <-time.After(client.enqueueTimeout):
-		log.Infof("send message to mch timed out %s", client.Log())
-		return false
-	}
+	res, dropped := client.lanes[p].push(msg, block, client.closeCh)
+	return client.enqueued(msg, p, res, dropped)
 }
 
-// 发送非阻塞消息
-func (client *Client) EnqueueNonBlockMessage(msg *Message) bool {
-	if client.closed.Load() { // 已关闭
+// 处理入队结果,调用溢出回调,不能在持有锁时调用
+func (client *Client) enqueued(msg *Message, p Priority, res enqueueResult, dropped []*Message) bool {
+	cfg := client.lanes[p].config()
+	if client.rel != nil {
+		// 没有入队或被挤出队列的可靠消息等待超时后重传
+		var lost []*Message
+		if res != enqueueOK && msg.pending {
+			lost = append(lost, msg)
+		}
+		for _, m := range dropped {
+			if m.pending {
+				lost = append(lost, m)
+			}
+		}
+		if len(lost) > 0 {
+			client.rel.dequeued(lost, false)
+		}
+	}
+	dropped = unpending(dropped)
+	switch res {
+	case enqueueClosed:
 		log.Infof("can't send message to closed client %s", client.Log())
 		return false
+	case enqueueOverBudget:
+		log.Infof("client %s memory budget exhausted, drop message", client.Log())
+		fallthrough
+	case enqueueDropped:
+		if cfg.Policy == OverflowSpill && cfg.Spill != nil && !msg.pending {
+			err := cfg.Spill(client, msg)
+			if err == nil {
+				return true
+			}
+			log.Warnf("client %s spill message error: %s", client.Log(), err)
+		}
+	case enqueueDisconnect:
+		log.Warnf("client %s %s queue full, disconnect slow consumer", client.Log(), p)
+		client.closeWithReason(CloseReasonSlowConsumer)
 	}
 
-	dropped := false
-	client.mu.Lock()
-	if client.lmessages.Len() >= MessageQueueLimit {
-		//队列阻塞，丢弃之前的消息
-		client.lmessages.Remove(client.lmessages.Front())
-		dropped = true
+	if len(dropped) > 0 {
+		log.Infof("client %s %s queue full, drop %d messages, policy: %s", client.Log(), p, len(dropped), cfg.Policy)
+		if cfg.OnOverflow != nil {
+			cfg.OnOverflow(client, dropped, cfg.Policy)
+		}
 	}
+	return res == enqueueOK
+}
 
-	client.lmessages.PushBack(msg)
-	client.mu.Unlock()
+// 去掉等待确认的可靠消息,它们之后会被重传或交给OnUnacked
+func unpending(msgs []*Message) []*Message {
+	res := msgs[:0]
+	for _, msg := range msgs {
+		if !msg.pending {
+			res = append(res, msg)
+		}
+	}
+	return res
+}
 
-	if dropped {
-		log.Info("client %s message queue full, drop a message", client.Log())
+// 使用服务的内存预算,控制消息不受预算限制
+func (client *Client) setBudget(b *memoryBudget) {
+	for p, q := range client.lanes {
+		q.budget = b
+		q.exempt = Priority(p) == PriorityControl
 	}
+}
 
-	//nonblock
-	select {
-	case client.lmsch <- 1:
-	default:
+// 因超出内存预算被断开,丢弃队列中的消息,返回释放的字节数
+func (client *Client) shed() int {
+	_, bytes := client.QueueLen()
+	for _, q := range client.lanes {
+		cfg := q.config()
+		if dropped := unpending(q.close()); len(dropped) > 0 && cfg.OnOverflow != nil {
+			cfg.OnOverflow(client, dropped, OverflowDisconnect)
+		}
 	}
-	return true
+	client.closeWithReason(CloseReasonSlowConsumer)
+	return bytes
+}
+
+// 关闭所有发送队列,释放剩余消息占用的预算,返回未写出的消息
+func (client *Client) closeQueues() []*Message {
+	var msgs []*Message
+	for _, q := range client.lanes {
+		msgs = append(msgs, q.close()...)
+	}
+	return msgs
+}
+
+// SetQueueConfig 设置客户端所有优先级的发送队列配置,一般在认证时根据客户端类型设置
+// 容量限制对每个优先级的队列分别生效
+func (client *Client) SetQueueConfig(cfg QueueConfig) {
+	for _, q := range client.lanes {
+		q.setConfig(cfg)
+	}
+}
+
+// SetPriorityQueueConfig 设置单个优先级的发送队列配置
+func (client *Client) SetPriorityQueueConfig(p Priority, cfg QueueConfig) {
+	if p.valid() {
+		client.lanes[p].setConfig(cfg)
+	}
+}
+
+// QueueConfig 优先级p的发送队列配置,p无效时返回零值
+func (client *Client) QueueConfig(p Priority) QueueConfig {
+	if !p.valid() {
+		return QueueConfig{}
+	}
+	return client.lanes[p].config()
+}
+
+// QueueLen 所有发送队列中的消息数和字节数
+func (client *Client) QueueLen() (n int, bytes int) {
+	for _, q := range client.lanes {
+		qn, qb := q.len()
+		n += qn
+		bytes += qb
+	}
+	return
 }
 
 // 发送一般消息
@@ -115,6 +315,9 @@ func (client *Client) flushMessage() {
 		log.Infof("client:%s, close the real connection", client.Log())
 		client.conn.Close()
 	}
+	client.closeOnce.Do(func() {
+		close(client.closeCh)
+	})
 
 	//close(client.mch)
 	//close(client.extch)
@@ -127,23 +330,17 @@ func (client *Client) flushMessage() {
 	//client.SendLMessages()
 }
 
-//发送等待队列中的消息
+// 发送队列中的所有消息,只能在写协程中调用
 func (client *Client) SendLMessages() {
-	var messages *list.List
-	client.mu.Lock()
-	if client.lmessages.Len() == 0 {
-		client.mu.Unlock()
-		return
-	}
-	messages = client.lmessages
-	client.lmessages = list.New()
-	client.mu.Unlock()
-
-	e := messages.Front()
-	for e != nil {
-		msg := e.Value.(*Message)
-		WriteMessage(client.conn, msg)
-		e = e.Next()
+	for {
+		n, err := client.writeBatch()
+		if err != nil {
+			log.Infof("client %s write error: %s", client.Log(), err)
+			return
+		}
+		if n == 0 {
+			return
+		}
 	}
 }
 
@@ -175,63 +372,172 @@ func (client *Client) read() {
 		//if client.closed.Load() {
 		//	break
 		//}
-		msg, err := ReadLimitMessage(client.conn, client.DC, 128*1024)
+		msg, err := client.readMessage()
+		if e, ok := err.(*ReadLimitError); ok {
+			client.rejectOversize(e)
+			break
+		}
 		if err != nil {
 			log.Infof("client %s read error: %s", client.Log(), err)
-			client.Close()
+			client.closeWithReason(CloseReasonReadError)
 			break
 		}
+		client.lastRead.Store(time.Now().UnixNano())
+		if client.hb != nil && client.handleHeartbeat(msg) {
+			continue
+		}
+		if client.rel != nil && client.handleAck(msg) {
+			continue
+		}
 		client.plugin.HandleMessage(client, msg)
 	}
 }
 
 func (client *Client) write() {
+	defer close(client.writeDone)
+	var hbTimer *time.Timer
+	var hbC <-chan time.Time
+	if client.hb != nil {
+		hbTimer = time.NewTimer(client.HeartbeatInterval())
+		defer hbTimer.Stop()
+		hbC = hbTimer.C
+	}
+	var rtTimer *time.Timer
+	var rtC <-chan time.Time
+	if client.rel != nil {
+		rtTimer = time.NewTimer(client.rel.cfg.AckTimeout)
+		defer rtTimer.Stop()
+		rtC = rtTimer.C
+	}
 	//发送在线消息
 	for {
 		select {
-		case msg := <-client.mch:
-			if msg == nil {
-				if client.UID != 0 {
-					log.Infof("client:%s socket closed", client.Log())
-				}
-				client.flushMessage()
+		case <-client.notify:
+			if !client.writeQueued() {
 				return
 			}
-			client.plugin.HandleBeforeWriteMessage(client, msg)
-			err := WriteMessage(client.conn, msg)
-			if err != nil {
-				if _, ok := err.(net.Error); ok || err == io.EOF {
-					log.Infof("[write-nil] client %s, msg : %s, err: %s", client.Log(), msg, err)
-				} else {
-					log.Warnf("[write-err] client %s, msg : %s, err: %s", client.Log(), msg, err)
-				}
-				client.flushMessage()
-				return
+
+		case <-client.closeCh:
+			if client.UID != 0 {
+				log.Infof("client:%s socket closed", client.Log())
 			}
-		case <-client.lmsch:
-			client.SendLMessages()
-			break
+			if client.controlOnly.Load() {
+				client.flushControl()
+			} else {
+				client.flushQueued(nil)
+			}
+			client.flushMessage()
+			return
 
 		case fn := <-client.extch:
 			if fn != nil {
 				fn(client)
 			}
+
+		case last := <-client.drainCh:
+			client.setCloseReason(CloseReasonServerShutdown)
+			if client.flushQueued(last) == nil {
+				client.drained.Store(true)
+			}
+			client.flushMessage()
+			return
+
+		case <-hbC:
+			next := client.checkHeartbeat()
+			if next == 0 {
+				client.setCloseReason(CloseReasonIdleTimeout)
+				client.flushMessage()
+				return
+			}
+			hbTimer.Reset(next)
+
+		case <-rtC:
+			next := client.checkRetransmit()
+			if next == 0 {
+				client.setCloseReason(CloseReasonAckTimeout)
+				client.flushMessage()
+				return
+			}
+			rtTimer.Reset(next)
 		}
 	}
 }
 
-//
-func (client *Client) Close() {
-	if !client.closed.Load() {
-		select {
-		case client.mch <- nil:
-			log.Infof("try close client %s", client.Log())
-		default:
+// 合并写出已入队的消息,连接需要关闭时返回false
+func (client *Client) writeQueued() bool {
+	n, err := client.writeBatch()
+	if err != nil {
+		if _, ok := err.(net.Error); ok || err == io.EOF {
+			log.Infof("[write-nil] client %s, %d msgs, err: %s", client.Log(), n, err)
+		} else {
+			log.Warnf("[write-err] client %s, %d msgs, err: %s", client.Log(), n, err)
 		}
+		client.setCloseReason(CloseReasonWriteError)
+		client.flushMessage()
+		return false
+	}
+	return true
+}
+
+// 写出所有已入队的消息,最后写出last,返回写错误
+func (client *Client) flushQueued(last *Message) error {
+	for {
+		n, err := client.writeBatch()
+		if err != nil {
+			log.Infof("[drain] client %s, %d msgs, err: %s", client.Log(), n, err)
+			return err
+		}
+		if n == 0 {
+			break
+		}
+	}
+	if last != nil {
+		client.appendBatch(last)
+		return client.flushBatch()
+	}
+	return nil
+}
+
+// 清空发送队列后关闭连接,只会生效一次
+func (client *Client) drain(last *Message) {
+	client.drainOnce.Do(func() {
+		client.drainCh <- last
+	})
+}
+
+// Done 返回客户端处理结束的信号,在HandleClientClosed之后关闭
+func (client *Client) Done() <-chan struct{} {
+	return client.done
+}
+
+// Close 写完队列中的消息后关闭连接
+func (client *Client) Close() {
+	client.closeWithReason(CloseReasonNormal)
+}
+
+func (client *Client) closeWithReason(reason CloseReason) {
+	if client.closed.Load() {
+		return
 	}
+	client.setCloseReason(reason)
+	client.closeOnce.Do(func() {
+		log.Infof("try close client %s", client.Log())
+		close(client.closeCh)
+	})
+}
+
+// 只有第一次设置的原因有效
+func (client *Client) setCloseReason(reason CloseReason) {
+	client.closeReason.CAS(int32(CloseReasonNone), int32(reason))
+}
+
+// CloseReason 客户端关闭原因
+func (client *Client) CloseReason() CloseReason {
+	return CloseReason(client.closeReason.Load())
 }
 
 func (client *Client) Run() {
+	client.lastRead.Store(time.Now().UnixNano())
 	go client.read()
 	client.write()
 }
@@ -239,3 +545,13 @@ func (client *Client) Run() {
 func (client *Client) LocalAddr() net.Addr {
 	return client.conn.LocalAddr()
 }
+
+// Authed 是否已通过认证
+func (client *Client) Authed() bool {
+	return client.authed.Load()
+}
+
+// ListenerConfig 返回客户端连接所在的监听配置
+func (client *Client) ListenerConfig() *ListenerConfig {
+	return client.lncfg
+}
@@ -58,6 +58,38 @@ func (conn *NetConn) Write(b []byte) (int, error) {
 	return n, err
 }
 
+// BuffersWriter 可以一次写出多个消息的连接,每个buffer是一个完整的消息
+type BuffersWriter interface {
+	WriteBuffers(bufs net.Buffers) (int64, error)
+}
+
+// WriteBuffers tcp和unix连接使用writev一次写出
+// 其他连接(如websocket)逐个buffer写出,保持消息边界
+func (conn *NetConn) WriteBuffers(bufs net.Buffers) (int64, error) {
+	if conn.writeTimeout > 0 {
+		conn.Conn.SetWriteDeadline(time.Now().Add(conn.writeTimeout))
+	}
+	n, err := bufs.WriteTo(conn.Conn)
+	if err != nil {
+		log.Debugf("write error: %s, addr: %s", err, conn.RemoteAddr())
+	}
+	return n, err
+}
+
+// 写出多个消息,连接不支持BuffersWriter时逐个写出
+func writeBuffers(conn Conn, bufs net.Buffers) error {
+	if bw, ok := conn.(BuffersWriter); ok {
+		_, err := bw.WriteBuffers(bufs)
+		return err
+	}
+	for _, b := range bufs {
+		if _, err := conn.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func IsTimeout(err error) bool {
 	if e, ok := err.(net.Error); ok {
 		return e.Timeout()
@@ -5,10 +5,39 @@ package meim
 type ExternalPlugin interface {
 	HandleAuthClient(*Client) bool              // run的第一步, auth 认证客户端,至少确定协议方式,亦即 DataCreator
 	HandleMessage(*Client, *Message)            // 消息处理函数
-	HandleClientClosed(*Client)                 // 关闭客户端之后的处理
+	HandleClientClosed(*Client)                 // 认证成功的客户端关闭之后的处理,关闭原因见Client.CloseReason
 	HandleBeforeWriteMessage(*Client, *Message) //
 }
 
+// 可选,基于消息的认证
+// 认证阶段读取的消息交给HandleAuthMessage处理,返回true表示认证完成,
+// 返回错误表示认证失败,若为*AuthError且Reply不为空,会在断开前回复给客户端
+type AuthMessageHandler interface {
+	HandleAuthMessage(*Client, *Message) (bool, error)
+}
+
+// 可选,按客户端和指令限制读取的消息body长度,DataCreator和ExternalPlugin都可以实现
+// 依次查询DataCreator,ExternalPlugin,返回0表示不指定,负数表示不限制
+// 都没有指定时使用客户端的限制,见Client.SetReadLimit
+type ReadLimiter interface {
+	ReadLimit(client *Client, cmd int) int
+}
+
+// 可选,消息超过读取限制时,在断开前回复给客户端的消息,返回nil时使用服务的默认回复
+type ReadLimitHandler interface {
+	HandleReadLimit(client *Client, header ProtocolHeader, limit int) *Message
+}
+
+// AuthError 认证失败
+type AuthError struct {
+	Reason string   // 失败原因
+	Reply  *Message // 回复给客户端的消息,可选
+}
+
+func (e *AuthError) Error() string {
+	return "auth failed: " + e.Reason
+}
+
 //var (
 //	ext     ExternalPlugin // ext = extension
 //	extOnce sync.Once
@@ -15,15 +15,19 @@ type (
 type ExternalImp struct {
 	defaultHandler MessageHandler // 当cmd处理函数未被注册时候,统一处理
 	defaultFilters []Filter
-	handlers       map[int]MessageHandler // 处理函数,按cmd
-	onAuthClient   func(*Client) bool     // 处理客户端认证
-	onClientClosed func(*Client)          //
+	handlers       map[int]MessageHandler                // 处理函数,按cmd
+	onAuthClient   func(*Client) bool                    // 处理客户端认证
+	onAuthMessage  func(*Client, *Message) (bool, error) // 处理认证消息
+	onClientClosed func(*Client)                         //
 	beforeWrite    MessageHandler
+	readLimits     map[int]int                                 // 读取限制,按cmd
+	onReadLimit    func(*Client, ProtocolHeader, int) *Message // 超过读取限制时的回复
 }
 
 func NewExternalImp() *ExternalImp {
 	return &ExternalImp{
-		handlers: make(map[int]MessageHandler),
+		handlers:   make(map[int]MessageHandler),
+		readLimits: make(map[int]int),
 	}
 }
 
@@ -38,6 +42,13 @@ func (e *ExternalImp) HandleAuthClient(client *Client) bool {
 	return true
 }
 
+func (e *ExternalImp) HandleAuthMessage(client *Client, msg *Message) (bool, error) {
+	if e.onAuthMessage == nil {
+		return false, &AuthError{Reason: "auth message handler not set"}
+	}
+	return e.onAuthMessage(client, msg)
+}
+
 func (e *ExternalImp) HandleMessage(client *Client, msg *Message) {
 	if h, ok := e.handlers[msg.Header.Cmd()]; ok {
 		h(client, msg)
@@ -62,6 +73,17 @@ func (e *ExternalImp) HandleBeforeWriteMessage(client *Client, message *Message)
 	}
 }
 
+func (e *ExternalImp) ReadLimit(client *Client, cmd int) int {
+	return e.readLimits[cmd]
+}
+
+func (e *ExternalImp) HandleReadLimit(client *Client, header ProtocolHeader, limit int) *Message {
+	if e.onReadLimit != nil {
+		return e.onReadLimit(client, header, limit)
+	}
+	return nil
+}
+
 func (e *ExternalImp) SetOnAuthClient(h func(*Client) bool) {
 	if e.onAuthClient != nil {
 		log.Warnf("onAuthClient already set, will be replaced")
@@ -69,6 +91,13 @@ func (e *ExternalImp) SetOnAuthClient(h func(*Client) bool) {
 	e.onAuthClient = h
 }
 
+func (e *ExternalImp) SetOnAuthMessage(h func(*Client, *Message) (bool, error)) {
+	if e.onAuthMessage != nil {
+		log.Warnf("onAuthMessage already set, will be replaced")
+	}
+	e.onAuthMessage = h
+}
+
 func (e *ExternalImp) SetMsgHandler(cmd int, h MessageHandler, filters ...Filter) {
 	if _, ok := e.handlers[cmd]; ok {
 		log.Warnf("cmd %d handler already exists, will be replaced", cmd)
@@ -91,6 +120,18 @@ func (e *ExternalImp) SetBeforeWrite(h MessageHandler) {
 	e.beforeWrite = h
 }
 
+// 设置cmd读取body的最大长度,负数表示不限制
+func (e *ExternalImp) SetReadLimit(cmd int, n int) {
+	e.readLimits[cmd] = n
+}
+
+func (e *ExternalImp) SetOnReadLimit(h func(*Client, ProtocolHeader, int) *Message) {
+	if e.onReadLimit != nil {
+		log.Warnf("onReadLimit already set, will be replaced")
+	}
+	e.onReadLimit = h
+}
+
 func (e *ExternalImp) SetOnClientClosed(h func(*Client)) {
 	if e.onClientClosed != nil {
 		log.Warnf("onClientClosed already set, will be replaced")
@@ -102,9 +143,11 @@ func (e *ExternalImp) Clone() *ExternalImp {
 	imp := &ExternalImp{
 		//Router:         e.Router,
 		onAuthClient:   e.onAuthClient,
+		onAuthMessage:  e.onAuthMessage,
 		onClientClosed: e.onClientClosed,
 		defaultHandler: e.defaultHandler,
 		beforeWrite:    e.beforeWrite,
+		onReadLimit:    e.onReadLimit,
 	}
 	handlers := make(map[int]MessageHandler)
 	for cmd, h := range e.handlers {
@@ -116,6 +159,10 @@ func (e *ExternalImp) Clone() *ExternalImp {
 	}
 	imp.defaultFilters = filters
 	imp.handlers = handlers
+	imp.readLimits = make(map[int]int)
+	for cmd, n := range e.readLimits {
+		imp.readLimits[cmd] = n
+	}
 	return imp
 }
 
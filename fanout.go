@@ -0,0 +1,121 @@
+package meim
+
+import (
+	"reflect"
+
+	"github.com/ipiao/meim/log"
+)
+
+// NewEncodedMessage 预先编码消息,返回的消息写出时直接使用编码后的数据
+// 编码后的消息可以同时入队到多个客户端,之后修改Header或Body不会影响写出的数据
+// 写出前仍会调用HandleBeforeWriteMessage,但不能修改消息
+func NewEncodedMessage(msg *Message) (*Message, error) {
+	if msg.encoded != nil {
+		return msg, nil
+	}
+	data, err := AppendMessage(nil, msg)
+	if err != nil {
+		return nil, err
+	}
+	return &Message{Header: msg.Header, Body: msg.Body, encoded: data}, nil
+}
+
+// Encoded 消息是否已预先编码
+func (m *Message) Encoded() bool {
+	return m.encoded != nil
+}
+
+// 共享编码后的数据和Body,Header为副本,每个接收者一个
+// 不同客户端的写协程同时调用HandleBeforeWriteMessage时不会修改同一个Header
+func (m *Message) share() *Message {
+	return &Message{Header: m.Header.Clone(), Body: m.Body, encoded: m.encoded, parts: m.parts}
+}
+
+// 按dc复制消息头,dc的header与h类型相同时复制全部字段,否则只复制cmd、seq和ver
+func copyHeader(dc DataCreator, h ProtocolHeader) ProtocolHeader {
+	nh := dc.CreateHeader()
+	if reflect.TypeOf(nh) == reflect.TypeOf(h) {
+		return h.Clone()
+	}
+	nh.SetCmd(h.Cmd())
+	nh.SetSeq(h.Seq())
+	nh.SetVer(h.Ver())
+	return nh
+}
+
+// 按DataCreator缓存编码后的消息,同一种协议只编码一次
+type encodeCache struct {
+	cmd  int
+	hdr  ProtocolHeader // 不为nil时按copyHeader复制消息头,否则只设置cmd
+	body ProtocolBody
+	msgs map[DataCreator]*Message // 编码失败时为nil
+}
+
+func newEncodeCache(cmd int, body ProtocolBody) *encodeCache {
+	return &encodeCache{cmd: cmd, body: body, msgs: make(map[DataCreator]*Message)}
+}
+
+// 按消息缓存,保留消息头的其他字段
+func newMessageEncodeCache(msg *Message) *encodeCache {
+	c := newEncodeCache(msg.Header.Cmd(), msg.Body)
+	c.hdr = msg.Header
+	return c
+}
+
+func (c *encodeCache) get(dc DataCreator) *Message {
+	if msg, ok := c.msgs[dc]; ok {
+		return msg
+	}
+	msg := &Message{Body: c.body}
+	if c.hdr != nil {
+		msg.Header = copyHeader(dc, c.hdr)
+	} else {
+		msg.Header = NewCmdMessage(dc, c.cmd).Header
+	}
+	msg, err := NewEncodedMessage(msg)
+	if err != nil {
+		log.Warnf("[encode-err] cmd: %d, err: %s", c.cmd, err)
+	}
+	c.msgs[dc] = msg
+	return msg
+}
+
+// 非阻塞入队,返回入队成功的客户端数
+func (c *encodeCache) send(clients ClientSet, p Priority) int {
+	n := 0
+	for client := range clients {
+		if client.DC == nil {
+			continue
+		}
+		msg := c.get(client.DC)
+		if msg != nil && client.EnqueuePriorityMessage(msg.share(), p, false) {
+			n++
+		}
+	}
+	return n
+}
+
+// Broadcast 向集合中的所有客户端发送指令为cmd的消息,使用PriorityRealtime非阻塞入队
+// 使用相同DataCreator的客户端共享同一份编码和body,每个客户端的消息有自己的Header,
+// HandleBeforeWriteMessage不能修改body,返回入队成功的客户端数
+func (set ClientSet) Broadcast(cmd int, body ProtocolBody) int {
+	return set.BroadcastPriority(cmd, body, PriorityRealtime)
+}
+
+// BroadcastPriority 同Broadcast,指定优先级
+func (set ClientSet) BroadcastPriority(cmd int, body ProtocolBody, p Priority) int {
+	return newEncodeCache(cmd, body).send(set, p)
+}
+
+// Broadcast 向uids的所有在线客户端发送消息,见ClientSet.Broadcast
+func (route *Router) Broadcast(uids []int64, cmd int, body ProtocolBody) int {
+	set := NewClientSet()
+	route.mu.RLock()
+	for _, uid := range uids {
+		for c := range route.clients[uid] {
+			set.Add(c)
+		}
+	}
+	route.mu.RUnlock()
+	return set.Broadcast(cmd, body)
+}
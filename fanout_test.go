@@ -0,0 +1,99 @@
+package meim
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/atomic"
+)
+
+// 记录编码次数的body
+type countingBody struct {
+	plainData
+	encodes atomic.Int32
+}
+
+func (b *countingBody) Encode() ([]byte, error) {
+	b.encodes.Inc()
+	return b.plainData.Encode()
+}
+
+func TestBroadcast(t *testing.T) {
+	otherDC := newPooledDataCreator()
+	set := NewClientSet()
+	var clients []*Client
+	for i := 0; i < 4; i++ {
+		c := newQueueTestClient(QueueConfig{})
+		if i%2 == 1 {
+			c.DC = otherDC
+		}
+		set.Add(c)
+		clients = append(clients, c)
+	}
+	// 未认证的客户端被跳过
+	set.Add(NewClient(nil))
+
+	body := &countingBody{plainData: plainData("broadcast")}
+	assert.Equal(t, 4, set.Broadcast(7, body))
+	assert.Equal(t, int32(2), body.encodes.Load())
+
+	var msgs []*Message
+	for _, c := range clients {
+		msg := c.nextMessage()
+		assert.True(t, msg.Encoded())
+		msgs = append(msgs, msg)
+	}
+	// 共享编码,Header各自独立
+	assert.True(t, &msgs[0].encoded[0] == &msgs[2].encoded[0])
+	assert.True(t, &msgs[1].encoded[0] == &msgs[3].encoded[0])
+	assert.False(t, msgs[0].Header == msgs[2].Header)
+	msgs[0].Header.SetSeq(9)
+	assert.Equal(t, 0, msgs[2].Header.Seq())
+
+	// 写出时不再编码
+	data, err := AppendMessage(nil, msgs[0])
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), body.encodes.Load())
+	msg, err := DecodeMessage(data, testDC)
+	assert.NoError(t, err)
+	assert.Equal(t, 7, msg.Header.Cmd())
+	assert.Equal(t, "broadcast", string(*msg.Body.(*plainData)))
+	assert.Equal(t, len(data), MessageSize(msgs[0]))
+}
+
+func TestRouterBroadcast(t *testing.T) {
+	route := NewRouter()
+	for uid := int64(1); uid <= 3; uid++ {
+		c := newQueueTestClient(QueueConfig{})
+		c.UID = uid
+		route.AddClient(c)
+	}
+	assert.Equal(t, 2, route.Broadcast([]int64{1, 3, 4}, 7, newTestMessage(7, "a").Body))
+}
+
+// 向1000个客户端写出同一消息的编码开销
+func BenchmarkBroadcast(b *testing.B) {
+	const clients = 1000
+	body := plainData(make([]byte, 512))
+	var buf []byte
+
+	b.Run("per-client", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for j := 0; j < clients; j++ {
+				msg := NewCmdMessage(testDC, 1)
+				msg.Body = &body
+				buf, _ = AppendMessage(buf[:0], msg)
+			}
+		}
+	})
+	b.Run("encode-once", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			msg := newEncodeCache(1, &body).get(testDC)
+			for j := 0; j < clients; j++ {
+				buf, _ = AppendMessage(buf[:0], msg)
+			}
+		}
+	})
+}
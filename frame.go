@@ -0,0 +1,61 @@
+package meim
+
+import (
+	"io"
+	"sync"
+)
+
+const maxPooledFrame = 64 * 1024 // 超过的frame不放回池中
+
+var framePool = sync.Pool{
+	New: func() interface{} {
+		return &Frame{b: make([]byte, 0, 512)}
+	},
+}
+
+// Frame 池中的编码后的消息,使用完后调用Release放回池中
+// Release之后不能再使用Bytes返回的数据,Release只能调用一次
+type Frame struct {
+	b []byte
+}
+
+func getFrame() *Frame {
+	f := framePool.Get().(*Frame)
+	f.b = f.b[:0]
+	return f
+}
+
+// EncodeFrame 编码消息到池中的Frame,limitSize限制body长度,不大于0表示不限制
+func EncodeFrame(message *Message, limitSize int) (*Frame, error) {
+	frame := getFrame()
+	b, err := appendLimitMessage(frame.b, message, limitSize)
+	if err != nil {
+		frame.Release()
+		return nil, err
+	}
+	frame.b = b
+	return frame, nil
+}
+
+// Bytes 编码后的数据,在Release之前有效
+func (f *Frame) Bytes() []byte {
+	return f.b
+}
+
+func (f *Frame) Len() int {
+	return len(f.b)
+}
+
+func (f *Frame) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(f.b)
+	return int64(n), err
+}
+
+// Release 放回池中
+func (f *Frame) Release() {
+	if f == nil || cap(f.b) > maxPooledFrame {
+		return
+	}
+	f.b = f.b[:0]
+	framePool.Put(f)
+}
@@ -0,0 +1,94 @@
+package meim
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 并发编码,之前的编码结果不能被后续编码覆盖
+func TestEncodeConcurrent(t *testing.T) {
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			var kept [][]byte
+			var bodies []string
+			for i := 0; i < 200; i++ {
+				body := fmt.Sprintf("goroutine %d message %d", g, i)
+				b, err := EncodeMessage(newTestMessage(1, body))
+				assert.NoError(t, err)
+				kept = append(kept, b)
+				bodies = append(bodies, body)
+
+				frame, err := EncodeFrame(newTestMessage(2, body), 0)
+				assert.NoError(t, err)
+				msg, err := DecodeMessage(frame.Bytes(), testDC)
+				assert.NoError(t, err)
+				assert.Equal(t, body, string(*msg.Body.(*plainData)))
+				frame.Release()
+
+				im := &InternalMessage{Message: newTestMessage(3, body), Sender: int64(g), Receiver: int64(i)}
+				b, err = EncodeInternalMessage(im)
+				assert.NoError(t, err)
+				dm, err := DecodeInternalMessgae(b, testDC)
+				assert.NoError(t, err)
+				assert.Equal(t, int64(i), dm.Receiver)
+				assert.Equal(t, body, string(*dm.Body.(*plainData)))
+			}
+			for i, b := range kept {
+				msg, err := DecodeMessage(b, testDC)
+				assert.NoError(t, err)
+				assert.Equal(t, bodies[i], string(*msg.Body.(*plainData)))
+			}
+		}(g)
+	}
+	wg.Wait()
+}
+
+func TestFrame(t *testing.T) {
+	_, err := EncodeFrame(newTestMessage(1, "0123456789"), 5)
+	assert.Equal(t, ErrorWriteOutofRange, err)
+
+	frame, err := EncodeFrame(newTestMessage(1, "0123456789"), 10)
+	assert.NoError(t, err)
+	data, _ := AppendMessage(nil, newTestMessage(1, "0123456789"))
+	assert.Equal(t, data, frame.Bytes())
+	assert.Equal(t, len(data), frame.Len())
+
+	var buf bytes.Buffer
+	n, err := frame.WriteTo(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(data)), n)
+	assert.Equal(t, data, buf.Bytes())
+	frame.Release()
+}
+
+func TestInternalMessageTopic(t *testing.T) {
+	// 没有主题的消息保持旧的编码
+	im := &InternalMessage{Message: newTestMessage(3, "body"), Sender: 1, Receiver: 2, Timestamp: 3}
+	b, err := EncodeInternalMessage(im)
+	assert.NoError(t, err)
+	hl := im.Header.Length()
+	assert.Len(t, b, hl+internalExtLength+len("body"))
+	assert.Equal(t, "body", string(b[hl+internalExtLength:]))
+
+	im = &InternalMessage{Message: newTestMessage(3, "body"), Timestamp: 3, Node: 7, Topic: "room:1"}
+	b, err = EncodeInternalMessage(im)
+	assert.NoError(t, err)
+	for _, decode := range []func([]byte) (*InternalMessage, error){
+		func(b []byte) (*InternalMessage, error) { return DecodeInternalMessgae(b, testDC) },
+		func(b []byte) (*InternalMessage, error) { return ReadInternalMessage(bytes.NewReader(b), testDC) },
+	} {
+		dm, err := decode(b)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(3), dm.Timestamp)
+		assert.Equal(t, int64(7), dm.Node)
+		assert.Equal(t, "room:1", dm.Topic)
+		assert.Equal(t, "body", string(*dm.Body.(*plainData)))
+	}
+}
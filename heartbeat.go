@@ -0,0 +1,114 @@
+package meim
+
+import (
+	"time"
+
+	"github.com/ipiao/meim/log"
+)
+
+const (
+	DefaultHeartbeatInterval  = time.Second * 30
+	DefaultHeartbeatMaxMissed = 3
+)
+
+// HeartbeatConfig 应用层心跳配置
+// ping/pong消息由客户端的DataCreator按指令创建,body为空
+// 收到的ping/pong由服务端处理,不会交给ExternalPlugin.HandleMessage
+type HeartbeatConfig struct {
+	PingCmd     int           // ping指令
+	PongCmd     int           // pong指令
+	Interval    time.Duration // 默认心跳间隔
+	MinInterval time.Duration // 客户端可协商的最小间隔,0表示不限制
+	MaxInterval time.Duration // 客户端可协商的最大间隔,0表示不限制
+	MaxMissed   int           // 连续多少个间隔没有收到任何消息则断开
+	ServerProbe bool          // 超过一个间隔没有收到消息时,服务端主动发送ping
+
+	OnHeartbeat func(*Client, *Message) // 收到ping/pong,可选
+	OnTimeout   func(*Client)           // 心跳超时断开之前,可选
+}
+
+func (cfg *HeartbeatConfig) init() {
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultHeartbeatInterval
+	}
+	if cfg.MaxMissed <= 0 {
+		cfg.MaxMissed = DefaultHeartbeatMaxMissed
+	}
+}
+
+// 限制在协商范围内
+func (cfg *HeartbeatConfig) clamp(d time.Duration) time.Duration {
+	if cfg.MinInterval > 0 && d < cfg.MinInterval {
+		d = cfg.MinInterval
+	}
+	if cfg.MaxInterval > 0 && d > cfg.MaxInterval {
+		d = cfg.MaxInterval
+	}
+	return d
+}
+
+// SetHeartbeatInterval 设置客户端的心跳间隔,返回实际生效的间隔
+// 一般在认证时根据客户端的请求设置,未开启心跳时返回0
+func (client *Client) SetHeartbeatInterval(d time.Duration) time.Duration {
+	if client.hb == nil {
+		return 0
+	}
+	d = client.hb.clamp(d)
+	client.hbInterval.Store(int64(d))
+	return d
+}
+
+// HeartbeatInterval 客户端的心跳间隔
+func (client *Client) HeartbeatInterval() time.Duration {
+	return time.Duration(client.hbInterval.Load())
+}
+
+// LastActive 最后一次收到消息的时间
+func (client *Client) LastActive() time.Time {
+	return time.Unix(0, client.lastRead.Load())
+}
+
+// 处理收到的心跳消息,返回是否为心跳消息
+func (client *Client) handleHeartbeat(msg *Message) bool {
+	cmd := msg.Header.Cmd()
+	switch {
+	case cmd == client.hb.PingCmd:
+		hdr := msg.Header.Clone()
+		hdr.SetCmd(client.hb.PongCmd)
+		client.EnqueuePriorityMessage(&Message{Header: hdr}, PriorityControl, false)
+	case cmd == client.hb.PongCmd:
+	default:
+		return false
+	}
+	if client.hb.OnHeartbeat != nil {
+		client.hb.OnHeartbeat(client, msg)
+	}
+	return true
+}
+
+// 心跳检查,在写协程中执行
+// 返回下一次检查的间隔,返回0表示心跳超时
+func (client *Client) checkHeartbeat() time.Duration {
+	interval := client.HeartbeatInterval()
+	idle := time.Since(client.LastActive())
+	if idle >= interval*time.Duration(client.hb.MaxMissed) {
+		log.Infof("client %s heartbeat timeout, idle %s", client.Log(), idle)
+		if client.hb.OnTimeout != nil {
+			client.hb.OnTimeout(client)
+		}
+		return 0
+	}
+	if idle < interval {
+		return interval - idle
+	}
+	if client.hb.ServerProbe {
+		data, err := AppendMessage(nil, NewCmdMessage(client.DC, client.hb.PingCmd))
+		if err == nil {
+			_, err = client.conn.Write(data)
+		}
+		if err != nil {
+			log.Infof("client %s write ping error: %s", client.Log(), err)
+		}
+	}
+	return interval
+}
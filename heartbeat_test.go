@@ -0,0 +1,59 @@
+package meim
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHeartbeat(t *testing.T) {
+	reasons := make(chan CloseReason, 1)
+	s := newTestServer(t, WithHeartbeat(&HeartbeatConfig{
+		PingCmd:     20,
+		PongCmd:     21,
+		Interval:    time.Millisecond * 50,
+		MinInterval: time.Millisecond * 50,
+		ServerProbe: true,
+	}))
+	defer s.Stop()
+	s.plugin.(*ExternalImp).SetOnClientClosed(func(client *Client) {
+		reasons <- client.CloseReason()
+	})
+
+	conn, err := net.Dial("tcp", s.Addrs()[0].String())
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	ping := newTestMessage(20, "")
+	ping.Header.SetSeq(7)
+	assert.NoError(t, WriteMessage(conn, ping))
+	msg, err := ReadMessage(conn, testDC)
+	assert.NoError(t, err)
+	assert.Equal(t, 21, msg.Header.Cmd())
+	assert.Equal(t, 7, msg.Header.Seq())
+
+	// 不再发送消息,收到服务端的ping后被断开
+	msg, err = ReadMessage(conn, testDC)
+	assert.NoError(t, err)
+	assert.Equal(t, 20, msg.Header.Cmd())
+
+	select {
+	case reason := <-reasons:
+		assert.Equal(t, CloseReasonIdleTimeout, reason)
+	case <-time.After(time.Second):
+		t.Fatal("client not closed")
+	}
+}
+
+func TestSetHeartbeatInterval(t *testing.T) {
+	client := NewClient(nil)
+	assert.Equal(t, time.Duration(0), client.SetHeartbeatInterval(time.Second))
+
+	client.hb = &HeartbeatConfig{MinInterval: time.Second, MaxInterval: time.Minute}
+	assert.Equal(t, time.Second, client.SetHeartbeatInterval(time.Millisecond))
+	assert.Equal(t, time.Minute, client.SetHeartbeatInterval(time.Hour))
+	assert.Equal(t, time.Second*10, client.SetHeartbeatInterval(time.Second*10))
+	assert.Equal(t, time.Second*10, client.HeartbeatInterval())
+}
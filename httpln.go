@@ -0,0 +1,99 @@
+package meim
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ipiao/meim/log"
+)
+
+var ErrorHTTPListenerClosed = errors.New("http listener closed")
+
+// 基于http的监听,如websocket,长轮询
+// http处理中产生的连接通过Accept返回
+type httpListener struct {
+	inner     net.Listener
+	srv       *http.Server
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+	errClosed error // 关闭后Accept返回的错误
+}
+
+// 创建http监听,secure时使用cfg.TLSConfig
+func makeHTTPListener(cfg *ListenerConfig, secure bool, handler func(*httpListener) http.Handler) (net.Listener, error) {
+	if secure && cfg.TLSConfig == nil {
+		return nil, errors.New(cfg.Network + ": TLSConfig must be configured")
+	}
+	raw, err := Listen("tcp", cfg.Address)
+	if err != nil {
+		return nil, err
+	}
+	inner := raw
+	if secure {
+		inner = NewTLSListener(raw, cfg.TLSConfig)
+	}
+	ln := &httpListener{
+		inner:     inner,
+		conns:     make(chan net.Conn),
+		closed:    make(chan struct{}),
+		errClosed: ErrorHTTPListenerClosed,
+	}
+	ln.srv = &http.Server{
+		Handler:           handler(ln),
+		ReadHeaderTimeout: time.Second * 10,
+	}
+	go func() {
+		err := ln.srv.Serve(inner)
+		if err != http.ErrServerClosed {
+			log.Warnf("http listener %s serve error: %s", cfg, err)
+		}
+		ln.Close()
+	}()
+	return WrapInheritable(ln, raw), nil
+}
+
+// 由http处理产生的连接可选实现,服务通过连接限制后调用admit
+type admitNotifier interface {
+	admit()
+}
+
+// 交给Accept,监听已关闭时返回false
+func (ln *httpListener) deliver(conn net.Conn) bool {
+	select {
+	case ln.conns <- conn:
+		return true
+	case <-ln.closed:
+		return false
+	}
+}
+
+func (ln *httpListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-ln.conns:
+		return conn, nil
+	case <-ln.closed:
+		return nil, ln.errClosed
+	}
+}
+
+func (ln *httpListener) Close() error {
+	var err error
+	ln.closeOnce.Do(func() {
+		close(ln.closed)
+		err = ln.srv.Close()
+	})
+	return err
+}
+
+func (ln *httpListener) Addr() net.Addr {
+	return ln.inner.Addr()
+}
+
+// 关闭信号
+func (ln *httpListener) Done() <-chan struct{} {
+	return ln.closed
+}
@@ -0,0 +1,195 @@
+package meim
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ipiao/meim/log"
+)
+
+// 热重启时监听的传递,参照systemd的socket activation
+// LISTEN_FDS: 传递的fd数量,从3开始
+// LISTEN_FDNAMES: fd名称,以":"分隔,名称为 url.QueryEscape(network://address)
+// LISTEN_PID: 可选,若设置则必须是当前进程
+const (
+	envListenFDs     = "LISTEN_FDS"
+	envListenFDNames = "LISTEN_FDNAMES"
+	envListenPID     = "LISTEN_PID"
+	listenFDStart    = 3
+)
+
+// InheritableListener 可以通过fd传递给子进程的监听
+type InheritableListener interface {
+	net.Listener
+	InheritName() string     // 子进程中用于匹配的名称
+	File() (*os.File, error) // 复制的监听fd
+}
+
+var (
+	inherited     map[string]net.Listener // 从父进程继承的监听
+	inheritedOnce sync.Once
+	inheritedMu   sync.Mutex
+)
+
+func listenName(network, address string) string {
+	return network + "://" + address
+}
+
+// 读取父进程传递的监听,只读取一次
+func loadInherited() {
+	inherited = make(map[string]net.Listener)
+
+	n, names := parseListenEnv(os.Getenv, os.Getpid())
+	if n <= 0 {
+		return
+	}
+	// 避免再传给之后的子进程
+	os.Unsetenv(envListenFDs)
+	os.Unsetenv(envListenFDNames)
+	os.Unsetenv(envListenPID)
+
+	files := make([]*os.File, n)
+	for i := range files {
+		files[i] = os.NewFile(uintptr(listenFDStart+i), fmt.Sprintf("listener-%d", i))
+	}
+	inherited = inheritListeners(files, names)
+}
+
+// 解析传递的fd数量和名称,LISTEN_PID不是pid时返回0
+func parseListenEnv(getenv func(string) string, pid int) (int, []string) {
+	if v := getenv(envListenPID); v != "" && v != strconv.Itoa(pid) {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(getenv(envListenFDs))
+	if err != nil || n <= 0 {
+		return 0, nil
+	}
+	var names []string
+	if v := getenv(envListenFDNames); v != "" {
+		for _, name := range strings.Split(v, ":") {
+			name, _ = url.QueryUnescape(name)
+			names = append(names, name)
+		}
+	}
+	return n, names
+}
+
+// 从传递的fd创建监听,按名称返回,files会被关闭
+func inheritListeners(files []*os.File, names []string) map[string]net.Listener {
+	lns := make(map[string]net.Listener, len(files))
+	for i, f := range files {
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			log.Warnf("inherit listener %s error: %s", f.Name(), err)
+			continue
+		}
+		var name string
+		if i < len(names) {
+			name = names[i]
+		}
+		if name == "" {
+			name = listenName(ln.Addr().Network(), ln.Addr().String())
+		}
+		log.Infof("inherit listener %s, fd %s", name, f.Name())
+		lns[name] = ln
+	}
+	return lns
+}
+
+// 取出继承的监听,先按名称匹配,再按实际地址匹配
+func takeInherited(network, address string) net.Listener {
+	inheritedOnce.Do(loadInherited)
+	inheritedMu.Lock()
+	defer inheritedMu.Unlock()
+
+	for _, name := range []string{listenName(network, address), listenName(addrNetwork(network), address)} {
+		if ln, ok := inherited[name]; ok {
+			delete(inherited, name)
+			return ln
+		}
+	}
+	for name, ln := range inherited {
+		if ln.Addr().String() == address && ln.Addr().Network() == addrNetwork(network) {
+			delete(inherited, name)
+			return ln
+		}
+	}
+	return nil
+}
+
+// tcp4,tcp6的监听地址network都是tcp
+func addrNetwork(network string) string {
+	if strings.HasPrefix(network, "tcp") {
+		return "tcp"
+	}
+	return network
+}
+
+// Listen 与net.Listen相同,但优先使用父进程传递的监听
+// 返回的监听可以在热重启时传递给子进程
+func Listen(network, address string) (net.Listener, error) {
+	ln := takeInherited(network, address)
+	if ln == nil {
+		var err error
+		ln, err = net.Listen(network, address)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &inheritListener{Listener: ln, name: listenName(network, address)}, nil
+}
+
+type inheritListener struct {
+	net.Listener
+	name string
+}
+
+func (ln *inheritListener) InheritName() string {
+	return ln.name
+}
+
+func (ln *inheritListener) File() (*os.File, error) {
+	switch l := ln.Listener.(type) {
+	case *net.TCPListener:
+		return l.File()
+	case *net.UnixListener:
+		// 父进程关闭监听时不能删除socket文件
+		l.SetUnlinkOnClose(false)
+		return l.File()
+	}
+	return nil, fmt.Errorf("listener %s can not be inherited", ln.name)
+}
+
+// NewTLSListener 与tls.NewListener相同,保留内部监听的可传递性
+func NewTLSListener(inner net.Listener, cfg *tls.Config) net.Listener {
+	return WrapInheritable(tls.NewListener(inner, cfg), inner)
+}
+
+// 对可传递监听的包装,如tls
+type wrappedListener struct {
+	net.Listener
+	inner InheritableListener
+}
+
+func (ln *wrappedListener) InheritName() string {
+	return ln.inner.InheritName()
+}
+
+func (ln *wrappedListener) File() (*os.File, error) {
+	return ln.inner.File()
+}
+
+// WrapInheritable 包装内部是可传递监听的监听,使外层监听也可以传递
+func WrapInheritable(outer, inner net.Listener) net.Listener {
+	if il, ok := inner.(InheritableListener); ok {
+		return &wrappedListener{Listener: outer, inner: il}
+	}
+	return outer
+}
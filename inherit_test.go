@@ -0,0 +1,51 @@
+package meim
+
+import (
+	"crypto/tls"
+	"net"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListenInheritable(t *testing.T) {
+	ln, err := Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer ln.Close()
+
+	il, ok := NewTLSListener(ln, &tls.Config{}).(InheritableListener)
+	assert.True(t, ok)
+	assert.Equal(t, "tcp://127.0.0.1:0", il.InheritName())
+
+	f, err := il.File()
+	assert.NoError(t, err)
+	defer f.Close()
+	fln, err := net.FileListener(f)
+	assert.NoError(t, err)
+	assert.Equal(t, ln.Addr().String(), fln.Addr().String())
+	fln.Close()
+}
+
+func TestParseListenEnv(t *testing.T) {
+	env := map[string]string{
+		envListenFDs:     "2",
+		envListenFDNames: url.QueryEscape("tcp://127.0.0.1:0") + ":" + url.QueryEscape("ws://:8080"),
+	}
+	getenv := func(k string) string { return env[k] }
+	n, names := parseListenEnv(getenv, 100)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, []string{"tcp://127.0.0.1:0", "ws://:8080"}, names)
+
+	// 传给其他进程的监听
+	env[envListenPID] = "101"
+	n, _ = parseListenEnv(getenv, 100)
+	assert.Equal(t, 0, n)
+	env[envListenPID] = "100"
+	n, _ = parseListenEnv(getenv, 100)
+	assert.Equal(t, 2, n)
+
+	env[envListenFDs] = "x"
+	n, _ = parseListenEnv(getenv, 100)
+	assert.Equal(t, 0, n)
+}
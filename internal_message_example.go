@@ -3,29 +3,85 @@ package meim
 import (
 	"encoding/binary"
 	"io"
+	"math"
 )
 
 // 内部消息,服务之间或者组件之间进行消息交换
 // example
 type InternalMessage struct {
-	*Message        // 发送的消息体
-	Sender    int64 // 发送人
-	Receiver  int64 // 接收人
-	Timestamp int64 // 时间戳,ms
+	*Message         // 发送的消息体
+	Sender    int64  // 发送人
+	Receiver  int64  // 接收人
+	Timestamp int64  // 时间戳,ms
+	Node      int64  // 发布消息的节点,用于丢弃发回本节点的主题消息,只在主题消息中编码
+	Topic     string // 主题,不为空时发给订阅了主题的节点,不使用Receiver,见TopicBroker
+}
+
+// 消息头之后的扩展字段: sender(8) + receiver(8) + timestamp(8)
+// 主题消息在timestamp的最高位设置标记,之后为 node(8) + 主题长度(2) + 主题
+// 没有主题的消息与旧版本的编码相同
+const (
+	internalExtLength   = 24
+	internalTopicLength = 10
+	internalTopicFlag   = uint64(1) << 63
+)
+
+// 解码扩展字段,返回body的数据
+func decodeInternalExt(message *InternalMessage, b []byte) ([]byte, error) {
+	if len(b) < internalExtLength {
+		return nil, ErrorInvalidMessage
+	}
+	message.Sender = int64(binary.BigEndian.Uint64(b[:8]))
+	message.Receiver = int64(binary.BigEndian.Uint64(b[8:16]))
+	ts := binary.BigEndian.Uint64(b[16:24])
+	message.Timestamp = int64(ts &^ internalTopicFlag)
+	b = b[internalExtLength:]
+	if ts&internalTopicFlag == 0 {
+		return b, nil
+	}
+	if len(b) < internalTopicLength {
+		return nil, ErrorInvalidMessage
+	}
+	message.Node = int64(binary.BigEndian.Uint64(b[:8]))
+	n := int(binary.BigEndian.Uint16(b[8:10]))
+	if len(b) < internalTopicLength+n {
+		return nil, ErrorInvalidMessage
+	}
+	message.Topic = string(b[internalTopicLength : internalTopicLength+n])
+	return b[internalTopicLength+n:], nil
 }
 
 func WriteInternalMessage(conn io.Writer, msg *InternalMessage) error {
-	data, err := EncodeInternalMessage(msg)
+	frame, err := EncodeInternalFrame(msg)
 	if err != nil {
 		return err
 	}
-	_, err = conn.Write(data)
+	_, err = conn.Write(frame.Bytes())
+	frame.Release()
 	return err
 }
 
+// 编码内部消息,返回的数据归调用方所有
 func EncodeInternalMessage(message *InternalMessage) ([]byte, error) {
+	return AppendInternalMessage(nil, message)
+}
+
+// EncodeInternalFrame 编码内部消息到池中的Frame,使用完后调用Release
+func EncodeInternalFrame(message *InternalMessage) (*Frame, error) {
+	frame := getFrame()
+	b, err := AppendInternalMessage(frame.b, message)
+	if err != nil {
+		frame.Release()
+		return nil, err
+	}
+	frame.b = b
+	return frame, nil
+}
+
+// AppendInternalMessage 将内部消息编码后追加到b,返回追加后的切片
+func AppendInternalMessage(b []byte, message *InternalMessage) ([]byte, error) {
 	if message.Header == nil {
-		return nil, ErrorInvalidHeader
+		return b, ErrorInvalidHeader
 	}
 
 	var body []byte
@@ -33,31 +89,45 @@ func EncodeInternalMessage(message *InternalMessage) ([]byte, error) {
 	if message.Body != nil {
 		body, err = message.Body.Encode()
 		if err != nil {
-			return nil, err
+			return b, err
 		}
 	}
 
-	message.Header.SetBodyLength(len(body) + 24)
-
-	buffer := bufPool.Get()
-	defer bufPool.Put(buffer)
+	if len(message.Topic) > math.MaxUint16 {
+		return b, ErrorInvalidMessage
+	}
+	ext := internalExtLength
+	ts := uint64(message.Timestamp)
+	if message.Topic != "" {
+		ext += internalTopicLength + len(message.Topic)
+		ts |= internalTopicFlag
+	}
+	message.Header.SetBodyLength(len(body) + ext)
 
 	hdr, err := message.Header.Encode()
 	if err != nil {
-		return nil, err
+		return b, err
 	}
 
-	buffer.Write(hdr)
-	binary.Write(buffer, binary.BigEndian, message.Sender)
-	binary.Write(buffer, binary.BigEndian, message.Receiver)
-	binary.Write(buffer, binary.BigEndian, message.Timestamp)
-	buffer.Write(body)
-	return buffer.Bytes(), nil
+	b = append(b, hdr...)
+	var buf [internalExtLength + internalTopicLength]byte
+	binary.BigEndian.PutUint64(buf[:8], uint64(message.Sender))
+	binary.BigEndian.PutUint64(buf[8:16], uint64(message.Receiver))
+	binary.BigEndian.PutUint64(buf[16:24], ts)
+	if message.Topic == "" {
+		b = append(b, buf[:internalExtLength]...)
+	} else {
+		binary.BigEndian.PutUint64(buf[24:32], uint64(message.Node))
+		binary.BigEndian.PutUint16(buf[32:34], uint16(len(message.Topic)))
+		b = append(b, buf[:]...)
+		b = append(b, message.Topic...)
+	}
+	return append(b, body...), nil
 }
 
 // 解码
 func DecodeInternalMessgae(b []byte, dc DataCreator) (*InternalMessage, error) {
-	message := new(InternalMessage)
+	message := &InternalMessage{Message: new(Message)}
 	message.Header = dc.CreateHeader()
 
 	headerLength := message.Header.Length()
@@ -77,22 +147,16 @@ func DecodeInternalMessgae(b []byte, dc DataCreator) (*InternalMessage, error) {
 	}
 
 	message.Body = dc.CreateBody(message.Header.Cmd())
-	if bodyLength >= 24 {
-		message.Sender = int64(binary.BigEndian.Uint64(b[headerLength : headerLength+8]))
-		message.Receiver = int64(binary.BigEndian.Uint64(b[headerLength+8 : headerLength+16]))
-		message.Timestamp = int64(binary.BigEndian.Uint64(b[headerLength+16 : headerLength+24]))
-
-		err = message.Body.Decode(b[headerLength+24:])
-	} else {
-		return message, ErrorInvalidMessage
+	body, err := decodeInternalExt(message, b[headerLength:])
+	if err != nil {
+		return message, err
 	}
-
-	return message, err
+	return message, message.Body.Decode(body)
 }
 
 // 编码Message
 func ReadInternalMessage(reader io.Reader, dc DataCreator) (*InternalMessage, error) {
-	message := new(InternalMessage)
+	message := &InternalMessage{Message: new(Message)}
 	header := dc.CreateHeader()
 
 	headerLength := header.Length()
@@ -112,21 +176,19 @@ func ReadInternalMessage(reader io.Reader, dc DataCreator) (*InternalMessage, er
 	bodyLength := header.BodyLength()
 
 	body := dc.CreateBody(header.Cmd())
-	if bodyLength >= 24 {
-		buff = make([]byte, bodyLength)
-		_, err = io.ReadFull(reader, buff)
-		if err != nil {
-			return nil, err
-		}
-
-		message.Sender = int64(binary.BigEndian.Uint64(buff[:8]))
-		message.Receiver = int64(binary.BigEndian.Uint64(buff[8:16]))
-		message.Timestamp = int64(binary.BigEndian.Uint64(buff[16:24]))
-
-		err = body.Decode(buff[24:])
-	} else {
+	if bodyLength < internalExtLength {
 		return message, ErrorInvalidMessage
 	}
+	buff = make([]byte, bodyLength)
+	_, err = io.ReadFull(reader, buff)
+	if err != nil {
+		return nil, err
+	}
+	data, err := decodeInternalExt(message, buff)
+	if err != nil {
+		return message, err
+	}
+	err = body.Decode(data)
 	message.Body = body
 	return message, err
 }
@@ -0,0 +1,139 @@
+package meim
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ipiao/meim/log"
+)
+
+const DefaultKickWait = time.Second // 等待踢下线通知写出的最长时间
+
+// CloseWithReason 关闭客户端,notice不为nil时作为控制消息发出,
+// 只写出notice和其他控制消息,等待写出后(最多DefaultKickWait)关闭连接,
+// 其他未写出的消息留在队列中,关闭后同未写出的消息一样交给会话或ReliableConfig.OnUnacked
+// reason在HandleClientClosed中通过client.CloseReason()获取,只有第一次设置的原因有效
+// 在客户端自己的读写协程中(如HandleMessage、EnqueueEvent的回调)调用时写协程无法写出,
+// 总是等待DefaultKickWait,这时使用CloseWithReasonAsync
+func (client *Client) CloseWithReason(reason CloseReason, notice *Message) {
+	if client.closeWithNotice(reason, notice) {
+		client.waitWritten()
+	}
+}
+
+// CloseWithReasonAsync 同CloseWithReason,但不等待通知写出,超过DefaultKickWait未写完时在后台强制关闭连接
+func (client *Client) CloseWithReasonAsync(reason CloseReason, notice *Message) {
+	if client.closeWithNotice(reason, notice) {
+		go client.waitWritten()
+	}
+}
+
+// 设置关闭原因并发出关闭信号,已经关闭时返回false
+func (client *Client) closeWithNotice(reason CloseReason, notice *Message) bool {
+	if client.closed.Load() {
+		return false
+	}
+	client.setCloseReason(reason)
+	client.controlOnly.Store(true)
+	if notice != nil {
+		client.EnqueuePriorityMessage(notice, PriorityControl, false)
+	}
+	client.closeWithReason(reason)
+	return true
+}
+
+// 等待写协程结束,超过DefaultKickWait时强制关闭连接
+func (client *Client) waitWritten() {
+	timer := time.NewTimer(DefaultKickWait)
+	defer timer.Stop()
+	select {
+	case <-client.writeDone:
+	case <-timer.C:
+		log.Infof("client %s flush kick notice timeout", client.Log())
+		client.flushMessage()
+	}
+}
+
+// Kick 踢下线,通知消息见WithKickNotice
+func (client *Client) Kick(reason CloseReason) {
+	client.CloseWithReason(reason, client.kickMessage(reason))
+}
+
+// 只写出控制消息,只能在写协程中调用
+func (client *Client) flushControl() error {
+	q := client.lanes[PriorityControl]
+	for {
+		for msg := q.pop(); msg != nil; msg = q.pop() {
+			client.appendBatch(msg)
+			if client.batchFull() {
+				break
+			}
+		}
+		n := client.batch.len()
+		if err := client.flushBatch(); err != nil || n == 0 {
+			return err
+		}
+	}
+}
+
+func (client *Client) kickMessage(reason CloseReason) *Message {
+	if client.kickNotice == nil || client.DC == nil {
+		return nil
+	}
+	return client.kickNotice(client, reason)
+}
+
+// 并发踢下线,notice返回每个客户端的通知消息,为nil时使用Kick的通知
+// wait为true时等待全部结束,否则在后台等待通知写出
+func kickClients(clients []*Client, reason CloseReason, notice func(*Client) *Message, wait bool) {
+	if notice == nil {
+		notice = func(c *Client) *Message {
+			return c.kickMessage(reason)
+		}
+	}
+	var wg sync.WaitGroup
+	for _, c := range clients {
+		if !wait {
+			c.CloseWithReasonAsync(reason, notice(c))
+			continue
+		}
+		if !c.closeWithNotice(reason, notice(c)) {
+			continue
+		}
+		wg.Add(1)
+		go func(c *Client) {
+			defer wg.Done()
+			c.waitWritten()
+		}(c)
+	}
+	wg.Wait()
+}
+
+// Kick 踢掉用户的所有已认证客户端,返回客户端数
+func (s *Server) Kick(uid int64, reason CloseReason) int {
+	var clients []*Client
+	s.clientsMu.RLock()
+	for c := range s.clients {
+		if c.Authed() && c.UID == uid {
+			clients = append(clients, c)
+		}
+	}
+	s.clientsMu.RUnlock()
+	kickClients(clients, reason, nil, true)
+	return len(clients)
+}
+
+// Kick 踢掉用户的所有客户端并从路由中移除,返回客户端数
+func (route *Router) Kick(uid int64, reason CloseReason) int {
+	route.mu.Lock()
+	set := route.clients[uid]
+	delete(route.clients, uid)
+	route.mu.Unlock()
+
+	clients := make([]*Client, 0, len(set))
+	for c := range set {
+		clients = append(clients, c)
+	}
+	kickClients(clients, reason, nil, true)
+	return len(clients)
+}
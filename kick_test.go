@@ -0,0 +1,132 @@
+package meim
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKick(t *testing.T) {
+	const reasonBanned = CloseReasonUser + 1
+	reasons := make(chan CloseReason, 2)
+	route := NewRouter()
+	imp := newEchoPlugin()
+	uid := make(chan int64, 2)
+	uid <- 1
+	uid <- 2
+	imp.SetOnAuthClient(func(client *Client) bool {
+		client.DC = testDC
+		client.UID = <-uid
+		route.AddClient(client)
+		return true
+	})
+	imp.SetOnClientClosed(func(client *Client) {
+		route.RemoveClient(client)
+		reasons <- client.CloseReason()
+	})
+	s := newTestServer(t, WithExternalPlugin(imp), WithKickCmd(50))
+	defer s.Stop()
+
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", s.Addrs()[0].String())
+		assert.NoError(t, err)
+		assert.NoError(t, WriteMessage(conn, newTestMessage(1, "hello")))
+		_, err = ReadMessage(conn, testDC)
+		assert.NoError(t, err)
+		return conn
+	}
+	expectKicked := func(conn net.Conn, reason CloseReason) {
+		msg, err := ReadMessage(conn, testDC)
+		assert.NoError(t, err)
+		assert.Equal(t, 50, msg.Header.Cmd())
+		_, err = ReadMessage(conn, testDC)
+		assert.Error(t, err)
+		select {
+		case r := <-reasons:
+			assert.Equal(t, reason, r)
+		case <-time.After(time.Second):
+			t.Fatal("client not closed")
+		}
+	}
+
+	conn1 := dial()
+	defer conn1.Close()
+	conn2 := dial()
+	defer conn2.Close()
+
+	assert.Equal(t, 0, s.Kick(3, reasonBanned))
+	assert.Equal(t, 1, s.Kick(1, reasonBanned))
+	expectKicked(conn1, reasonBanned)
+	assert.Equal(t, "reason-101", reasonBanned.String())
+
+	assert.Equal(t, 1, route.Kick(2, CloseReasonKicked))
+	expectKicked(conn2, CloseReasonKicked)
+	assert.False(t, route.IsOnline(2))
+}
+
+func TestCloseWithReasonControlOnly(t *testing.T) {
+	server, peer := net.Pipe()
+	defer peer.Close()
+	client := NewClient(server)
+	client.plugin = newEchoPlugin()
+	client.DC = testDC
+	for i := 0; i < 10; i++ {
+		assert.True(t, client.EnqueuePriorityMessage(newTestMessage(1, "bulk"), PriorityBulk, false))
+	}
+
+	done := make(chan struct{})
+	go func() {
+		client.CloseWithReason(CloseReasonKicked, NewCmdMessage(testDC, 50))
+		close(done)
+	}()
+	assert.Eventually(t, func() bool {
+		select {
+		case <-client.closeCh:
+			return true
+		default:
+			return false
+		}
+	}, time.Second, time.Millisecond*10)
+	// 只留下关闭信号,写协程不会先写出其他消息
+	select {
+	case <-client.notify:
+	default:
+	}
+	go client.write()
+
+	// 只写出通知,其他消息留在队列中
+	msg, err := ReadMessage(peer, testDC)
+	assert.NoError(t, err)
+	assert.Equal(t, 50, msg.Header.Cmd())
+	_, err = ReadMessage(peer, testDC)
+	assert.Error(t, err)
+	<-done
+	assert.Len(t, client.closeQueues(), 10)
+}
+
+func TestCloseWithReasonAsync(t *testing.T) {
+	server, peer := net.Pipe()
+	defer peer.Close()
+	client := NewClient(server)
+	client.plugin = newEchoPlugin()
+	client.DC = testDC
+	go client.write()
+
+	// 在写协程中关闭,不等待通知写出
+	elapsed := make(chan time.Duration, 1)
+	assert.True(t, client.EnqueueEvent(func(c *Client) {
+		start := time.Now()
+		c.CloseWithReasonAsync(CloseReasonKicked, NewCmdMessage(testDC, 50))
+		elapsed <- time.Since(start)
+	}))
+	assert.Less(t, int64(<-elapsed), int64(DefaultKickWait/2))
+
+	msg, err := ReadMessage(peer, testDC)
+	assert.NoError(t, err)
+	assert.Equal(t, 50, msg.Header.Cmd())
+	_, err = ReadMessage(peer, testDC)
+	assert.Error(t, err)
+	assert.Equal(t, CloseReasonKicked, client.CloseReason())
+}
@@ -0,0 +1,299 @@
+package meim
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/atomic"
+)
+
+// 连接限制,在创建Client之前进行检查
+
+// ConnLimitConfig 连接限制配置,零值表示不限制
+type ConnLimitConfig struct {
+	MaxConnPerIP     int      // 单个ip最大连接数
+	AcceptRate       float64  // 全局每秒accept数
+	AcceptBurst      int      // 全局accept突发数
+	AcceptRatePerIP  float64  // 单个ip每秒accept数
+	AcceptBurstPerIP int      // 单个ip accept突发数
+	Allow            []string // 白名单,CIDR或ip,不为空时只允许名单内的ip
+	Deny             []string // 黑名单,CIDR或ip,优先于白名单
+}
+
+// RejectStats 被拒绝的连接数
+type RejectStats struct {
+	MaxConn      int64 // 超过最大连接数
+	MaxConnPerIP int64 // 超过单ip最大连接数
+	Rate         int64 // 超过全局accept速率
+	RatePerIP    int64 // 超过单ip accept速率
+	Denied       int64 // 不在白名单或在黑名单中
+}
+
+// 拒绝原因
+type rejectReason int
+
+const (
+	rejectNone rejectReason = iota
+	rejectMaxConn
+	rejectMaxConnPerIP
+	rejectRate
+	rejectRatePerIP
+	rejectDenied
+)
+
+func (r rejectReason) String() string {
+	switch r {
+	case rejectMaxConn:
+		return "too many connections"
+	case rejectMaxConnPerIP:
+		return "too many connections per ip"
+	case rejectRate:
+		return "accept rate limited"
+	case rejectRatePerIP:
+		return "accept rate limited per ip"
+	case rejectDenied:
+		return "ip denied"
+	}
+	return "none"
+}
+
+// 令牌桶
+type tokenBucket struct {
+	rate   float64 // 每秒产生的令牌
+	burst  float64 // 桶容量
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   now,
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+}
+
+func (b *tokenBucket) allow(now time.Time) bool {
+	if !b.available(now) {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// 是否有令牌,不消耗
+func (b *tokenBucket) available(now time.Time) bool {
+	b.refill(now)
+	return b.tokens >= 1
+}
+
+// 已满的桶可以回收
+func (b *tokenBucket) full(now time.Time) bool {
+	b.refill(now)
+	return b.tokens >= b.burst
+}
+
+// 单个ip的状态
+type ipState struct {
+	conns  int
+	bucket *tokenBucket
+}
+
+type connLimiter struct {
+	cfg   ConnLimitConfig
+	allow []*net.IPNet
+	deny  []*net.IPNet
+
+	mu        sync.Mutex
+	global    *tokenBucket
+	ips       map[string]*ipState
+	lastSweep time.Time
+
+	rejectMaxConn      atomic.Int64
+	rejectMaxConnPerIP atomic.Int64
+	rejectRate         atomic.Int64
+	rejectRatePerIP    atomic.Int64
+	rejectDenied       atomic.Int64
+}
+
+func newConnLimiter(cfg ConnLimitConfig) (*connLimiter, error) {
+	now := time.Now()
+	l := &connLimiter{
+		cfg:       cfg,
+		ips:       make(map[string]*ipState),
+		lastSweep: now,
+	}
+	var err error
+	if l.allow, err = parseCIDRs(cfg.Allow); err != nil {
+		return nil, err
+	}
+	if l.deny, err = parseCIDRs(cfg.Deny); err != nil {
+		return nil, err
+	}
+	if cfg.AcceptRate > 0 {
+		l.global = newTokenBucket(cfg.AcceptRate, cfg.AcceptBurst, now)
+	}
+	return l, nil
+}
+
+// 解析CIDR,单个ip视为/32或/128
+func parseCIDRs(list []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(list))
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid ip: %s", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// 远端ip,非ip连接(如unix)返回nil
+func remoteIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	case nil:
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// 检查是否接受连接,接受后需要调用release
+// count为当前的总连接数
+func (l *connLimiter) admit(ip net.IP, count, maxConn int) rejectReason {
+	if ip != nil {
+		if containsIP(l.deny, ip) || (len(l.allow) > 0 && !containsIP(l.allow, ip)) {
+			l.rejectDenied.Inc()
+			return rejectDenied
+		}
+	}
+
+	if count >= maxConn {
+		l.rejectMaxConn.Inc()
+		return rejectMaxConn
+	}
+
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// 先检查所有限制,都通过后才消耗令牌,被拒绝的连接不占用其他限制的令牌
+	var st *ipState
+	if ip != nil && (l.cfg.MaxConnPerIP > 0 || l.cfg.AcceptRatePerIP > 0) {
+		l.sweep(now)
+		key := ip.String()
+		var ok bool
+		if st, ok = l.ips[key]; !ok {
+			st = new(ipState)
+			if l.cfg.AcceptRatePerIP > 0 {
+				st.bucket = newTokenBucket(l.cfg.AcceptRatePerIP, l.cfg.AcceptBurstPerIP, now)
+			}
+			l.ips[key] = st
+		}
+		if l.cfg.MaxConnPerIP > 0 && st.conns >= l.cfg.MaxConnPerIP {
+			l.rejectMaxConnPerIP.Inc()
+			return rejectMaxConnPerIP
+		}
+		if st.bucket != nil && !st.bucket.available(now) {
+			l.rejectRatePerIP.Inc()
+			return rejectRatePerIP
+		}
+	}
+	if l.global != nil && !l.global.allow(now) {
+		l.rejectRate.Inc()
+		return rejectRate
+	}
+	if st != nil {
+		if st.bucket != nil {
+			st.bucket.allow(now)
+		}
+		st.conns++
+	}
+	return rejectNone
+}
+
+// 连接关闭
+func (l *connLimiter) release(ip net.IP) {
+	if ip == nil || (l.cfg.MaxConnPerIP <= 0 && l.cfg.AcceptRatePerIP <= 0) {
+		return
+	}
+	key := ip.String()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if st, ok := l.ips[key]; ok {
+		st.conns--
+		if st.conns <= 0 && st.bucket == nil {
+			delete(l.ips, key)
+		}
+	}
+}
+
+// 定期回收没有连接且令牌已满的ip
+func (l *connLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	for key, st := range l.ips {
+		if st.conns <= 0 && (st.bucket == nil || st.bucket.full(now)) {
+			delete(l.ips, key)
+		}
+	}
+}
+
+func (l *connLimiter) stats() RejectStats {
+	return RejectStats{
+		MaxConn:      l.rejectMaxConn.Load(),
+		MaxConnPerIP: l.rejectMaxConnPerIP.Load(),
+		Rate:         l.rejectRate.Load(),
+		RatePerIP:    l.rejectRatePerIP.Load(),
+		Denied:       l.rejectDenied.Load(),
+	}
+}
@@ -0,0 +1,73 @@
+package meim
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := newTokenBucket(10, 2, now)
+	assert.True(t, b.allow(now))
+	assert.True(t, b.allow(now))
+	assert.False(t, b.allow(now))
+	assert.True(t, b.allow(now.Add(time.Millisecond*100)))
+	assert.True(t, b.full(now.Add(time.Second)))
+}
+
+func TestConnLimiter(t *testing.T) {
+	_, err := newConnLimiter(ConnLimitConfig{Deny: []string{"10.0.0.1/33"}})
+	assert.Error(t, err)
+
+	l, err := newConnLimiter(ConnLimitConfig{
+		MaxConnPerIP: 2,
+		Allow:        []string{"10.0.0.0/8", "192.168.1.1"},
+		Deny:         []string{"10.0.0.2"},
+	})
+	assert.NoError(t, err)
+
+	ip := net.ParseIP("10.0.0.1")
+	assert.Equal(t, rejectNone, l.admit(ip, 0, 10))
+	assert.Equal(t, rejectNone, l.admit(ip, 1, 10))
+	assert.Equal(t, rejectMaxConnPerIP, l.admit(ip, 2, 10))
+	l.release(ip)
+	assert.Equal(t, rejectNone, l.admit(ip, 2, 10))
+
+	assert.Equal(t, rejectDenied, l.admit(net.ParseIP("10.0.0.2"), 0, 10))
+	assert.Equal(t, rejectDenied, l.admit(net.ParseIP("172.16.0.1"), 0, 10))
+	assert.Equal(t, rejectNone, l.admit(net.ParseIP("192.168.1.1"), 0, 10))
+	assert.Equal(t, rejectMaxConn, l.admit(net.ParseIP("192.168.1.1"), 10, 10))
+	assert.Equal(t, rejectNone, l.admit(nil, 0, 10))
+
+	assert.Equal(t, RejectStats{MaxConn: 1, MaxConnPerIP: 1, Denied: 2}, l.stats())
+}
+
+func TestConnLimiterOrder(t *testing.T) {
+	l, err := newConnLimiter(ConnLimitConfig{MaxConnPerIP: 1, AcceptRate: 0.001, AcceptBurst: 2})
+	assert.NoError(t, err)
+
+	ip := net.ParseIP("10.0.0.1")
+	assert.Equal(t, rejectNone, l.admit(ip, 0, 10))
+	// 被其他限制拒绝的连接不消耗全局令牌
+	assert.Equal(t, rejectMaxConn, l.admit(net.ParseIP("10.0.0.2"), 10, 10))
+	assert.Equal(t, rejectMaxConnPerIP, l.admit(ip, 1, 10))
+	assert.Equal(t, rejectNone, l.admit(net.ParseIP("10.0.0.2"), 1, 10))
+	assert.Equal(t, rejectRate, l.admit(net.ParseIP("10.0.0.3"), 2, 10))
+}
+
+func TestServerAcceptRate(t *testing.T) {
+	s := newTestServer(t, WithAcceptRate(0.001, 1))
+	defer s.Stop()
+
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", s.Addrs()[0].String())
+		assert.NoError(t, err)
+		defer conn.Close()
+	}
+	time.Sleep(time.Millisecond * 100)
+	assert.Equal(t, int64(1), s.RejectStats().Rate)
+	assert.Len(t, s.ClientSet(), 1)
+}
@@ -10,12 +10,20 @@ import (
 // 监听服务,适配不同的网络服务
 
 type ListenerConfig struct {
+	Name      string // 监听名称,可选,用于区分客户端来自哪个监听
 	Network   string
 	Address   string
 	TLSConfig *tls.Config
 	Options   map[string]interface{} // 为了在不囊括某些配置的时候,能够支持自定义listener的配置信息
 }
 
+func (cfg *ListenerConfig) String() string {
+	if cfg.Name != "" {
+		return cfg.Name
+	}
+	return cfg.Network + "://" + cfg.Address
+}
+
 // listener
 type MakeListener func(cfg *ListenerConfig) (ln net.Listener, err error)
 
@@ -35,15 +43,18 @@ func init() {
 	makeListeners["tcp4"] = tcpMakeListener("tcp4")
 	makeListeners["tcp6"] = tcpMakeListener("tcp6")
 	makeListeners["http"] = tcpMakeListener("tcp")
+	makeListeners["ws"] = wsMakeListener(false)
+	makeListeners["wss"] = wsMakeListener(true)
+	makeListeners["poll"] = pollMakeListener(false)
+	makeListeners["polls"] = pollMakeListener(true)
 }
 
 func tcpMakeListener(network string) func(cfg *ListenerConfig) (ln net.Listener, err error) {
 	return func(cfg *ListenerConfig) (ln net.Listener, err error) {
-		if cfg.TLSConfig == nil {
-			ln, err = net.Listen(network, cfg.Address)
-		} else {
-			ln, err = tls.Listen(network, cfg.Address, cfg.TLSConfig)
+		ln, err = Listen(network, cfg.Address)
+		if err != nil || cfg.TLSConfig == nil {
+			return ln, err
 		}
-		return ln, err
+		return NewTLSListener(ln, cfg.TLSConfig), nil
 	}
 }
@@ -0,0 +1,582 @@
+package meim
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ipiao/meim/log"
+)
+
+// http长轮询/SSE传输,用于无法使用tcp和websocket的环境
+// 每个会话对应一个虚拟连接,Client的读写与tcp连接相同
+//
+// POST {Path}/open              创建会话,返回会话id,服务拒绝连接或等待接受的会话过多时返回503
+// POST {Path}/send?sid=ID       上行,body为一个或多个完整的消息,超过MaxPending返回413,上行积压已满返回429
+// GET  {Path}/poll?sid=ID       长轮询下行,body为拼接的消息,没有数据时返回204
+// GET  {Path}/events?sid=ID     SSE下行,每个事件的data为一个消息的base64编码
+// POST {Path}/close?sid=ID      关闭会话
+// 同一会话同时只能有一个下行请求,否则返回409,下行消息在响应写出后才移除
+// 会话不存在或已关闭时返回410,服务端关闭的会话在超时前仍可以取走剩余的下行消息
+
+const (
+	DefaultPollTimeout        = time.Second * 25
+	DefaultPollSessionTimeout = time.Minute
+	DefaultPollMaxPending     = 1024 * 1024
+	DefaultPollMaxOpening     = 128
+)
+
+var (
+	ErrorPollSessionClosed = errors.New("poll session closed")
+	errorPollTimeout       = &pollTimeoutError{}
+)
+
+// 实现net.Error,NetConn的读写超时
+type pollTimeoutError struct{}
+
+func (e *pollTimeoutError) Error() string   { return "poll session i/o timeout" }
+func (e *pollTimeoutError) Timeout() bool   { return true }
+func (e *pollTimeoutError) Temporary() bool { return true }
+
+// PollConn 长轮询会话的虚拟连接,实现了net.Conn
+type PollConn struct {
+	id         string
+	localAddr  net.Addr
+	remoteAddr net.Addr
+	maxPending int
+
+	mu            sync.Mutex
+	upstream      []byte        // 上行数据,最多maxPending字节
+	downstream    [][]byte      // 下行消息,每次Write为一个消息
+	pending       int           // 下行未取走的字节数
+	taker         chan struct{} // 正在取下行消息的请求,同时只能有一个
+	readable      chan struct{} // 有上行数据(信号)
+	writable      chan struct{} // 下行有空间(信号)
+	polled        chan struct{} // 有下行数据(信号)
+	readDeadline  time.Time
+	writeDeadline time.Time
+	lastActive    time.Time
+
+	admitted  chan struct{} // 服务接受了连接
+	admitOnce sync.Once
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newPollConn(id string, local, remote net.Addr, maxPending int) *PollConn {
+	return &PollConn{
+		id:         id,
+		localAddr:  local,
+		remoteAddr: remote,
+		maxPending: maxPending,
+		readable:   make(chan struct{}, 1),
+		writable:   make(chan struct{}, 1),
+		polled:     make(chan struct{}, 1),
+		taker:      make(chan struct{}, 1),
+		lastActive: time.Now(),
+		admitted:   make(chan struct{}),
+		closed:     make(chan struct{}),
+	}
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// 截止时间的计时通道,零值表示不超时
+func deadlineC(t time.Time) (<-chan time.Time, func()) {
+	if t.IsZero() {
+		return nil, func() {}
+	}
+	timer := time.NewTimer(time.Until(t))
+	return timer.C, func() { timer.Stop() }
+}
+
+// ID 会话id
+func (c *PollConn) ID() string {
+	return c.id
+}
+
+func (c *PollConn) Read(b []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		if len(c.upstream) > 0 {
+			n := copy(b, c.upstream)
+			c.upstream = c.upstream[n:]
+			c.mu.Unlock()
+			return n, nil
+		}
+		deadline := c.readDeadline
+		c.mu.Unlock()
+
+		timeout, stop := deadlineC(deadline)
+		select {
+		case <-c.readable:
+			stop()
+		case <-c.closed:
+			stop()
+			return 0, ErrorPollSessionClosed
+		case <-timeout:
+			return 0, errorPollTimeout
+		}
+	}
+}
+
+// Write 每次写入一个完整的消息,下行积压超过maxPending时阻塞
+func (c *PollConn) Write(b []byte) (int, error) {
+	data := make([]byte, len(b))
+	copy(data, b)
+	for {
+		c.mu.Lock()
+		select {
+		case <-c.closed:
+			c.mu.Unlock()
+			return 0, ErrorPollSessionClosed
+		default:
+		}
+		if c.pending == 0 || c.pending+len(data) <= c.maxPending {
+			c.downstream = append(c.downstream, data)
+			c.pending += len(data)
+			c.mu.Unlock()
+			notify(c.polled)
+			return len(b), nil
+		}
+		deadline := c.writeDeadline
+		c.mu.Unlock()
+
+		timeout, stop := deadlineC(deadline)
+		select {
+		case <-c.writable:
+			stop()
+		case <-c.closed:
+			stop()
+			return 0, ErrorPollSessionClosed
+		case <-timeout:
+			return 0, errorPollTimeout
+		}
+	}
+}
+
+// 上行数据,积压超过maxPending时返回false
+func (c *PollConn) push(data []byte) bool {
+	c.mu.Lock()
+	if len(c.upstream) > 0 && len(c.upstream)+len(data) > c.maxPending {
+		c.mu.Unlock()
+		return false
+	}
+	c.upstream = append(c.upstream, data...)
+	c.lastActive = time.Now()
+	c.mu.Unlock()
+	notify(c.readable)
+	return true
+}
+
+// 开始取下行消息,已有请求在取时返回false
+func (c *PollConn) acquire() bool {
+	select {
+	case c.taker <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *PollConn) release() {
+	<-c.taker
+}
+
+// 等待下行消息,至多等待timeout,返回的消息在ack之后才移除
+// 会话已关闭并且没有剩余的消息时closed为true
+func (c *PollConn) peek(timeout time.Duration, cancel <-chan struct{}) (msgs [][]byte, closed bool) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		c.mu.Lock()
+		c.lastActive = time.Now()
+		if len(c.downstream) > 0 {
+			msgs = append(msgs, c.downstream...)
+			c.mu.Unlock()
+			return msgs, false
+		}
+		c.mu.Unlock()
+		// 关闭后不会再有写入,再检查一次后返回
+		if closed {
+			return nil, true
+		}
+
+		select {
+		case <-c.polled:
+		case <-c.closed:
+			closed = true
+		case <-cancel:
+			return nil, false
+		case <-timer.C:
+			return nil, false
+		}
+	}
+}
+
+// 移除已写出的下行消息,msgs为peek的返回
+func (c *PollConn) ack(msgs [][]byte) {
+	c.mu.Lock()
+	for _, msg := range msgs {
+		c.pending -= len(msg)
+	}
+	c.downstream = append(c.downstream[:0:0], c.downstream[len(msgs):]...)
+	c.mu.Unlock()
+	notify(c.writable)
+}
+
+func (c *PollConn) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *PollConn) idle(timeout time.Duration) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return time.Since(c.lastActive) > timeout
+}
+
+// 服务通过连接限制后调用,见admitNotifier
+func (c *PollConn) admit() {
+	c.admitOnce.Do(func() { close(c.admitted) })
+}
+
+func (c *PollConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		log.Debugf("poll session %s closed", c.id)
+	})
+	return nil
+}
+
+func (c *PollConn) LocalAddr() net.Addr  { return c.localAddr }
+func (c *PollConn) RemoteAddr() net.Addr { return c.remoteAddr }
+
+func (c *PollConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *PollConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	notify(c.readable)
+	return nil
+}
+
+func (c *PollConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.mu.Unlock()
+	notify(c.writable)
+	return nil
+}
+
+// 长轮询的http处理,管理会话
+type pollHandler struct {
+	ln             *httpListener
+	path           string
+	pollTimeout    time.Duration
+	sessionTimeout time.Duration
+	maxPending     int
+	allowOrigin    string
+	opening        chan struct{} // 等待服务接受的会话,限制同时打开的数量
+
+	mu       sync.RWMutex
+	sessions map[string]*PollConn
+}
+
+// Options:
+// "Path": string, 路径前缀
+// "PollTimeout": time.Duration, 长轮询等待时间
+// "SessionTimeout": time.Duration, 会话没有任何请求的超时时间
+// "MaxPending": int, 上行和下行积压的最大字节数
+// "MaxOpening": int, 同时等待服务接受的会话数,超过时open返回503
+// "AllowOrigin": string, 跨域时的Access-Control-Allow-Origin
+func pollMakeListener(secure bool) MakeListener {
+	return func(cfg *ListenerConfig) (net.Listener, error) {
+		h := &pollHandler{
+			pollTimeout:    DefaultPollTimeout,
+			sessionTimeout: DefaultPollSessionTimeout,
+			maxPending:     DefaultPollMaxPending,
+			sessions:       make(map[string]*PollConn),
+		}
+		maxOpening := DefaultPollMaxOpening
+		if opts := cfg.Options; opts != nil {
+			h.path, _ = opts["Path"].(string)
+			h.allowOrigin, _ = opts["AllowOrigin"].(string)
+			if d, ok := opts["PollTimeout"].(time.Duration); ok && d > 0 {
+				h.pollTimeout = d
+			}
+			if d, ok := opts["SessionTimeout"].(time.Duration); ok && d > 0 {
+				h.sessionTimeout = d
+			}
+			if n, ok := opts["MaxPending"].(int); ok && n > 0 {
+				h.maxPending = n
+			}
+			if n, ok := opts["MaxOpening"].(int); ok && n > 0 {
+				maxOpening = n
+			}
+		}
+		h.opening = make(chan struct{}, maxOpening)
+		// 轮询期间会话不能超时
+		if h.pollTimeout > h.sessionTimeout/2 {
+			log.Warnf("poll listener %s: PollTimeout %s clamped to half of SessionTimeout %s", cfg, h.pollTimeout, h.sessionTimeout)
+			h.pollTimeout = h.sessionTimeout / 2
+		}
+		h.path = strings.TrimSuffix(h.path, "/")
+		ln, err := makeHTTPListener(cfg, secure, func(ln *httpListener) http.Handler {
+			h.ln = ln
+			return h
+		})
+		if err != nil {
+			return nil, err
+		}
+		go h.expire()
+		return ln, nil
+	}
+}
+
+func (h *pollHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.allowOrigin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", h.allowOrigin)
+		if r.Method == http.MethodOptions {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+	if !strings.HasPrefix(r.URL.Path, h.path+"/") {
+		http.NotFound(w, r)
+		return
+	}
+	action := strings.TrimPrefix(r.URL.Path, h.path+"/")
+	if action == "open" {
+		h.open(w, r)
+		return
+	}
+
+	conn := h.session(r.URL.Query().Get("sid"))
+	if conn == nil {
+		http.Error(w, "session closed", http.StatusGone)
+		return
+	}
+	if conn.isClosed() && action == "send" {
+		http.Error(w, "session closed", http.StatusGone)
+		return
+	}
+	switch action {
+	case "send":
+		h.send(w, r, conn)
+	case "poll":
+		h.poll(w, r, conn)
+	case "events":
+		h.events(w, r, conn)
+	case "close":
+		conn.Close()
+		h.remove(conn)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (h *pollHandler) session(id string) *PollConn {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.sessions[id]
+}
+
+func (h *pollHandler) open(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	remote, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	select {
+	case h.opening <- struct{}{}:
+		defer func() { <-h.opening }()
+	default:
+		http.Error(w, "too many opening sessions", http.StatusServiceUnavailable)
+		return
+	}
+	conn := newPollConn(hex.EncodeToString(b), h.ln.Addr(), remote, h.maxPending)
+	if !h.ln.deliver(conn) {
+		conn.Close()
+		http.Error(w, "server closed", http.StatusServiceUnavailable)
+		return
+	}
+	// 通过服务的连接限制后才记录会话,被拒绝的连接已经关闭
+	select {
+	case <-conn.admitted:
+	case <-conn.closed:
+		http.Error(w, "connection rejected", http.StatusServiceUnavailable)
+		return
+	case <-r.Context().Done():
+		conn.Close()
+		return
+	}
+	h.mu.Lock()
+	h.sessions[conn.id] = conn
+	h.mu.Unlock()
+	log.Debugf("poll session %s opened, addr: %s", conn.id, r.RemoteAddr)
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(conn.id))
+}
+
+func (h *pollHandler) remove(conn *PollConn) {
+	h.mu.Lock()
+	delete(h.sessions, conn.id)
+	h.mu.Unlock()
+}
+
+func (h *pollHandler) send(w http.ResponseWriter, r *http.Request, conn *PollConn) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, int64(h.maxPending)+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(data) > h.maxPending {
+		http.Error(w, "request too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if !conn.push(data) {
+		http.Error(w, "too many pending requests", http.StatusTooManyRequests)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *pollHandler) poll(w http.ResponseWriter, r *http.Request, conn *PollConn) {
+	if !conn.acquire() {
+		http.Error(w, "poll in progress", http.StatusConflict)
+		return
+	}
+	defer conn.release()
+	msgs, closed := conn.peek(h.pollTimeout, r.Context().Done())
+	if closed {
+		h.remove(conn)
+		http.Error(w, "session closed", http.StatusGone)
+		return
+	}
+	if len(msgs) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	bufs := net.Buffers(msgs)
+	if _, err := bufs.WriteTo(w); err == nil {
+		conn.ack(msgs)
+	}
+}
+
+func (h *pollHandler) events(w http.ResponseWriter, r *http.Request, conn *PollConn) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	if !conn.acquire() {
+		http.Error(w, "poll in progress", http.StatusConflict)
+		return
+	}
+	defer conn.release()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		msgs, closed := conn.peek(h.pollTimeout, r.Context().Done())
+		if closed {
+			h.remove(conn)
+			return
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		default:
+		}
+		if len(msgs) == 0 {
+			// 保持连接
+			if _, err := w.Write([]byte(":\n\n")); err != nil {
+				return
+			}
+		}
+		for _, msg := range msgs {
+			if _, err := w.Write([]byte("data: " + base64.StdEncoding.EncodeToString(msg) + "\n\n")); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+		conn.ack(msgs)
+	}
+}
+
+// 关闭并移除长时间没有请求的会话,包括等待取走剩余消息的已关闭会话
+func (h *pollHandler) expire() {
+	ticker := time.NewTicker(h.sessionTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-h.ln.Done():
+			h.mu.RLock()
+			var conns []*PollConn
+			for _, conn := range h.sessions {
+				conns = append(conns, conn)
+			}
+			h.mu.RUnlock()
+			for _, conn := range conns {
+				conn.Close()
+				h.remove(conn)
+			}
+			return
+		}
+
+		var expired []*PollConn
+		h.mu.RLock()
+		for _, conn := range h.sessions {
+			if conn.idle(h.sessionTimeout) {
+				expired = append(expired, conn)
+			}
+		}
+		h.mu.RUnlock()
+		for _, conn := range expired {
+			log.Infof("poll session %s expired", conn.id)
+			conn.Close()
+			h.remove(conn)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package meim
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newPollTestServer(t *testing.T, options ...OptionFn) (*Server, string) {
+	s := newTestServer(t, append(options, WithListenerConfig(&ListenerConfig{
+		Network: "poll",
+		Address: "127.0.0.1:0",
+		Options: map[string]interface{}{
+			"Path":        "/im",
+			"PollTimeout": time.Second,
+			"MaxPending":  1024,
+		},
+	}))...)
+	return s, "http://" + s.Addrs()[1].String() + "/im"
+}
+
+func openPollSession(t *testing.T, base string) string {
+	resp, err := http.Post(base+"/open", "", nil)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	sid, err := ioutil.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	return string(sid)
+}
+
+func sendPollMessage(t *testing.T, base, sid string, msg *Message) {
+	data, err := EncodeMessage(msg)
+	assert.NoError(t, err)
+	resp, err := http.Post(base+"/send?sid="+sid, "application/octet-stream", bytes.NewReader(append([]byte(nil), data...)))
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+}
+
+func TestLongPoll(t *testing.T) {
+	s, base := newPollTestServer(t)
+	defer s.Stop()
+
+	sid := openPollSession(t, base)
+	sendPollMessage(t, base, sid, newTestMessage(3, "hello poll"))
+
+	resp, err := http.Get(base + "/poll?sid=" + sid)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	data, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.NoError(t, err)
+	msg, err := DecodeMessage(data, testDC)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, msg.Header.Cmd())
+	assert.Equal(t, "hello poll", string(*msg.Body.(*plainData)))
+
+	// 没有数据时超时返回
+	resp, err = http.Get(base + "/poll?sid=" + sid)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	// 关闭后会话失效
+	resp, err = http.Post(base+"/close?sid="+sid, "", nil)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	resp, err = http.Get(base + "/poll?sid=" + sid)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusGone, resp.StatusCode)
+}
+
+func TestLongPollEvents(t *testing.T) {
+	s, base := newPollTestServer(t)
+	defer s.Stop()
+
+	sid := openPollSession(t, base)
+	resp, err := http.Get(base + "/events?sid=" + sid)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	sendPollMessage(t, base, sid, newTestMessage(5, "hello sse"))
+
+	br := bufio.NewReader(resp.Body)
+	for {
+		line, err := br.ReadString('\n')
+		assert.NoError(t, err)
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(strings.TrimPrefix(line, "data: ")))
+		assert.NoError(t, err)
+		msg, err := DecodeMessage(data, testDC)
+		assert.NoError(t, err)
+		assert.Equal(t, 5, msg.Header.Cmd())
+		assert.Equal(t, "hello sse", string(*msg.Body.(*plainData)))
+		break
+	}
+}
+
+func TestPollConnPending(t *testing.T) {
+	conn := newPollConn("test", nil, nil, 8)
+	assert.True(t, conn.push([]byte("12345")))
+	// 上行积压已满
+	assert.False(t, conn.push([]byte("6789")))
+	b := make([]byte, 8)
+	n, err := conn.Read(b)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, n)
+	assert.True(t, conn.push([]byte("6789")))
+
+	// 下行消息在ack之后才移除
+	conn.Write([]byte("a"))
+	conn.Write([]byte("b"))
+	msgs, closed := conn.peek(time.Millisecond, nil)
+	assert.False(t, closed)
+	assert.Len(t, msgs, 2)
+	conn.Write([]byte("c"))
+	msgs, _ = conn.peek(time.Millisecond, nil)
+	assert.Len(t, msgs, 3)
+	conn.ack(msgs[:2])
+	msgs, _ = conn.peek(time.Millisecond, nil)
+	assert.Equal(t, [][]byte{[]byte("c")}, msgs)
+
+	// 关闭后仍可以取走剩余的消息
+	assert.True(t, conn.acquire())
+	assert.False(t, conn.acquire())
+	conn.release()
+	conn.Close()
+	msgs, closed = conn.peek(time.Millisecond, nil)
+	assert.False(t, closed)
+	conn.ack(msgs)
+	_, closed = conn.peek(time.Millisecond, nil)
+	assert.True(t, closed)
+}
+
+func TestLongPollDrainOnClose(t *testing.T) {
+	s, base := newPollTestServer(t)
+	defer s.Stop()
+	sid := openPollSession(t, base)
+
+	resp, err := http.Post(base+"/send?sid="+sid, "application/octet-stream", bytes.NewReader(make([]byte, 2048)))
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+
+	// 踢下线的通知在会话关闭后仍可以取走
+	var client *Client
+	assert.Eventually(t, func() bool {
+		for c := range s.ClientSet() {
+			client = c
+		}
+		return client != nil && client.Authed()
+	}, time.Second, time.Millisecond*10)
+	client.CloseWithReason(CloseReasonKicked, NewCmdMessage(testDC, 99))
+	<-client.Done()
+
+	resp, err = http.Get(base + "/poll?sid=" + sid)
+	assert.NoError(t, err)
+	data, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	msg, err := DecodeMessage(data, testDC)
+	assert.NoError(t, err)
+	assert.Equal(t, 99, msg.Header.Cmd())
+
+	resp, err = http.Get(base + "/poll?sid=" + sid)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusGone, resp.StatusCode)
+}
+
+func pollHandlerOf(s *Server) *pollHandler {
+	s.mu.RLock()
+	ln := s.lns[1]
+	s.mu.RUnlock()
+	if w, ok := ln.(*wrappedListener); ok {
+		ln = w.Listener
+	}
+	return ln.(*httpListener).srv.Handler.(*pollHandler)
+}
+
+func TestLongPollRejected(t *testing.T) {
+	s, base := newPollTestServer(t, WithMaxConn(1))
+	defer s.Stop()
+	openPollSession(t, base)
+
+	// 超过连接数的会话被拒绝,不会记录
+	resp, err := http.Post(base+"/open", "", nil)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	h := pollHandlerOf(s)
+	h.mu.RLock()
+	assert.Len(t, h.sessions, 1)
+	h.mu.RUnlock()
+}
+
+func TestLongPollTimeoutClamped(t *testing.T) {
+	s := newTestServer(t, WithListenerConfig(&ListenerConfig{
+		Network: "poll",
+		Address: "127.0.0.1:0",
+		Options: map[string]interface{}{
+			"PollTimeout":    time.Minute,
+			"SessionTimeout": time.Second * 10,
+		},
+	}))
+	defer s.Stop()
+	assert.Equal(t, time.Second*5, pollHandlerOf(s).pollTimeout)
+}
@@ -1,13 +1,13 @@
 package meim
 
 import (
+	"bufio"
 	"errors"
 	"fmt"
 	"io"
 	"reflect"
 
 	"github.com/ipiao/meim/log"
-	"github.com/ipiao/meim/util"
 )
 
 var (
@@ -15,17 +15,30 @@ var (
 	ErrorInvalidHeader   = errors.New("invalid header")
 	ErrorReadOutofRange  = errors.New("read body length out of range")
 	ErrorWriteOutofRange = errors.New("write body length out of range")
-
-	bufPool = util.NewBufferPool()
 )
 
 // 协议数据,定义了数据基本交换协议
 // 头和body 都属于协议数据
+// Decode传入的字节归协议数据所有,实现DecodeBufferReuser时除外
 type ProtocolData interface {
 	Decode(b []byte) error   // 从字节中读取
 	Encode() ([]byte, error) // 编码
 }
 
+// DecodeBufferReuser 可选,协议头或body实现并返回true时,Decode传入的字节在读取下一个消息时会被复用,
+// Decode不能保留传入的字节;没有实现时每次传入新分配的字节
+type DecodeBufferReuser interface {
+	ReuseDecodeBuffer() bool
+}
+
+// 实现了DecodeBufferReuser的数据使用可复用的缓冲区
+func decodeBuffer(data ProtocolData, n int, buf func(n int) []byte) []byte {
+	if r, ok := data.(DecodeBufferReuser); ok && r.ReuseDecodeBuffer() {
+		return buf(n)
+	}
+	return make([]byte, n)
+}
+
 // 协议头
 type ProtocolHeader interface {
 	ProtocolData
@@ -48,12 +61,41 @@ type ProtocolBody = ProtocolData
 type Message struct {
 	Header ProtocolHeader
 	Body   ProtocolBody
+
+	dc      DataCreator // 读取消息时使用的DataCreator,用于回收body
+	encoded []byte      // 预先编码的数据,不为nil时直接写出,见NewEncodedMessage
+	parts   []int       // encoded中合并了多个消息时每个消息的结束位置,写出时每个消息一个buffer
+	pending bool        // 等待确认的可靠消息,丢弃后由重传或OnUnacked处理,不交给溢出回调
+	offline uint64      // 离线存储中的id,客户端确认后从存储中删除,0表示不是离线消息
+}
+
+// Release 回收从连接读取的消息的body,之后不能再使用Body
+// 只有DataCreator实现了BodyReleaser时body才会被复用,消息被转发或入队时不能调用
+func (m *Message) Release() {
+	if r, ok := m.dc.(BodyReleaser); ok && m.Body != nil {
+		r.ReleaseBody(m.Header.Cmd(), m.Body)
+	}
+	m.Body = nil
+	m.dc = nil
 }
 
 func (m *Message) String() string {
 	return fmt.Sprintf("header: %v, body: %v", m.Header, m.Body)
 }
 
+// 只包含指令的消息,body为空
+func NewCmdMessage(dc DataCreator, cmd int) *Message {
+	hdr := dc.CreateHeader()
+	hdr.SetCmd(cmd)
+	return &Message{Header: hdr}
+}
+
+// BodyReleaser 可选,DataCreator实现后可以通过Message.Release回收body,
+// 一般配合util.TypePools使用
+type BodyReleaser interface {
+	ReleaseBody(cmd int, body ProtocolBody)
+}
+
 // 协议数据创建器,可以分别创建头和body
 // 定义DataCreator的作用之一是,在必要的时候,可以对不同的客户端使用不同的数据交换协议
 type DataCreator interface {
@@ -71,10 +113,39 @@ func ReadMessage(reader io.Reader, dc DataCreator) (*Message, error) {
 
 // 限制读
 func ReadLimitMessage(reader io.Reader, dc DataCreator, limitSize int) (*Message, error) {
+	msg, err := ReadMessageFunc(reader, dc, func(ProtocolHeader) int { return limitSize })
+	if _, ok := err.(*ReadLimitError); ok {
+		err = ErrorReadOutofRange
+	}
+	return msg, err
+}
+
+// ReadLimitError 消息body超过读取限制,body未被读取
+type ReadLimitError struct {
+	Header ProtocolHeader // 已读取的消息头
+	Limit  int            // 生效的限制
+}
+
+func (e *ReadLimitError) Error() string {
+	return fmt.Sprintf("read body length %d out of range %d, cmd: %d", e.Header.BodyLength(), e.Limit, e.Header.Cmd())
+}
+
+func (e *ReadLimitError) Unwrap() error {
+	return ErrorReadOutofRange
+}
+
+// ReadMessageFunc 读取消息,limit根据消息头返回body的最大长度,不大于0表示不限制
+// 超过限制时返回*ReadLimitError
+func ReadMessageFunc(reader io.Reader, dc DataCreator, limit func(ProtocolHeader) int) (*Message, error) {
+	return readMessage(reader, dc, limit, func(n int) []byte { return make([]byte, n) })
+}
+
+// buf返回长度为n的可复用缓冲区,头和body依次使用,见DecodeBufferReuser
+func readMessage(reader io.Reader, dc DataCreator, limit func(ProtocolHeader) int, buf func(n int) []byte) (*Message, error) {
 	header := dc.CreateHeader()
 
 	headerLength := header.Length()
-	buff := make([]byte, headerLength)
+	buff := decodeBuffer(header, headerLength, buf)
 	_, err := io.ReadFull(reader, buff)
 	if err != nil {
 		return nil, err
@@ -86,14 +157,18 @@ func ReadLimitMessage(reader io.Reader, dc DataCreator, limitSize int) (*Message
 	}
 
 	bodyLength := header.BodyLength()
-	if bodyLength < 0 || (limitSize > 0 && bodyLength > limitSize) {
+	if bodyLength < 0 {
 		log.Warnf("invalid header length: %d", bodyLength)
 		return nil, ErrorReadOutofRange
 	}
+	if limitSize := limit(header); limitSize > 0 && bodyLength > limitSize {
+		log.Warnf("invalid header length: %d", bodyLength)
+		return nil, &ReadLimitError{Header: header, Limit: limitSize}
+	}
 	body := dc.CreateBody(header.Cmd())
 	if body != nil {
 		if bodyLength > 0 {
-			buff = make([]byte, bodyLength)
+			buff = decodeBuffer(body, bodyLength, buf)
 			_, err = io.ReadFull(reader, buff)
 			if err != nil {
 				return nil, err
@@ -101,7 +176,54 @@ func ReadLimitMessage(reader io.Reader, dc DataCreator, limitSize int) (*Message
 			err = body.Decode(buff)
 		}
 	}
-	return &Message{Header: header, Body: body}, err
+	return &Message{Header: header, Body: body, dc: dc}, err
+}
+
+const (
+	DefaultReadBufferSize = 4096      // 默认读缓冲大小
+	maxRetainedReadBuffer = 64 * 1024 // 超过的body缓冲不复用
+)
+
+// MessageReader 带缓冲的消息读取,复用头和body的缓冲区,不能并发使用
+// 读缓冲在第一次读取时才分配
+type MessageReader struct {
+	src   io.Reader
+	size  int
+	r     io.Reader
+	buf   []byte
+	bufFn func(n int) []byte
+}
+
+// NewMessageReader 新建消息读取,size为读缓冲大小,0时使用DefaultReadBufferSize,小于0时不使用读缓冲
+func NewMessageReader(r io.Reader, size int) *MessageReader {
+	if size == 0 {
+		size = DefaultReadBufferSize
+	}
+	mr := &MessageReader{src: r, size: size}
+	mr.bufFn = mr.buffer
+	return mr
+}
+
+// ReadMessage 读取消息,limit见ReadMessageFunc
+// 实现了DecodeBufferReuser的头和body,解码传入的字节在下一次读取时被复用
+func (mr *MessageReader) ReadMessage(dc DataCreator, limit func(ProtocolHeader) int) (*Message, error) {
+	if mr.r == nil {
+		mr.r = mr.src
+		if mr.size > 0 {
+			mr.r = bufio.NewReaderSize(mr.src, mr.size)
+		}
+	}
+	return readMessage(mr.r, dc, limit, mr.bufFn)
+}
+
+func (mr *MessageReader) buffer(n int) []byte {
+	if n > maxRetainedReadBuffer {
+		return make([]byte, n)
+	}
+	if cap(mr.buf) < n {
+		mr.buf = make([]byte, n)
+	}
+	return mr.buf[:n]
 }
 
 // 解码字节流
@@ -125,7 +247,9 @@ func DecodeMessage(b []byte, dc DataCreator) (*Message, error) {
 		return message, ErrorInvalidMessage
 	}
 	message.Body = dc.CreateBody(message.Header.Cmd())
-	err = message.Body.Decode(b[headerLength:])
+	if message.Body != nil {
+		err = message.Body.Decode(b[headerLength:])
+	}
 	return message, err
 }
 
@@ -139,48 +263,57 @@ func WriteLimitMessage(conn io.Writer, message *Message, limitSize int) error {
 	if message.Header == nil {
 		return ErrorInvalidMessage
 	}
-	data, err := EncodeLimitMessage(message, limitSize)
+	frame, err := EncodeFrame(message, limitSize)
 	if err != nil {
 		return err
 	}
-	_, err = conn.Write(data)
+	_, err = conn.Write(frame.Bytes())
+	frame.Release()
 	return err
 }
 
-// 限制编码消息
+// 限制编码消息,返回的数据归调用方所有
 func EncodeLimitMessage(message *Message, limitSize int) ([]byte, error) {
+	return appendLimitMessage(nil, message, limitSize)
+}
+
+// AppendMessage 将消息编码后追加到b,返回追加后的切片
+// 不使用缓冲池,返回的数据归调用方所有
+func AppendMessage(b []byte, message *Message) ([]byte, error) {
+	return appendLimitMessage(b, message, 0)
+}
+
+func appendLimitMessage(b []byte, message *Message, limitSize int) ([]byte, error) {
 	if message.Header == nil {
-		return nil, ErrorInvalidHeader
+		return b, ErrorInvalidHeader
+	}
+	if message.encoded != nil {
+		if limitSize > 0 && len(message.encoded)-message.Header.Length() > limitSize {
+			return b, ErrorWriteOutofRange
+		}
+		return append(b, message.encoded...), nil
 	}
-
 	var body []byte
 	var err error
 	if message.Body != nil {
 		body, err = message.Body.Encode()
 		if err != nil {
-			return nil, err
+			return b, err
 		}
 	}
 	if limitSize > 0 && len(body) > limitSize {
-		return nil, ErrorWriteOutofRange
+		return b, ErrorWriteOutofRange
 	}
 	message.Header.SetBodyLength(len(body))
-	buffer := bufPool.Get()
-	defer bufPool.Put(buffer)
-
 	hdr, err := message.Header.Encode()
 	if err != nil {
-		return nil, err
-	}
-
-	buffer.Write(hdr)
-	if body != nil {
-		buffer.Write(body)
+		return b, err
 	}
-	return buffer.Bytes(), nil
+	b = append(b, hdr...)
+	return append(b, body...), nil
 }
 
-// 编码Message
+// 编码Message,返回的数据归调用方所有
 func EncodeMessage(message *Message) ([]byte, error) {
 	return EncodeLimitMessage(message, 0)
 }
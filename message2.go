@@ -10,15 +10,23 @@ var (
 )
 
 func (d *plainData) Decode(b []byte) error {
-	*d = b
+	*d = append((*d)[:0], b...)
 	return nil
 } // 从字节中读取
+
+// 解码时复制,可以复用解码的缓冲区
+func (d *plainData) ReuseDecodeBuffer() bool {
+	return true
+}
 func (d *plainData) Encode() ([]byte, error) {
 	return *d, nil
 } // 编码
 func (d *plainData) Length() int {
 	return len(*d)
 }
+func (d *plainData) Size() int {
+	return len(*d)
+}
 func (d *plainData) Cmd() int {
 	return 0
 }                               // 协议指令
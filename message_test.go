@@ -0,0 +1,161 @@
+package meim
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/ipiao/meim/util"
+	"github.com/stretchr/testify/assert"
+)
+
+var plainDataType = reflect.TypeOf((*plainData)(nil))
+
+// body可复用的DataCreator
+type pooledDataCreator struct {
+	testDataCreator
+	pools *util.TypePools
+}
+
+func newPooledDataCreator() *pooledDataCreator {
+	dc := &pooledDataCreator{pools: util.NewTypePools()}
+	dc.pools.Init(plainDataType)
+	return dc
+}
+
+func (dc *pooledDataCreator) CreateBody(cmd int) ProtocolBody {
+	return dc.pools.Get(plainDataType).(*plainData)
+}
+
+func (dc *pooledDataCreator) ReleaseBody(cmd int, body ProtocolBody) {
+	dc.pools.Put(plainDataType, body)
+}
+
+// 循环读取同一段数据,每次填满b,记录Read调用次数
+type loopReader struct {
+	data  []byte
+	pos   int
+	reads int
+}
+
+func (r *loopReader) Read(b []byte) (int, error) {
+	r.reads++
+	n := 0
+	for n < len(b) {
+		if r.pos == len(r.data) {
+			r.pos = 0
+		}
+		m := copy(b[n:], r.data[r.pos:])
+		r.pos += m
+		n += m
+	}
+	return n, nil
+}
+
+func TestMessageReader(t *testing.T) {
+	var buf bytes.Buffer
+	for _, body := range []string{"first", "second message", ""} {
+		data, err := AppendMessage(nil, newTestMessage(1, body))
+		assert.NoError(t, err)
+		buf.Write(data)
+	}
+
+	mr := NewMessageReader(&buf, 0)
+	var msgs []*Message
+	for i := 0; i < 3; i++ {
+		msg, err := mr.ReadMessage(testDC, func(ProtocolHeader) int { return 0 })
+		assert.NoError(t, err)
+		msgs = append(msgs, msg)
+	}
+	// 缓冲区复用后之前的body不受影响
+	assert.Equal(t, "first", string(*msgs[0].Body.(*plainData)))
+	assert.Equal(t, "second message", string(*msgs[1].Body.(*plainData)))
+	assert.Equal(t, "", string(*msgs[2].Body.(*plainData)))
+
+	_, err := mr.ReadMessage(testDC, func(ProtocolHeader) int { return 0 })
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestMessageRelease(t *testing.T) {
+	dc := newPooledDataCreator()
+	data, err := AppendMessage(nil, newTestMessage(1, "pooled body"))
+	assert.NoError(t, err)
+
+	mr := NewMessageReader(&loopReader{data: data}, 0)
+	msg, err := mr.ReadMessage(dc, func(ProtocolHeader) int { return 0 })
+	assert.NoError(t, err)
+	assert.Equal(t, "pooled body", string(*msg.Body.(*plainData)))
+	msg.Release()
+	assert.Nil(t, msg.Body)
+
+	// 未通过读取得到的消息可以安全调用
+	newTestMessage(1, "a").Release()
+}
+
+func BenchmarkReadMessage(b *testing.B) {
+	data, _ := AppendMessage(nil, newTestMessage(1, "a chat message body of typical size for the benchmark"))
+	noLimit := func(ProtocolHeader) int { return 0 }
+
+	b.Run("alloc", func(b *testing.B) {
+		r := &loopReader{data: data}
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := ReadLimitMessage(r, testDC, DefaultReadLimit); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ReportMetric(float64(r.reads)/float64(b.N), "reads/op")
+	})
+
+	b.Run("pooled", func(b *testing.B) {
+		r := &loopReader{data: data}
+		mr := NewMessageReader(r, 0)
+		dc := newPooledDataCreator()
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			msg, err := mr.ReadMessage(dc, noLimit)
+			if err != nil {
+				b.Fatal(err)
+			}
+			msg.Release()
+		}
+		b.ReportMetric(float64(r.reads)/float64(b.N), "reads/op")
+	})
+}
+
+// 保留Decode传入字节的body
+type retainData struct {
+	b []byte
+}
+
+func (d *retainData) Decode(b []byte) error   { d.b = b; return nil }
+func (d *retainData) Encode() ([]byte, error) { return d.b, nil }
+
+type retainDataCreator struct {
+	testDataCreator
+}
+
+func (dc *retainDataCreator) CreateBody(cmd int) ProtocolBody {
+	return new(retainData)
+}
+
+func TestMessageReaderRetain(t *testing.T) {
+	var buf bytes.Buffer
+	for _, body := range []string{"first", "second"} {
+		data, err := AppendMessage(nil, newTestMessage(1, body))
+		assert.NoError(t, err)
+		buf.Write(data)
+	}
+
+	mr := NewMessageReader(&buf, -1)
+	assert.Nil(t, mr.r)
+	dc := new(retainDataCreator)
+	first, err := mr.ReadMessage(dc, func(ProtocolHeader) int { return 0 })
+	assert.NoError(t, err)
+	assert.Equal(t, &buf, mr.r)
+	_, err = mr.ReadMessage(dc, func(ProtocolHeader) int { return 0 })
+	assert.NoError(t, err)
+	// 没有实现DecodeBufferReuser的body不复用缓冲区
+	assert.Equal(t, "first", string(first.Body.(*retainData).b))
+}
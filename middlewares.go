@@ -17,6 +17,13 @@ type MessageBroker interface {
 	Close()
 }
 
+// 支持按主题发布订阅的Broker,房间和在线状态跨节点同步需要
+// InternalMessage.Topic不为空时发给订阅了主题的所有节点,可以包括发布者所在的节点
+type TopicBroker interface {
+	SubscribeTopic(topic string)   // 订阅主题
+	UnSubscribeTopic(topic string) // 取消订阅
+}
+
 // 消息推送,作为附属
 type Pusher interface {
 	PushMessage(msg *InternalMessage) bool
@@ -29,6 +36,13 @@ func (p *NopPusher) PushMessage(msg *InternalMessage) bool {
 	return false
 }
 
+// 离线消息存储,按uid保存,每个uid的消息id递增,需要支持并发调用
+type OfflineStore interface {
+	Append(uid int64, msg *Message) error                                 // 保存消息
+	Fetch(uid int64, cursor uint64, limit int) ([]*OfflineMessage, error) // 按id顺序读取id大于cursor的未过期消息
+	Ack(uid int64, cursor uint64) error                                   // 删除id不大于cursor的消息
+}
+
 // 本地消息分发,外部发送到本服务的消息
 type Dispatcher interface {
 	DispatchMessage(*InternalMessage) bool
@@ -1,6 +1,11 @@
 package meim
 
 import (
+	"crypto/rand"
+	"encoding/binary"
+	"math"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/ipiao/meim/log"
@@ -15,6 +20,10 @@ type Exchanger struct {
 	InternalMessageHandler                       //
 	pubCh                  chan *InternalMessage //
 	router                 *Router               // for example,取 ExternalImp的Router
+	store                  OfflineStore          // 离线消息存储,可选
+	rooms                  *Rooms                // 房间,可选
+	presence               *Presence             // 在线状态,可选
+	node                   int64                 // 本节点id,用于丢弃发回本节点的主题消息
 }
 
 func NewMessageExchanger(broker MessageBroker, pusher Pusher, handler InternalMessageHandler, router *Router) *Exchanger {
@@ -27,26 +36,153 @@ func NewMessageExchanger(broker MessageBroker, pusher Pusher, handler InternalMe
 		InternalMessageHandler: handler,
 		pubCh:                  make(chan *InternalMessage, 256),
 		router:                 router,
+		node:                   randomNode(),
 	}
 }
 
+// 随机生成的正数节点id,不同节点几乎不会重复
+func randomNode() int64 {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return time.Now().UnixNano()
+	}
+	return int64(binary.BigEndian.Uint64(b[:])&math.MaxInt64) | 1
+}
+
+// SetOfflineStore 接收人不在线时保存消息,在其认证后由服务投递,见WithOfflineStore
+func (exc *Exchanger) SetOfflineStore(store OfflineStore) {
+	exc.store = store
+}
+
+// SetNode 设置本节点id,发布的主题消息带上节点id,Broker发回本节点的主题消息被丢弃
+// 默认随机生成,为0时忽略
+func (exc *Exchanger) SetNode(node int64) {
+	if node != 0 {
+		exc.node = node
+	}
+}
+
+// 订阅主题需要Broker实现TopicBroker
+func (exc *Exchanger) topicBroker() TopicBroker {
+	tb, _ := exc.MessageBroker.(TopicBroker)
+	return tb
+}
+
+// RoomTopic 房间消息在Broker中的主题
+func RoomTopic(roomID int64) string {
+	return "room:" + strconv.FormatInt(roomID, 10)
+}
+
+func parseRoomTopic(topic string) (int64, bool) {
+	if !strings.HasPrefix(topic, "room:") {
+		return 0, false
+	}
+	roomID, err := strconv.ParseInt(topic[len("room:"):], 10, 64)
+	return roomID, err == nil
+}
+
+// SetRooms 房间消息跨节点分发,需要Broker实现TopicBroker
+// 房间在本节点有成员时订阅RoomTopic(roomID),收到的主题消息作为房间消息分发
+func (exc *Exchanger) SetRooms(rooms *Rooms) {
+	exc.rooms = rooms
+	tb := exc.topicBroker()
+	if tb == nil {
+		if exc.MessageBroker != nil {
+			log.Warnf("broker %T does not support topics, rooms are not synced across nodes", exc.MessageBroker)
+		}
+		return
+	}
+	rooms.SetHooks(func(roomID int64) {
+		tb.SubscribeTopic(RoomTopic(roomID))
+	}, func(roomID int64) {
+		tb.UnSubscribeTopic(RoomTopic(roomID))
+	})
+}
+
+// SetPresence 在线状态跨节点同步,需要Broker实现TopicBroker,
+// 订阅PresenceTopic,本节点的状态变化和心跳发布到Broker,收到的状态消息交给Presence处理
+func (exc *Exchanger) SetPresence(p *Presence) {
+	exc.presence = p
+	p.defaultNode(exc.node)
+	tb := exc.topicBroker()
+	if tb == nil {
+		if exc.MessageBroker != nil {
+			log.Warnf("broker %T does not support topics, presence is not synced across nodes", exc.MessageBroker)
+		}
+		return
+	}
+	p.setPublisher(exc)
+	tb.SubscribeTopic(PresenceTopic)
+}
+
+// PublishRoomMessage 发送房间消息,本节点的成员直接广播(排除sender),其他节点通过Broker
+// 返回本节点入队成功的客户端数
+func (exc *Exchanger) PublishRoomMessage(roomID int64, msg *Message, sender *Client) int {
+	n := exc.rooms.Broadcast(roomID, msg, sender)
+	im := &InternalMessage{
+		Message:   msg,
+		Timestamp: time.Now().UnixNano() / int64(time.Millisecond),
+		Node:      exc.node,
+		Topic:     RoomTopic(roomID),
+	}
+	if sender != nil {
+		im.Sender = sender.UID
+	}
+	if exc.topicBroker() != nil {
+		exc.PublishMessage(im)
+	}
+	return n
+}
+
 // 直接下发
 // 单纯的进行消息下发,未考虑业务消息
+// 接收人不在线时保存到离线存储,并交给Pusher推送
+// 主题消息见dispatchTopic
 func (exc *Exchanger) DispatchMessage(msg *InternalMessage) bool {
 	// TODO 使用goroutin池
 	// 用go避免阻塞
+	if msg.Topic != "" {
+		return exc.dispatchTopic(msg)
+	}
 	if exc.router == nil {
 		return false
 	}
 	client := exc.router.FindClient(msg.Receiver)
 	if client == nil {
-		return exc.PushMessage(msg)
+		stored := exc.storeMessage(msg)
+		return exc.PushMessage(msg) || stored
 	} else {
 		go client.EnqueueMessage(msg.Message)
 		return true
 	}
 }
 
+// 分发主题消息,本节点发布的消息已经在本地分发过,直接丢弃
+func (exc *Exchanger) dispatchTopic(msg *InternalMessage) bool {
+	if msg.Node == exc.node {
+		return true
+	}
+	if msg.Topic == PresenceTopic && exc.presence != nil {
+		return exc.presence.HandleMessage(msg)
+	}
+	if roomID, ok := parseRoomTopic(msg.Topic); ok && exc.rooms != nil {
+		exc.rooms.Broadcast(roomID, msg.Message, nil)
+		return true
+	}
+	return false
+}
+
+func (exc *Exchanger) storeMessage(msg *InternalMessage) bool {
+	if exc.store == nil {
+		return false
+	}
+	if err := exc.store.Append(msg.Receiver, msg.Message); err != nil {
+		log.Warnf("store offline message error: %s, msg: %v", err, msg)
+		return false
+	}
+	return true
+}
+
 // 发布消息到Broker
 func (exc *Exchanger) PublishMessage(msg *InternalMessage) bool {
 	select {
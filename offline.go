@@ -0,0 +1,167 @@
+package meim
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ipiao/meim/log"
+)
+
+const offlineFetchSize = 100 // 认证后每次读取的离线消息数
+
+// OfflineMessage 离线存储中的消息
+type OfflineMessage struct {
+	ID      uint64    // uid内递增的id,作为读取和确认的cursor
+	Time    time.Time // 保存时间
+	Message *Message
+}
+
+func offlineExpired(msg *OfflineMessage, ttl time.Duration, now time.Time) bool {
+	return ttl > 0 && now.Sub(msg.Time) >= ttl
+}
+
+// OfflineUnacked 将未确认的消息保存到离线存储,用于ReliableConfig.OnUnacked
+func OfflineUnacked(store OfflineStore) func(*Client, []*Message) {
+	return func(client *Client, msgs []*Message) {
+		for _, msg := range msgs {
+			if err := store.Append(client.UID, msg); err != nil {
+				log.Warnf("client %s store unacked message error: %s", client.Log(), err)
+			}
+		}
+	}
+}
+
+// OfflineSpill 将发送队列溢出的消息保存到离线存储,用于QueueConfig.Spill
+func OfflineSpill(store OfflineStore) func(*Client, *Message) error {
+	return func(client *Client, msg *Message) error {
+		return store.Append(client.UID, msg)
+	}
+}
+
+// 认证后在客户端开始收发消息之前投递离线消息,保证离线消息在之后的消息之前入队
+// 消息在客户端确认后才从存储中删除,未确认的消息留在存储中,下次认证时重新投递
+func (s *Server) deliverOffline(client *Client) {
+	if client.UID == 0 {
+		return
+	}
+	cursor := client.offlineCursor()
+	for {
+		msgs, err := s.offline.Fetch(client.UID, cursor, offlineFetchSize)
+		if err != nil {
+			log.Warnf("client %s fetch offline messages error: %s", client.Log(), err)
+			return
+		}
+		for _, om := range msgs {
+			if !client.enqueueReliable(om.Message, om.ID) {
+				log.Infof("client %s stop delivering offline messages, the rest are kept in store", client.Log())
+				return
+			}
+			cursor = om.ID
+		}
+		if len(msgs) < offlineFetchSize {
+			return
+		}
+	}
+}
+
+// MemoryOfflineStore 内存离线存储,ttl不大于0表示不过期
+// ttl大于0时每隔ttl清理所有uid的过期消息,不再使用时调用Close停止清理
+type MemoryOfflineStore struct {
+	ttl       time.Duration
+	mu        sync.Mutex
+	msgs      map[int64][]*OfflineMessage
+	ids       map[int64]uint64 // 每个uid最后分配的id
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func NewMemoryOfflineStore(ttl time.Duration) *MemoryOfflineStore {
+	store := &MemoryOfflineStore{
+		ttl:  ttl,
+		msgs: make(map[int64][]*OfflineMessage),
+		ids:  make(map[int64]uint64),
+		done: make(chan struct{}),
+	}
+	if ttl > 0 {
+		go store.sweep()
+	}
+	return store
+}
+
+// Close 停止定期清理
+func (store *MemoryOfflineStore) Close() {
+	store.closeOnce.Do(func() {
+		close(store.done)
+	})
+}
+
+// 定期删除过期消息,不再认证的uid也能释放内存
+func (store *MemoryOfflineStore) sweep() {
+	ticker := time.NewTicker(store.ttl)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-store.done:
+			return
+		}
+		store.mu.Lock()
+		for uid := range store.msgs {
+			store.trimLocked(uid, 0)
+		}
+		store.mu.Unlock()
+	}
+}
+
+func (store *MemoryOfflineStore) Append(uid int64, msg *Message) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.ids[uid]++
+	store.msgs[uid] = append(store.trimLocked(uid, 0), &OfflineMessage{
+		ID:      store.ids[uid],
+		Time:    time.Now(),
+		Message: msg,
+	})
+	return nil
+}
+
+func (store *MemoryOfflineStore) Fetch(uid int64, cursor uint64, limit int) ([]*OfflineMessage, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	var res []*OfflineMessage
+	for _, msg := range store.trimLocked(uid, 0) {
+		if msg.ID <= cursor {
+			continue
+		}
+		if limit > 0 && len(res) >= limit {
+			break
+		}
+		res = append(res, msg)
+	}
+	return res, nil
+}
+
+func (store *MemoryOfflineStore) Ack(uid int64, cursor uint64) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.trimLocked(uid, cursor)
+	return nil
+}
+
+// 删除过期和id不大于cursor的消息,返回剩余的消息
+func (store *MemoryOfflineStore) trimLocked(uid int64, cursor uint64) []*OfflineMessage {
+	msgs := store.msgs[uid]
+	now := time.Now()
+	i := 0
+	for i < len(msgs) && (msgs[i].ID <= cursor || offlineExpired(msgs[i], store.ttl, now)) {
+		msgs[i] = nil
+		i++
+	}
+	msgs = msgs[i:]
+	if len(msgs) == 0 {
+		delete(store.msgs, uid)
+		return nil
+	}
+	store.msgs[uid] = msgs
+	return msgs
+}
@@ -0,0 +1,332 @@
+package meim
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ipiao/meim/log"
+)
+
+// 单条记录的最大长度,超过时视为文件损坏,之后的记录被忽略
+const offlineMaxRecord = 16 << 20
+
+// FileOfflineStore 文件离线存储,每个uid一个只追加写的文件,Ack时重写文件
+// 记录格式: id(8) + 保存时间UnixNano(8) + 消息长度(4) + 编码后的消息
+// id取保存时间的纳秒数并保证递增,文件删除后再创建时id也不会变小
+// 同一uid的读写串行执行,不同uid之间互不阻塞,文件删除后不再保留uid的状态
+// ttl大于0时每隔ttl重写有过期消息的文件,不再使用时调用Close停止清理
+type FileOfflineStore struct {
+	dir string
+	dc  DataCreator // 解码消息
+	ttl time.Duration
+
+	mu    sync.Mutex
+	files map[int64]*offlineFile
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// 单个uid的文件状态
+type offlineFile struct {
+	refs   int // 正在使用的调用数,由store.mu保护
+	mu     sync.Mutex
+	loaded bool   // lastID已从文件读取
+	lastID uint64 // 最后分配的id
+	cursor uint64 // 上一次Fetch返回的最后id
+	offset int64  // cursor之后的记录在文件中的位置,分页读取时跳过已读的记录,0表示从头读取
+}
+
+// NewFileOfflineStore 新建文件离线存储,目录不存在时创建,ttl不大于0表示不过期
+func NewFileOfflineStore(dir string, dc DataCreator, ttl time.Duration) (*FileOfflineStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	store := &FileOfflineStore{
+		dir:   dir,
+		dc:    dc,
+		ttl:   ttl,
+		files: make(map[int64]*offlineFile),
+		done:  make(chan struct{}),
+	}
+	if ttl > 0 {
+		go store.sweep()
+	}
+	return store, nil
+}
+
+// Close 停止定期清理
+func (store *FileOfflineStore) Close() {
+	store.closeOnce.Do(func() {
+		close(store.done)
+	})
+}
+
+// 定期重写有过期消息的文件,不再认证的uid也能释放磁盘
+func (store *FileOfflineStore) sweep() {
+	ticker := time.NewTicker(store.ttl)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-store.done:
+			return
+		}
+		names, err := filepath.Glob(filepath.Join(store.dir, "*.log"))
+		if err != nil {
+			log.Warnf("offline sweep %s error: %s", store.dir, err)
+			continue
+		}
+		for _, name := range names {
+			uid, err := strconv.ParseInt(strings.TrimSuffix(filepath.Base(name), ".log"), 10, 64)
+			if err != nil {
+				continue
+			}
+			if err := store.expire(uid); err != nil {
+				log.Warnf("offline sweep %s error: %s", name, err)
+			}
+		}
+	}
+}
+
+// 最早的消息过期时重写文件
+func (store *FileOfflineStore) expire(uid int64) error {
+	of := store.lock(uid)
+	defer store.unlock(uid, of)
+	expired := false
+	now := time.Now()
+	err := store.scanLocked(uid, 0, func(om *OfflineMessage, data []byte, end int64) error {
+		expired = offlineExpired(om, store.ttl, now)
+		return io.EOF
+	})
+	if err != nil || !expired {
+		return err
+	}
+	return store.rewriteLocked(uid, of, 0)
+}
+
+func (store *FileOfflineStore) path(uid int64) string {
+	return filepath.Join(store.dir, fmt.Sprintf("%d.log", uid))
+}
+
+// 加锁返回uid的文件状态
+func (store *FileOfflineStore) lock(uid int64) *offlineFile {
+	store.mu.Lock()
+	f, ok := store.files[uid]
+	if !ok {
+		f = &offlineFile{}
+		store.files[uid] = f
+	}
+	f.refs++
+	store.mu.Unlock()
+	f.mu.Lock()
+	return f
+}
+
+// 解锁,文件不存在并且没有其他调用在使用时移除uid的状态
+func (store *FileOfflineStore) unlock(uid int64, f *offlineFile) {
+	_, err := os.Stat(store.path(uid))
+	gone := os.IsNotExist(err)
+	f.mu.Unlock()
+	store.mu.Lock()
+	f.refs--
+	if f.refs == 0 && gone {
+		delete(store.files, uid)
+	}
+	store.mu.Unlock()
+}
+
+func (store *FileOfflineStore) Append(uid int64, msg *Message) error {
+	data, err := AppendMessage(make([]byte, 20), msg)
+	if err != nil {
+		return err
+	}
+	if len(data)-20 > offlineMaxRecord {
+		return fmt.Errorf("offline message too large: %d", len(data)-20)
+	}
+
+	of := store.lock(uid)
+	defer store.unlock(uid, of)
+	last, err := store.lastIDLocked(uid, of)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UnixNano()
+	id := uint64(now)
+	if id <= last {
+		id = last + 1
+	}
+	binary.BigEndian.PutUint64(data[:8], id)
+	binary.BigEndian.PutUint64(data[8:16], uint64(now))
+	binary.BigEndian.PutUint32(data[16:20], uint32(len(data)-20))
+
+	f, err := os.OpenFile(store.path(uid), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	of.lastID = id
+	return nil
+}
+
+func (store *FileOfflineStore) Fetch(uid int64, cursor uint64, limit int) ([]*OfflineMessage, error) {
+	of := store.lock(uid)
+	defer store.unlock(uid, of)
+	var start int64
+	if cursor > 0 && cursor == of.cursor {
+		start = of.offset
+	}
+	var res []*OfflineMessage
+	now := time.Now()
+	err := store.scanLocked(uid, start, func(om *OfflineMessage, data []byte, end int64) error {
+		if om.ID <= cursor || offlineExpired(om, store.ttl, now) {
+			return nil
+		}
+		if limit > 0 && len(res) >= limit {
+			return io.EOF
+		}
+		msg, err := DecodeMessage(data, store.dc)
+		if err != nil {
+			return err
+		}
+		om.Message = msg
+		res = append(res, om)
+		of.cursor, of.offset = om.ID, end
+		return nil
+	})
+	return res, err
+}
+
+// Ack 删除id不大于cursor和过期的消息,重写文件
+func (store *FileOfflineStore) Ack(uid int64, cursor uint64) error {
+	of := store.lock(uid)
+	defer store.unlock(uid, of)
+	return store.rewriteLocked(uid, of, cursor)
+}
+
+// 重写文件,删除id不大于cursor和过期的消息,没有剩余的消息时删除文件
+func (store *FileOfflineStore) rewriteLocked(uid int64, of *offlineFile, cursor uint64) error {
+	if _, err := store.lastIDLocked(uid, of); err != nil {
+		return err
+	}
+
+	path := store.path(uid)
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	kept := 0
+	now := time.Now()
+	var hdr [20]byte
+	err = store.scanLocked(uid, 0, func(om *OfflineMessage, data []byte, end int64) error {
+		if om.ID <= cursor || offlineExpired(om, store.ttl, now) {
+			return nil
+		}
+		kept++
+		binary.BigEndian.PutUint64(hdr[:8], om.ID)
+		binary.BigEndian.PutUint64(hdr[8:16], uint64(om.Time.UnixNano()))
+		binary.BigEndian.PutUint32(hdr[16:20], uint32(len(data)))
+		w.Write(hdr[:])
+		_, err := w.Write(data)
+		return err
+	})
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	// 文件重写后记录的位置改变
+	of.cursor, of.offset = 0, 0
+	if kept == 0 {
+		os.Remove(tmp)
+		err = os.Remove(path)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// 文件中最后的id
+func (store *FileOfflineStore) lastIDLocked(uid int64, of *offlineFile) (uint64, error) {
+	if of.loaded {
+		return of.lastID, nil
+	}
+	var id uint64
+	err := store.scanLocked(uid, 0, func(om *OfflineMessage, data []byte, end int64) error {
+		id = om.ID
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	of.loaded, of.lastID = true, id
+	return id, nil
+}
+
+// 从offset开始依次读取文件中的记录,end为记录结束的位置,fn返回io.EOF时停止
+// 末尾不完整的记录(写入时中断)和长度异常的记录及之后的记录被忽略
+func (store *FileOfflineStore) scanLocked(uid int64, offset int64, fn func(om *OfflineMessage, data []byte, end int64) error) error {
+	f, err := os.Open(store.path(uid))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if offset > 0 {
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+	}
+
+	r := bufio.NewReader(f)
+	var hdr [20]byte
+	for {
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return nil
+		}
+		n := binary.BigEndian.Uint32(hdr[16:20])
+		if n > offlineMaxRecord {
+			log.Warnf("offline file %s corrupted at offset %d, record length %d", f.Name(), offset, n)
+			return nil
+		}
+		data := make([]byte, n)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil
+		}
+		offset += int64(len(hdr)) + int64(n)
+		om := &OfflineMessage{
+			ID:   binary.BigEndian.Uint64(hdr[:8]),
+			Time: time.Unix(0, int64(binary.BigEndian.Uint64(hdr[8:16]))),
+		}
+		if err := fn(om, data, offset); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
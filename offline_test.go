@@ -0,0 +1,241 @@
+package meim
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func offlineBodies(t *testing.T, msgs []*OfflineMessage) []string {
+	var bodies []string
+	for _, om := range msgs {
+		bodies = append(bodies, string(*om.Message.Body.(*plainData)))
+	}
+	return bodies
+}
+
+func testOfflineStore(t *testing.T, store OfflineStore) {
+	for _, body := range []string{"a", "b", "c"} {
+		assert.NoError(t, store.Append(1, newTestMessage(1, body)))
+	}
+	assert.NoError(t, store.Append(2, newTestMessage(1, "other")))
+
+	msgs, err := store.Fetch(1, 0, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, offlineBodies(t, msgs))
+	cursor := msgs[1].ID
+	assert.Greater(t, cursor, msgs[0].ID)
+	msgs, err = store.Fetch(1, cursor, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"c"}, offlineBodies(t, msgs))
+	last := msgs[0].ID
+
+	assert.NoError(t, store.Ack(1, cursor))
+	msgs, err = store.Fetch(1, 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"c"}, offlineBodies(t, msgs))
+
+	// 全部确认后id继续递增
+	assert.NoError(t, store.Ack(1, last))
+	assert.NoError(t, store.Append(1, newTestMessage(1, "d")))
+	msgs, err = store.Fetch(1, 0, 0)
+	assert.NoError(t, err)
+	if assert.Len(t, msgs, 1) {
+		assert.Greater(t, msgs[0].ID, last)
+	}
+
+	msgs, err = store.Fetch(3, 0, 0)
+	assert.NoError(t, err)
+	assert.Empty(t, msgs)
+	assert.NoError(t, store.Ack(3, 1))
+}
+
+func TestMemoryOfflineStore(t *testing.T) {
+	testOfflineStore(t, NewMemoryOfflineStore(0))
+
+	store := NewMemoryOfflineStore(time.Millisecond * 20)
+	defer store.Close()
+	assert.NoError(t, store.Append(1, newTestMessage(1, "a")))
+	assert.NoError(t, store.Append(2, newTestMessage(1, "b")))
+	time.Sleep(time.Millisecond * 20)
+	msgs, err := store.Fetch(1, 0, 0)
+	assert.NoError(t, err)
+	assert.Empty(t, msgs)
+
+	// 不再访问的uid也会被清理
+	assert.Eventually(t, func() bool {
+		store.mu.Lock()
+		defer store.mu.Unlock()
+		return len(store.msgs) == 0
+	}, time.Second, time.Millisecond*10)
+}
+
+func TestFileOfflineStore(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileOfflineStore(dir, testDC, 0)
+	assert.NoError(t, err)
+	testOfflineStore(t, store)
+	// 没有文件的uid不保留状态
+	assert.Len(t, store.files, 2)
+
+	// 重新打开后保留消息和id
+	store, err = NewFileOfflineStore(dir, testDC, time.Millisecond*50)
+	assert.NoError(t, err)
+	defer store.Close()
+	assert.NoError(t, store.Append(2, newTestMessage(1, "more")))
+	msgs, err := store.Fetch(2, 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"other", "more"}, offlineBodies(t, msgs))
+	assert.Greater(t, msgs[1].ID, msgs[0].ID)
+
+	time.Sleep(time.Millisecond * 50)
+	msgs, err = store.Fetch(2, 0, 0)
+	assert.NoError(t, err)
+	assert.Empty(t, msgs)
+
+	// 过期的文件被定期删除
+	assert.Eventually(t, func() bool {
+		_, err1 := os.Stat(store.path(1))
+		_, err2 := os.Stat(store.path(2))
+		store.mu.Lock()
+		defer store.mu.Unlock()
+		return os.IsNotExist(err1) && os.IsNotExist(err2) && len(store.files) == 0
+	}, time.Second, time.Millisecond*10)
+}
+
+// 指令9没有body
+type cmdOnlyDataCreator struct {
+	testDataCreator
+}
+
+func (dc *cmdOnlyDataCreator) CreateBody(cmd int) ProtocolBody {
+	if cmd == 9 {
+		return nil
+	}
+	return new(plainData)
+}
+
+func TestFileOfflineStoreNoBody(t *testing.T) {
+	dc := new(cmdOnlyDataCreator)
+	store, err := NewFileOfflineStore(t.TempDir(), dc, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, store.Append(1, NewCmdMessage(dc, 9)))
+	msgs, err := store.Fetch(1, 0, 0)
+	assert.NoError(t, err)
+	if assert.Len(t, msgs, 1) {
+		assert.Equal(t, 9, msgs[0].Message.Header.Cmd())
+		assert.Nil(t, msgs[0].Message.Body)
+	}
+}
+
+func TestFileOfflineStorePaging(t *testing.T) {
+	store, err := NewFileOfflineStore(t.TempDir(), testDC, 0)
+	assert.NoError(t, err)
+	for _, body := range []string{"a", "b", "c", "d", "e"} {
+		assert.NoError(t, store.Append(1, newTestMessage(1, body)))
+	}
+
+	// 分页读取从上一页结束的位置继续
+	var bodies []string
+	var ids []uint64
+	var cursor uint64
+	for {
+		msgs, err := store.Fetch(1, cursor, 2)
+		assert.NoError(t, err)
+		if len(msgs) == 0 {
+			break
+		}
+		bodies = append(bodies, offlineBodies(t, msgs)...)
+		for _, om := range msgs {
+			ids = append(ids, om.ID)
+		}
+		cursor = msgs[len(msgs)-1].ID
+		assert.Equal(t, cursor, store.files[1].cursor)
+	}
+	assert.Equal(t, []string{"a", "b", "c", "d", "e"}, bodies)
+
+	// 确认后文件重写,从头读取
+	assert.NoError(t, store.Ack(1, ids[2]))
+	msgs, err := store.Fetch(1, ids[3], 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"e"}, offlineBodies(t, msgs))
+
+	// 长度异常的记录及之后的记录被忽略
+	f, err := os.OpenFile(store.path(1), os.O_WRONLY|os.O_APPEND, 0644)
+	assert.NoError(t, err)
+	var hdr [20]byte
+	binary.BigEndian.PutUint32(hdr[16:20], offlineMaxRecord+1)
+	_, err = f.Write(hdr[:])
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+	msgs, err = store.Fetch(1, 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"d", "e"}, offlineBodies(t, msgs))
+}
+
+func TestOfflineDelivery(t *testing.T) {
+	store := NewMemoryOfflineStore(0)
+	exc := NewMessageExchanger(nil, nil, nil, NewRouter())
+	exc.SetOfflineStore(store)
+	for _, body := range []string{"a", "b"} {
+		assert.True(t, exc.DispatchMessage(&InternalMessage{Message: newTestMessage(1, body), Receiver: 1}))
+	}
+
+	imp := newEchoPlugin()
+	imp.SetOnAuthClient(func(client *Client) bool {
+		client.DC = testDC
+		client.UID = 1
+		return true
+	})
+	assert.Equal(t, ErrOfflineReliable, NewServer(WithExternalPlugin(imp), WithOfflineStore(store)).prepare())
+
+	var unacked []*Message
+	s := newTestServer(t, WithExternalPlugin(imp), WithOfflineStore(store),
+		WithReliable(&ReliableConfig{
+			AckCmd: 30,
+			OnUnacked: func(client *Client, msgs []*Message) {
+				unacked = append(unacked, msgs...)
+			},
+		}))
+	defer s.Stop()
+
+	read := func(conn net.Conn) {
+		for i, body := range []string{"a", "b"} {
+			msg, err := ReadMessage(conn, testDC)
+			assert.NoError(t, err)
+			assert.Equal(t, body, string(*msg.Body.(*plainData)))
+			assert.Equal(t, i+1, msg.Header.Seq())
+		}
+	}
+	stored := func() int {
+		msgs, err := store.Fetch(1, 0, 0)
+		assert.NoError(t, err)
+		return len(msgs)
+	}
+
+	// 未确认就断开,消息留在存储中
+	conn, err := net.Dial("tcp", s.Addrs()[0].String())
+	assert.NoError(t, err)
+	read(conn)
+	conn.Close()
+	assert.Eventually(t, func() bool { return len(s.ClientSet()) == 0 }, time.Second, time.Millisecond*10)
+	assert.Equal(t, 2, stored())
+	assert.Empty(t, unacked)
+
+	// 确认后从存储中删除
+	conn, err = net.Dial("tcp", s.Addrs()[0].String())
+	assert.NoError(t, err)
+	defer conn.Close()
+	read(conn)
+	ack := newTestMessage(30, "")
+	ack.Header.SetSeq(1)
+	assert.NoError(t, WriteMessage(conn, ack))
+	assert.Eventually(t, func() bool { return stored() == 1 }, time.Second, time.Millisecond*10)
+	ack.Header.SetSeq(2)
+	assert.NoError(t, WriteMessage(conn, ack))
+	assert.Eventually(t, func() bool { return stored() == 0 }, time.Second, time.Millisecond*10)
+}
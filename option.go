@@ -11,11 +11,12 @@ type OptionFn func(*Server)
 // WithOptions sets multiple options.
 func WithOptions(ops map[string]interface{}) OptionFn {
 	return func(s *Server) {
-		if s.lncfg.Options == nil {
-			s.lncfg.Options = make(map[string]interface{})
+		cfg := s.listenerConfig()
+		if cfg.Options == nil {
+			cfg.Options = make(map[string]interface{})
 		}
 		for k, op := range ops {
-			s.lncfg.Options[k] = op
+			cfg.Options[k] = op
 		}
 	}
 }
@@ -23,7 +24,7 @@ func WithOptions(ops map[string]interface{}) OptionFn {
 // WithTLSConfig sets tls.Config.
 func WithTLSConfig(cfg *tls.Config) OptionFn {
 	return func(s *Server) {
-		s.lncfg.TLSConfig = cfg
+		s.listenerConfig().TLSConfig = cfg
 	}
 }
 
@@ -41,6 +42,193 @@ func WithWriteTimeout(writeTimeout time.Duration) OptionFn {
 	}
 }
 
+// WithConnLimit sets all connection limits.
+func WithConnLimit(cfg ConnLimitConfig) OptionFn {
+	return func(s *Server) {
+		s.limitCfg = cfg
+	}
+}
+
+// WithMaxConnPerIP sets max connections of one remote ip.
+func WithMaxConnPerIP(n int) OptionFn {
+	return func(s *Server) {
+		s.limitCfg.MaxConnPerIP = n
+	}
+}
+
+// WithAcceptRate sets global accept rate per second.
+func WithAcceptRate(rate float64, burst int) OptionFn {
+	return func(s *Server) {
+		s.limitCfg.AcceptRate = rate
+		s.limitCfg.AcceptBurst = burst
+	}
+}
+
+// WithAcceptRatePerIP sets accept rate per second of one remote ip.
+func WithAcceptRatePerIP(rate float64, burst int) OptionFn {
+	return func(s *Server) {
+		s.limitCfg.AcceptRatePerIP = rate
+		s.limitCfg.AcceptBurstPerIP = burst
+	}
+}
+
+// WithAllowCIDR adds CIDRs or ips to allow list.
+func WithAllowCIDR(cidrs ...string) OptionFn {
+	return func(s *Server) {
+		s.limitCfg.Allow = append(s.limitCfg.Allow, cidrs...)
+	}
+}
+
+// WithDenyCIDR adds CIDRs or ips to deny list.
+func WithDenyCIDR(cidrs ...string) OptionFn {
+	return func(s *Server) {
+		s.limitCfg.Deny = append(s.limitCfg.Deny, cidrs...)
+	}
+}
+
+// WithAuthTimeout sets the deadline of auth phase.
+func WithAuthTimeout(d time.Duration) OptionFn {
+	return func(s *Server) {
+		s.authTimeout = d
+	}
+}
+
+// WithAuthMessages sets max messages read in auth phase,
+// the plugin must implement AuthMessageHandler, otherwise Start and Serve return ErrNoAuthMsgHandler.
+func WithAuthMessages(n int) OptionFn {
+	return func(s *Server) {
+		s.authMsgCount = n
+	}
+}
+
+// WithHeartbeat enables application-level heartbeat.
+func WithHeartbeat(cfg *HeartbeatConfig) OptionFn {
+	return func(s *Server) {
+		c := *cfg // 不修改调用方的配置
+		c.init()
+		s.heartbeat = &c
+	}
+}
+
+// WithReliable enables acknowledged server push, see Client.EnqueueReliableMessage.
+func WithReliable(cfg *ReliableConfig) OptionFn {
+	return func(s *Server) {
+		c := *cfg
+		c.init()
+		s.reliable = &c
+	}
+}
+
+// WithSession enables session resumption across reconnects, it needs WithReliable.
+func WithSession(cfg *SessionConfig) OptionFn {
+	return func(s *Server) {
+		c := *cfg
+		c.init()
+		s.sessionCfg = &c
+	}
+}
+
+// WithOfflineStore delivers stored offline messages to clients after auth,
+// it needs WithReliable, messages are removed from the store once acked.
+func WithOfflineStore(store OfflineStore) OptionFn {
+	return func(s *Server) {
+		s.offline = store
+	}
+}
+
+// WithWriteBatchSize sets the byte budget of one coalesced write,
+// n <= 0 uses DefaultWriteBatchSize.
+func WithWriteBatchSize(n int) OptionFn {
+	return func(s *Server) {
+		if n <= 0 {
+			n = DefaultWriteBatchSize
+		}
+		s.batchSize = n
+	}
+}
+
+// WithQueueConfig sets the default outbound queue config of clients.
+func WithQueueConfig(cfg QueueConfig) OptionFn {
+	return func(s *Server) {
+		s.queueCfg = &cfg
+	}
+}
+
+// WithSchedule sets how the writer schedules between priority queues.
+func WithSchedule(cfg ScheduleConfig) OptionFn {
+	return func(s *Server) {
+		s.schedule = cfg
+	}
+}
+
+// WithMemoryBudget sets the byte budget shared by all client queues.
+func WithMemoryBudget(cfg MemoryBudgetConfig) OptionFn {
+	return func(s *Server) {
+		s.budgetCfg = cfg
+	}
+}
+
+// WithReadLimit sets the default max body length read from authenticated clients.
+// A negative value means unlimited.
+func WithReadLimit(n int) OptionFn {
+	return func(s *Server) {
+		s.readLimit = n
+	}
+}
+
+// WithReadBufferSize sets the read buffer size of each connection,
+// 0 uses DefaultReadBufferSize, a negative value disables buffering.
+// The buffer is allocated on the first read.
+func WithReadBufferSize(n int) OptionFn {
+	return func(s *Server) {
+		s.readBufSize = n
+	}
+}
+
+// WithAuthReadLimit sets the max body length read from clients before auth completes.
+func WithAuthReadLimit(n int) OptionFn {
+	return func(s *Server) {
+		s.authReadLimit = n
+	}
+}
+
+// WithReadLimitReply sets the message replied to a client whose message exceeds the read limit.
+func WithReadLimitReply(fn func(client *Client, header ProtocolHeader, limit int) *Message) OptionFn {
+	return func(s *Server) {
+		s.limitReply = fn
+	}
+}
+
+// WithReadLimitErrorCmd replies a message with cmd and the request seq when the read limit is exceeded.
+func WithReadLimitErrorCmd(cmd int) OptionFn {
+	return WithReadLimitReply(func(client *Client, header ProtocolHeader, limit int) *Message {
+		msg := NewCmdMessage(client.DC, cmd)
+		msg.Header.SetSeq(header.Seq())
+		return msg
+	})
+}
+
+// WithKickNotice sets the notice sent to a client before it is kicked.
+func WithKickNotice(fn func(client *Client, reason CloseReason) *Message) OptionFn {
+	return func(s *Server) {
+		s.kickNotice = fn
+	}
+}
+
+// WithKickCmd sends a body-less notice with cmd before a client is kicked.
+func WithKickCmd(cmd int) OptionFn {
+	return WithKickNotice(func(client *Client, reason CloseReason) *Message {
+		return NewCmdMessage(client.DC, cmd)
+	})
+}
+
+// WithDrainTimeout sets how long to wait for clients to drain on restart and Close.
+func WithDrainTimeout(d time.Duration) OptionFn {
+	return func(s *Server) {
+		s.drainTimeout = d
+	}
+}
+
 // WithMaxConn sets maxConn.
 func WithMaxConn(n int) OptionFn {
 	return func(s *Server) {
@@ -51,14 +239,33 @@ func WithMaxConn(n int) OptionFn {
 // WithWriteTimeout sets writeTimeout.
 func WithNetwork(network string) OptionFn {
 	return func(s *Server) {
-		s.lncfg.Network = network
+		s.listenerConfig().Network = network
 	}
 }
 
 // WithListenAddr sets listener addr.
 func WithListenAddr(addr string) OptionFn {
 	return func(s *Server) {
-		s.lncfg.Address = addr
+		s.listenerConfig().Address = addr
+	}
+}
+
+// WithListenerConfig always adds an extra listener after the primary one,
+// all listeners share clients, maxConn and plugin.
+// The primary listener defaults to tcp, see WithPrimaryListener.
+func WithListenerConfig(cfg *ListenerConfig) OptionFn {
+	return func(s *Server) {
+		s.listenerConfig()
+		s.lncfgs = append(s.lncfgs, cfg)
+	}
+}
+
+// WithPrimaryListener replaces the primary listener config,
+// settings made to it by WithNetwork, WithListenAddr, WithTLSConfig and WithOptions before are discarded.
+func WithPrimaryListener(cfg *ListenerConfig) OptionFn {
+	return func(s *Server) {
+		s.listenerConfig()
+		s.lncfgs[0] = cfg
 	}
 }
 
@@ -68,3 +275,17 @@ func WithExternalPlugin(plugin ExternalPlugin) OptionFn {
 		s.plugin = plugin
 	}
 }
+
+// WithGoingAway sets the last message sent to each client on shutdown.
+func WithGoingAway(fn func(*Client) *Message) OptionFn {
+	return func(s *Server) {
+		s.goingAway = fn
+	}
+}
+
+// WithGoingAwayCmd sets a cmd, the going away message is created by client's DataCreator.
+func WithGoingAwayCmd(cmd int) OptionFn {
+	return WithGoingAway(func(client *Client) *Message {
+		return NewCmdMessage(client.DC, cmd)
+	})
+}
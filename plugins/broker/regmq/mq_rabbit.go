@@ -359,8 +359,9 @@ func (rb *RabbitMQ) getRpcRoutingKey(node int, message *meim.InternalMessage) st
 	return fmt.Sprintf("%s_rpc.%d.%d", rb.cfg.QueuePrefix, node, message.Receiver)
 }
 
+// 编码后的数据归调用方所有,Publish之后可能仍被引用,不使用池
 func (rb *RabbitMQ) encodeMessage(msg *meim.InternalMessage) []byte {
-	b, _ := meim.EncodeInternalMessage(msg)
+	b, _ := meim.AppendInternalMessage(nil, msg)
 	return b
 }
 
@@ -20,8 +20,10 @@ type TCPBrokerClient struct {
 
 func NewTCPRouterClient(addr string, dc meim.DataCreator, subCmd, unsubCmd int) *TCPBrokerClient {
 	tr := &TCPBrokerClient{
-		addr: addr,
-		dc:   dc,
+		addr:     addr,
+		dc:       dc,
+		subCmd:   subCmd,
+		unsubCmd: unsubCmd,
 	}
 	return tr
 }
@@ -55,11 +57,7 @@ func (tr *TCPBrokerClient) SyncMessage(msg *meim.InternalMessage) (*meim.Interna
 }
 
 func (tr *TCPBrokerClient) SendMessage(msg *meim.InternalMessage) error {
-	data, err := meim.EncodeInternalMessage(msg)
-	if err == nil {
-		_, err = tr.conn.Write(data)
-	}
-	return err
+	return meim.WriteInternalMessage(tr.conn, msg)
 }
 
 func (tr *TCPBrokerClient) ReceiveMessage() (*meim.InternalMessage, error) {
@@ -82,6 +80,23 @@ func (tr *TCPBrokerClient) UnSubscribe(uid int64) {
 	tr.SendMessage(msg)
 }
 
+// SubscribeTopic 订阅主题,实现meim.TopicBroker
+func (tr *TCPBrokerClient) SubscribeTopic(topic string) {
+	msg := new(meim.InternalMessage)
+	msg.Header = tr.dc.CreateHeader()
+	msg.Header.SetCmd(tr.subCmd)
+	msg.Topic = topic
+	tr.SendMessage(msg)
+}
+
+func (tr *TCPBrokerClient) UnSubscribeTopic(topic string) {
+	msg := new(meim.InternalMessage)
+	msg.Header = tr.dc.CreateHeader()
+	msg.Header.SetCmd(tr.unsubCmd)
+	msg.Topic = topic
+	tr.SendMessage(msg)
+}
+
 func (tr *TCPBrokerClient) Close() {
 	tr.conn.Close()
 }
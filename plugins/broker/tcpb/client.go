@@ -44,9 +44,17 @@ func (client *Client) HandleMessage(msg *meim.InternalMessage) {
 	log.Infof("client: %s handle msg cmd: %d", client.name, cmd)
 	switch cmd {
 	case Subcmd:
-		client.HandleSubscribe(msg.Sender)
+		if msg.Topic != "" {
+			client.HandleSubscribeTopic(msg.Topic)
+		} else {
+			client.HandleSubscribe(msg.Sender)
+		}
 	case Unsubcmd:
-		client.HandleUnsubscribe(msg.Sender)
+		if msg.Topic != "" {
+			client.HandleUnsubscribeTopic(msg.Topic)
+		} else {
+			client.HandleUnsubscribe(msg.Sender)
+		}
 	default:
 		client.HandlePublish(msg)
 	}
@@ -64,8 +72,36 @@ func (client *Client) HandleUnsubscribe(uid int64) {
 	client.route.RemoveUserID(uid)
 }
 
-// 处理发布单聊消息
+// 处理订阅主题
+func (client *Client) HandleSubscribeTopic(topic string) {
+	log.Infof("client: %s subscribe topic:%s", client.name, topic)
+	client.route.AddTopic(topic)
+}
+
+// 处理取消订阅主题
+func (client *Client) HandleUnsubscribeTopic(topic string) {
+	log.Infof("client: %s unsubscribe topic:%s", client.name, topic)
+	client.route.RemoveTopic(topic)
+}
+
+// 处理发布主题消息,发送给订阅了主题的其他节点
+func (client *Client) HandlePublishTopic(msg *meim.InternalMessage) {
+	log.Infof("client: %s publish topic message topic:%s cmd:%d", client.name, msg.Topic, msg.Header.Cmd())
+
+	for c := range FindTopicClientSet(msg.Topic) {
+		if client == c { //不发送给自身
+			continue
+		}
+		c.wt <- msg
+	}
+}
+
+// 处理发布单聊消息,主题不为空时为主题消息
 func (client *Client) HandlePublish(msg *meim.InternalMessage) {
+	if msg.Topic != "" {
+		client.HandlePublishTopic(msg)
+		return
+	}
 	cmd := msg.Header.Cmd()
 	log.Infof("client: %s publish message uid:%d cmd:%s", client.name, msg.Receiver, cmd)
 
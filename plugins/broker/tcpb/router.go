@@ -8,15 +8,15 @@ import (
 
 // 对应每个comect的Route,记录每个comect的用户信息
 type Route struct {
-	mutex sync.Mutex
-	uids  util.IntSet
-	// roomIds util.IntSet
+	mutex  sync.Mutex
+	uids   util.IntSet
+	topics map[string]struct{} // 订阅的主题
 }
 
 func NewRoute() *Route {
 	r := new(Route)
 	r.uids = util.NewIntSet()
-	// r.roomIds = util.NewIntSet()
+	r.topics = make(map[string]struct{})
 
 	return r
 }
@@ -61,25 +61,26 @@ func (route *Route) GetUserIDs() util.IntSet {
 	return uids
 }
 
-// func (route *Route) ContainRoomID(room_id int64) bool {
-// 	route.mutex.Lock()
-// 	defer route.mutex.Unlock()
+func (route *Route) ContainTopic(topic string) bool {
+	route.mutex.Lock()
+	defer route.mutex.Unlock()
 
-// 	return route.roomIds.IsMember(room_id)
-// }
+	_, ok := route.topics[topic]
+	return ok
+}
 
-// func (route *Route) AddRoomID(room_id int64) {
-// 	route.mutex.Lock()
-// 	defer route.mutex.Unlock()
+func (route *Route) AddTopic(topic string) {
+	route.mutex.Lock()
+	defer route.mutex.Unlock()
 
-// 	route.roomIds.Add(room_id)
-// }
+	route.topics[topic] = struct{}{}
+}
 
-// func (route *Route) RemoveRoomID(room_id int64) {
-// 	route.mutex.Lock()
-// 	defer route.mutex.Unlock()
+func (route *Route) RemoveTopic(topic string) {
+	route.mutex.Lock()
+	defer route.mutex.Unlock()
 
-// 	route.roomIds.Remove(room_id)
-// }
+	delete(route.topics, topic)
+}
 
 //=================client===
@@ -57,6 +57,19 @@ func FindClientSet(userId int64) ClientSet {
 	return s
 }
 
+// 查找订阅了主题的客户端
+func FindTopicClientSet(topic string) ClientSet {
+	clientsMutex.RLock()
+	defer clientsMutex.RUnlock()
+	s := NewClientSet()
+	for c := range clients {
+		if c.route.ContainTopic(topic) {
+			s.Add(c)
+		}
+	}
+	return s
+}
+
 // 判断用户是否在线
 func IsUserOnline(uid int64) bool {
 	clientsMutex.RLock()
@@ -6,6 +6,7 @@ import (
 
 	"github.com/ipiao/meim"
 	"github.com/ipiao/meim/log"
+	"github.com/ipiao/meim/util"
 )
 
 type DataCreator struct {
@@ -13,6 +14,7 @@ type DataCreator struct {
 	cmdType        map[int]reflect.Type
 	typeCmd        map[reflect.Type]int // 一般在写的时候需要
 	cmdDescription map[int]string       // 消息描述信息,用于日志
+	pools          *util.TypePools      // body池,nil表示不复用body
 	//mu         sync.RWMutex
 }
 
@@ -41,6 +43,9 @@ func (m *DataCreator) SetBodyCmd2(cmd int, t reflect.Type, desc ...string) {
 	}
 	m.cmdType[cmd] = t
 	m.typeCmd[t] = cmd
+	if m.pools != nil {
+		m.pools.Init(t)
+	}
 	if len(desc) > 0 {
 		m.cmdDescription[cmd] = desc[0]
 	}
@@ -79,9 +84,38 @@ func (m *DataCreator) GetMsg(cmd int) interface{} {
 		log.Warnf("cmd %d doesnt set body", cmd)
 		return nil
 	}
+	if m.pools != nil {
+		return m.pools.Get(t)
+	}
 	return newTypeData(t)
 }
 
+// EnableBodyPool 复用body,读取的消息处理完后通过Message.Release放回池中
+// 放回时body实现了util.Reset会被重置
+func (m *DataCreator) EnableBodyPool() {
+	m.pools = util.NewTypePools()
+	for _, t := range m.cmdType {
+		m.pools.Init(t)
+	}
+}
+
+// PutMsg 将cmd对应的body放回池中,未开启复用时忽略
+func (m *DataCreator) PutMsg(cmd int, msg interface{}) {
+	if m.pools == nil || msg == nil {
+		return
+	}
+	t, ok := m.cmdType[cmd]
+	if !ok || reflect.TypeOf(msg) != t {
+		return
+	}
+	m.pools.Put(t, msg)
+}
+
+// ReleaseBody 实现meim.BodyReleaser
+func (m *DataCreator) ReleaseBody(cmd int, body meim.ProtocolBody) {
+	m.PutMsg(cmd, body)
+}
+
 func (m *DataCreator) Clone() *DataCreator {
 	cts := make(map[int]reflect.Type)
 	tcs := make(map[reflect.Type]int)
@@ -99,12 +133,16 @@ func (m *DataCreator) Clone() *DataCreator {
 		cmdDescs[cmd] = desc
 	}
 
-	return &DataCreator{
+	dc := &DataCreator{
 		headerType:     m.headerType,
 		cmdType:        cts,
 		typeCmd:        tcs,
 		cmdDescription: cmdDescs,
 	}
+	if m.pools != nil {
+		dc.EnableBodyPool()
+	}
+	return dc
 }
 
 func (m *DataCreator) CreateHeader() meim.ProtocolHeader {
@@ -33,6 +33,15 @@ func (p *ProtoData) Decode(b []byte) error {
 	return err
 }
 
+// proto.Unmarshal会复制bytes字段,不保留传入的字节
+func (p *ProtoData) ReuseDecodeBuffer() bool {
+	return true
+}
+
+func (p *ProtoData) Size() int {
+	return proto.Size(p.Message)
+}
+
 func (p *ProtoData) Reset() {
 	p.Message.Reset()
 }
@@ -76,6 +85,13 @@ func (m *ProtoDataCreator) CreateBody(cmd int) meim.ProtocolBody {
 	return NewProtoData(msg.(proto.Message))
 }
 
+// ReleaseBody 实现meim.BodyReleaser,将proto.Message放回池中
+func (m *ProtoDataCreator) ReleaseBody(cmd int, body meim.ProtocolBody) {
+	if p, ok := body.(*ProtoData); ok {
+		m.PutMsg(cmd, p.Message)
+	}
+}
+
 func (m *ProtoDataCreator) CreateMessage(body interface{}) *meim.Message {
 	cmd, _ := m.GetCmd(body)
 	hdr := m.CreateHeader()
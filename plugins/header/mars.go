@@ -34,6 +34,11 @@ func (h *MarsHeader) Decode(b []byte) error {
 	return nil
 }
 
+// Decode不保留传入的字节
+func (h *MarsHeader) ReuseDecodeBuffer() bool {
+	return true
+}
+
 func (h *MarsHeader) Encode() ([]byte, error) {
 	b := make([]byte, 20, 20)
 	h.HeadLen = 20
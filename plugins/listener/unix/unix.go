@@ -15,5 +15,6 @@ func unixMakeListener(cfg *meim.ListenerConfig) (ln net.Listener, err error) {
 	if err != nil {
 		return nil, err
 	}
-	return net.ListenUnix("unix", laddr)
+	// 支持热重启时继承监听
+	return meim.Listen("unix", laddr.String())
 }
@@ -0,0 +1,559 @@
+package meim
+
+// 用户在线状态,按设备聚合,跨节点通过Broker同步
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ipiao/meim/log"
+	"github.com/ipiao/meim/util"
+)
+
+// PresenceTopic 在线状态消息在Broker中的主题
+const PresenceTopic = "presence"
+
+const (
+	DefaultPresenceHeartbeat = time.Second * 10
+)
+
+// PresenceStatus 在线状态,多个设备或节点时取最大的状态
+type PresenceStatus int32
+
+const (
+	PresenceOffline PresenceStatus = iota // 离线
+	PresenceAway                          // 离开
+	PresenceOnline                        // 在线
+	PresenceBusy                          // 忙碌
+)
+
+func (s PresenceStatus) String() string {
+	switch s {
+	case PresenceOffline:
+		return "offline"
+	case PresenceAway:
+		return "away"
+	case PresenceOnline:
+		return "online"
+	case PresenceBusy:
+		return "busy"
+	}
+	return fmt.Sprintf("presence-%d", int32(s))
+}
+
+// PresenceBody 在线状态消息的body,通知订阅者和发布到Broker时使用
+// 二进制编码: uid(8) + status(4) + node(8) + 时间ms(8)
+// UID为0时是节点心跳,Timestamp为节点的启动时间,用于发现节点重启
+// DataCreator需要为PresenceConfig.Cmd创建能解码原始字节的body,如*PresenceBody
+type PresenceBody struct {
+	UID       int64
+	Status    PresenceStatus
+	Node      int64 // 发布状态的节点
+	Timestamp int64 // ms
+}
+
+const presenceBodyLength = 28
+
+func (b *PresenceBody) Decode(data []byte) error {
+	if len(data) != presenceBodyLength {
+		return ErrorInvalidMessage
+	}
+	b.UID = int64(binary.BigEndian.Uint64(data[:8]))
+	b.Status = PresenceStatus(binary.BigEndian.Uint32(data[8:12]))
+	b.Node = int64(binary.BigEndian.Uint64(data[12:20]))
+	b.Timestamp = int64(binary.BigEndian.Uint64(data[20:28]))
+	return nil
+}
+
+func (b *PresenceBody) ReuseDecodeBuffer() bool {
+	return true
+}
+
+func (b *PresenceBody) Encode() ([]byte, error) {
+	data := make([]byte, presenceBodyLength)
+	binary.BigEndian.PutUint64(data[:8], uint64(b.UID))
+	binary.BigEndian.PutUint32(data[8:12], uint32(b.Status))
+	binary.BigEndian.PutUint64(data[12:20], uint64(b.Node))
+	binary.BigEndian.PutUint64(data[20:28], uint64(b.Timestamp))
+	return data, nil
+}
+
+func (b *PresenceBody) Size() int {
+	return presenceBodyLength
+}
+
+// PresenceEvent 用户聚合状态变化
+type PresenceEvent struct {
+	UID    int64
+	Status PresenceStatus
+	Old    PresenceStatus
+	Reason CloseReason // 因本节点客户端关闭而变化时的关闭原因
+}
+
+// PresenceConfig 在线状态配置
+type PresenceConfig struct {
+	Cmd  int         // 通知订阅者和发布到Broker的消息指令
+	Node int64       // 本节点id,为0时使用Exchanger的节点id
+	DC   DataCreator // 创建发布到Broker的消息,为nil时不发布
+
+	Heartbeat   time.Duration // 节点心跳间隔,默认DefaultPresenceHeartbeat
+	NodeTimeout time.Duration // 超过时间未收到其他节点的消息时清除其状态,默认3倍Heartbeat
+
+	// 通知订阅者的消息,默认为Cmd指令,body为*PresenceBody,可选
+	Notify func(client *Client, ev PresenceEvent) *Message
+	// 状态变化,与Notify一起在锁外按发生顺序串行调用,不能再调用SetStatus等改变状态的方法,可选
+	OnChange func(ev PresenceEvent)
+}
+
+// Presence 在线状态服务
+// 客户端认证后调用Attach,关闭(包括心跳超时)后自动离线
+// 跨节点同步见Exchanger.SetPresence
+type Presence struct {
+	cfg       PresenceConfig
+	publisher Publisher
+	epoch     int64 // 启动时间ms
+
+	outMu     sync.Mutex
+	outbox    []*InternalMessage // 待发布的消息,由publish协程按顺序发布
+	outCh     chan struct{}
+	closeCh   chan struct{}
+	closeOnce sync.Once
+
+	mu       sync.Mutex
+	devices  map[int64]map[*Client]PresenceStatus // 本节点每个用户的设备状态
+	nodes    map[int64]map[int64]PresenceStatus   // 其他节点每个用户的状态
+	status   map[int64]PresenceStatus             // 聚合状态,不含离线
+	subs     map[int64]ClientSet                  // 被订阅的用户和订阅者
+	watching map[*Client]util.IntSet              // 客户端订阅的用户
+	watched  map[*Client]bool                     // 已经在等待关闭的客户端
+	seen     map[int64]time.Time                  // 其他节点最后一次消息的时间
+	epochs   map[int64]int64                      // 其他节点的启动时间
+	events   []presenceNotice                     // 等待通知的状态变化
+	hookMu   sync.Mutex                           // 保证通知按发生顺序串行调用
+}
+
+// 状态变化和当时的订阅者
+type presenceNotice struct {
+	ev   PresenceEvent
+	subs ClientSet
+	node int64
+}
+
+func NewPresence(cfg PresenceConfig) *Presence {
+	if cfg.Heartbeat <= 0 {
+		cfg.Heartbeat = DefaultPresenceHeartbeat
+	}
+	if cfg.NodeTimeout <= 0 {
+		cfg.NodeTimeout = cfg.Heartbeat * 3
+	}
+	return &Presence{
+		cfg:      cfg,
+		epoch:    time.Now().UnixNano() / int64(time.Millisecond),
+		outCh:    make(chan struct{}, 1),
+		closeCh:  make(chan struct{}),
+		devices:  make(map[int64]map[*Client]PresenceStatus),
+		nodes:    make(map[int64]map[int64]PresenceStatus),
+		status:   make(map[int64]PresenceStatus),
+		subs:     make(map[int64]ClientSet),
+		watching: make(map[*Client]util.IntSet),
+		watched:  make(map[*Client]bool),
+		seen:     make(map[int64]time.Time),
+		epochs:   make(map[int64]int64),
+	}
+}
+
+// 没有配置Node时使用node,在设置发布者前调用
+func (p *Presence) defaultNode(node int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cfg.Node == 0 {
+		p.cfg.Node = node
+	}
+}
+
+// 设置发布者并启动publish协程,只能调用一次
+// 先发布心跳,再发布已有的状态
+func (p *Presence) setPublisher(publisher Publisher) {
+	if p.cfg.DC == nil {
+		return
+	}
+	p.mu.Lock()
+	p.publisher = publisher
+	p.outMu.Lock()
+	p.outbox = append(p.outbox, p.message(0, PresenceOffline, p.epoch))
+	p.outMu.Unlock()
+	p.syncLocked()
+	p.mu.Unlock()
+	go p.run()
+}
+
+// Close 停止发布状态和心跳
+func (p *Presence) Close() {
+	p.closeOnce.Do(func() { close(p.closeCh) })
+}
+
+func (p *Presence) run() {
+	ticker := time.NewTicker(p.cfg.Heartbeat)
+	defer ticker.Stop()
+	p.flush()
+	for {
+		select {
+		case <-p.outCh:
+			p.flush()
+		case <-ticker.C:
+			p.expire()
+			p.heartbeat()
+		case <-p.closeCh:
+			return
+		}
+	}
+}
+
+// 发布心跳,其他节点据此判断本节点存活和重启
+func (p *Presence) heartbeat() {
+	p.outMu.Lock()
+	p.outbox = append(p.outbox, p.message(0, PresenceOffline, p.epoch))
+	p.outMu.Unlock()
+	p.flush()
+}
+
+// 按顺序发布待发布的消息,在publish协程调用,不持有p.mu
+func (p *Presence) flush() {
+	p.outMu.Lock()
+	msgs := p.outbox
+	p.outbox = nil
+	p.outMu.Unlock()
+	for _, msg := range msgs {
+		p.publisher.PublishMessage(msg)
+	}
+}
+
+// 清除超时未收到消息的节点的状态
+func (p *Presence) expire() {
+	defer p.runEvents()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	for node, t := range p.seen {
+		if now.Sub(t) > p.cfg.NodeTimeout {
+			log.Infof("presence node %d timeout, clear its status", node)
+			p.dropNodeLocked(node)
+			delete(p.seen, node)
+			delete(p.epochs, node)
+		}
+	}
+}
+
+// 清除其他节点的所有状态
+func (p *Presence) dropNodeLocked(node int64) {
+	for uid, nodes := range p.nodes {
+		if _, ok := nodes[node]; !ok {
+			continue
+		}
+		delete(nodes, node)
+		if len(nodes) == 0 {
+			delete(p.nodes, uid)
+		}
+		p.aggregateLocked(uid, CloseReasonNone)
+	}
+}
+
+// 在锁内调用,客户端关闭后清理
+func (p *Presence) watchLocked(client *Client) {
+	if p.watched[client] {
+		return
+	}
+	p.watched[client] = true
+	go func() {
+		<-client.Done()
+		p.detach(client)
+	}()
+}
+
+// Attach 客户端上线,需要已设置UID
+func (p *Presence) Attach(client *Client) {
+	p.SetStatus(client, PresenceOnline)
+}
+
+// SetStatus 设置客户端设备的状态,未Attach时同时上线
+func (p *Presence) SetStatus(client *Client, status PresenceStatus) {
+	if client.UID == 0 {
+		log.Warnf("presence set status of invalid client %s", client.Log())
+		return
+	}
+	defer p.runEvents()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if status == PresenceOffline {
+		p.removeDeviceLocked(client, CloseReasonNone)
+		return
+	}
+	devices, ok := p.devices[client.UID]
+	if !ok {
+		devices = make(map[*Client]PresenceStatus)
+		p.devices[client.UID] = devices
+	}
+	old := p.localLocked(client.UID)
+	devices[client] = status
+	p.watchLocked(client)
+	p.updateLocked(client.UID, old, CloseReasonNone)
+}
+
+func (p *Presence) removeDeviceLocked(client *Client, reason CloseReason) {
+	devices, ok := p.devices[client.UID]
+	if !ok {
+		return
+	}
+	if _, ok := devices[client]; !ok {
+		return
+	}
+	old := p.localLocked(client.UID)
+	delete(devices, client)
+	if len(devices) == 0 {
+		delete(p.devices, client.UID)
+	}
+	p.updateLocked(client.UID, old, reason)
+}
+
+// 客户端关闭
+func (p *Presence) detach(client *Client) {
+	defer p.runEvents()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.watched, client)
+	p.removeDeviceLocked(client, client.CloseReason())
+	for uid := range p.watching[client] {
+		p.unsubscribeLocked(client, uid)
+	}
+	delete(p.watching, client)
+}
+
+// Status 用户的聚合状态
+func (p *Presence) Status(uid int64) PresenceStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.status[uid]
+}
+
+// 本节点的聚合状态
+func (p *Presence) localLocked(uid int64) PresenceStatus {
+	s := PresenceOffline
+	for _, ds := range p.devices[uid] {
+		if ds > s {
+			s = ds
+		}
+	}
+	return s
+}
+
+// 本节点状态从old变化后,发布并更新聚合状态
+func (p *Presence) updateLocked(uid int64, old PresenceStatus, reason CloseReason) {
+	local := p.localLocked(uid)
+	if local == old {
+		return
+	}
+	p.publishLocked(uid, local)
+	p.aggregateLocked(uid, reason)
+}
+
+// 重新计算聚合状态,变化时记录通知,由runEvents在锁外调用
+func (p *Presence) aggregateLocked(uid int64, reason CloseReason) {
+	s := p.localLocked(uid)
+	for _, ns := range p.nodes[uid] {
+		if ns > s {
+			s = ns
+		}
+	}
+	old := p.status[uid]
+	if s == old {
+		return
+	}
+	if s == PresenceOffline {
+		delete(p.status, uid)
+	} else {
+		p.status[uid] = s
+	}
+
+	n := presenceNotice{
+		ev:   PresenceEvent{UID: uid, Status: s, Old: old, Reason: reason},
+		subs: p.subs[uid].Clone(),
+		node: p.cfg.Node,
+	}
+	p.events = append(p.events, n)
+}
+
+// 在锁外调用OnChange并通知订阅者,其他调用正在处理时由其按顺序处理
+func (p *Presence) runEvents() {
+	p.hookMu.Lock()
+	defer p.hookMu.Unlock()
+	for {
+		p.mu.Lock()
+		events := p.events
+		p.events = nil
+		p.mu.Unlock()
+		if len(events) == 0 {
+			return
+		}
+		for _, n := range events {
+			if p.cfg.OnChange != nil {
+				p.cfg.OnChange(n.ev)
+			}
+			for c := range n.subs {
+				if msg := p.notifyMessage(c, n); msg != nil {
+					c.EnqueuePriorityMessage(msg, PriorityRealtime, false)
+				}
+			}
+		}
+	}
+}
+
+func (p *Presence) notifyMessage(client *Client, n presenceNotice) *Message {
+	if p.cfg.Notify != nil {
+		return p.cfg.Notify(client, n.ev)
+	}
+	if client.DC == nil {
+		return nil
+	}
+	msg := NewCmdMessage(client.DC, p.cfg.Cmd)
+	msg.Body = &PresenceBody{UID: n.ev.UID, Status: n.ev.Status, Node: n.node, Timestamp: time.Now().UnixNano() / int64(time.Millisecond)}
+	return msg
+}
+
+func (p *Presence) message(uid int64, status PresenceStatus, ts int64) *InternalMessage {
+	msg := NewCmdMessage(p.cfg.DC, p.cfg.Cmd)
+	msg.Body = &PresenceBody{UID: uid, Status: status, Node: p.cfg.Node, Timestamp: ts}
+	return &InternalMessage{Message: msg, Timestamp: ts, Node: p.cfg.Node, Topic: PresenceTopic}
+}
+
+// 发布本节点的状态,在锁内调用以保证顺序,实际由publish协程发布,不会阻塞
+func (p *Presence) publishLocked(uid int64, status PresenceStatus) {
+	if p.publisher == nil || p.cfg.DC == nil {
+		return
+	}
+	msg := p.message(uid, status, time.Now().UnixNano()/int64(time.Millisecond))
+	p.outMu.Lock()
+	p.outbox = append(p.outbox, msg)
+	p.outMu.Unlock()
+	select {
+	case p.outCh <- struct{}{}:
+	default:
+	}
+}
+
+// 发布本节点所有用户的状态,用于其他节点启动或重启后同步
+func (p *Presence) syncLocked() {
+	for uid := range p.devices {
+		p.publishLocked(uid, p.localLocked(uid))
+	}
+}
+
+// HandleMessage 处理其他节点发布的状态,返回是否为状态消息
+func (p *Presence) HandleMessage(msg *InternalMessage) bool {
+	if msg.Topic != PresenceTopic || msg.Body == nil {
+		return false
+	}
+	body, ok := msg.Body.(*PresenceBody)
+	if !ok {
+		// 其他body类型按原始字节解码
+		data, err := msg.Body.Encode()
+		body = new(PresenceBody)
+		if err == nil {
+			err = body.Decode(data)
+		}
+		if err != nil {
+			log.Warnf("presence decode message error: %v, msg: %v", err, msg)
+			return true
+		}
+	}
+	if body.Node == p.cfg.Node {
+		return true
+	}
+
+	defer p.runEvents()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.seen[body.Node] = time.Now()
+	if body.UID == 0 {
+		// 心跳,新节点或重启的节点需要同步本节点的状态
+		epoch, ok := p.epochs[body.Node]
+		if ok && epoch == body.Timestamp {
+			return true
+		}
+		if ok {
+			// 重启前的状态已经失效
+			p.dropNodeLocked(body.Node)
+		}
+		p.epochs[body.Node] = body.Timestamp
+		p.syncLocked()
+		return true
+	}
+	nodes, ok := p.nodes[body.UID]
+	if !ok {
+		nodes = make(map[int64]PresenceStatus)
+		p.nodes[body.UID] = nodes
+	}
+	if body.Status == PresenceOffline {
+		delete(nodes, body.Node)
+		if len(nodes) == 0 {
+			delete(p.nodes, body.UID)
+		}
+	} else {
+		nodes[body.Node] = body.Status
+	}
+	p.aggregateLocked(body.UID, CloseReasonNone)
+	return true
+}
+
+// Subscribe 客户端订阅用户的状态变化,返回用户当前的状态,客户端关闭后自动取消
+func (p *Presence) Subscribe(client *Client, uids ...int64) map[int64]PresenceStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	watching, ok := p.watching[client]
+	if !ok {
+		watching = util.NewIntSet()
+		p.watching[client] = watching
+	}
+	p.watchLocked(client)
+	res := make(map[int64]PresenceStatus, len(uids))
+	for _, uid := range uids {
+		set, ok := p.subs[uid]
+		if !ok {
+			set = NewClientSet()
+			p.subs[uid] = set
+		}
+		set.Add(client)
+		watching.Add(uid)
+		res[uid] = p.status[uid]
+	}
+	return res
+}
+
+// Unsubscribe 取消订阅
+func (p *Presence) Unsubscribe(client *Client, uids ...int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, uid := range uids {
+		p.unsubscribeLocked(client, uid)
+		if watching, ok := p.watching[client]; ok {
+			watching.Remove(uid)
+		}
+	}
+}
+
+func (p *Presence) unsubscribeLocked(client *Client, uid int64) {
+	if set, ok := p.subs[uid]; ok {
+		set.Remove(client)
+		if set.Count() == 0 {
+			delete(p.subs, uid)
+		}
+	}
+}
+
+// Subscribers 订阅了用户状态的本节点客户端数
+func (p *Presence) Subscribers(uid int64) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.subs[uid].Count()
+}
@@ -0,0 +1,231 @@
+package meim
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 直接转发到其他节点的Presence
+type presencePeer struct {
+	peers []*Presence
+}
+
+func (p *presencePeer) PublishMessage(msg *InternalMessage) bool {
+	data, _ := AppendInternalMessage(nil, msg)
+	m, err := DecodeInternalMessgae(data, testDC)
+	if err != nil {
+		return false
+	}
+	for _, peer := range p.peers {
+		peer.HandleMessage(m)
+	}
+	return true
+}
+
+func presenceNotices(client *Client) []PresenceBody {
+	var res []PresenceBody
+	for msg := client.nextMessage(); msg != nil; msg = client.nextMessage() {
+		res = append(res, *msg.Body.(*PresenceBody))
+	}
+	return res
+}
+
+func TestPresence(t *testing.T) {
+	events := make(chan PresenceEvent, 10)
+	p := NewPresence(PresenceConfig{Cmd: 60, OnChange: func(ev PresenceEvent) { events <- ev }})
+	phone := newRouterTestClient(1, "ios")
+	pc := newRouterTestClient(1, "pc")
+	watcher := newRouterTestClient(2, "ios")
+
+	assert.Equal(t, map[int64]PresenceStatus{1: PresenceOffline}, p.Subscribe(watcher, 1))
+	assert.Equal(t, 1, p.Subscribers(1))
+
+	p.Attach(phone)
+	assert.Equal(t, PresenceEvent{UID: 1, Status: PresenceOnline, Old: PresenceOffline}, <-events)
+	p.SetStatus(phone, PresenceBusy)
+	<-events
+	// 其他设备状态较低,聚合状态不变
+	p.Attach(pc)
+	assert.Equal(t, PresenceBusy, p.Status(1))
+	notices := presenceNotices(watcher)
+	if assert.Len(t, notices, 2) {
+		assert.Equal(t, PresenceOnline, notices[0].Status)
+		assert.Equal(t, PresenceBusy, notices[1].Status)
+		assert.Equal(t, int64(1), notices[1].UID)
+	}
+
+	// 心跳超时关闭
+	phone.setCloseReason(CloseReasonIdleTimeout)
+	close(phone.done)
+	assert.Equal(t, PresenceEvent{UID: 1, Status: PresenceOnline, Old: PresenceBusy, Reason: CloseReasonIdleTimeout}, <-events)
+	close(pc.done)
+	assert.Equal(t, PresenceOffline, (<-events).Status)
+	assert.Equal(t, PresenceOffline, p.Status(1))
+
+	// 订阅者关闭后自动取消订阅
+	close(watcher.done)
+	assert.Eventually(t, func() bool { return p.Subscribers(1) == 0 }, time.Second, time.Millisecond*10)
+}
+
+func TestPresenceCluster(t *testing.T) {
+	dc := newPooledDataCreator()
+	p1 := NewPresence(PresenceConfig{Cmd: 60, Node: 1, DC: dc})
+	p2 := NewPresence(PresenceConfig{Cmd: 60, Node: 2, DC: dc})
+	defer p1.Close()
+	defer p2.Close()
+	c1 := newRouterTestClient(1, "ios")
+	c2 := newRouterTestClient(1, "pc")
+	// 设置发布者前已有的状态在启动时同步
+	p1.Attach(c1)
+	peer := &presencePeer{peers: []*Presence{p1, p2}}
+	p1.setPublisher(peer)
+	p2.setPublisher(peer)
+
+	watcher := newRouterTestClient(2, "ios")
+	p2.Subscribe(watcher, 1)
+	assert.Eventually(t, func() bool { return p2.Status(1) == PresenceOnline }, time.Second, time.Millisecond*10)
+	p2.Attach(c2)
+	p2.SetStatus(c2, PresenceAway)
+	// 节点1在线,节点2离开,聚合为在线
+	time.Sleep(time.Millisecond * 50)
+	assert.Equal(t, PresenceOnline, p1.Status(1))
+	assert.Equal(t, PresenceOnline, p2.Status(1))
+
+	p1.SetStatus(c1, PresenceOffline)
+	assert.Eventually(t, func() bool { return p2.Status(1) == PresenceAway }, time.Second, time.Millisecond*10)
+	assert.Equal(t, PresenceAway, p1.Status(1))
+
+	var statuses []PresenceStatus
+	for _, n := range presenceNotices(watcher) {
+		statuses = append(statuses, n.Status)
+	}
+	assert.Equal(t, []PresenceStatus{PresenceOnline, PresenceAway}, statuses)
+}
+
+// 记录发布的状态
+type presenceRecorder struct {
+	mu     sync.Mutex
+	bodies []PresenceBody
+}
+
+func (r *presenceRecorder) PublishMessage(msg *InternalMessage) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.bodies = append(r.bodies, *msg.Body.(*PresenceBody))
+	return true
+}
+
+func (r *presenceRecorder) statuses(uid int64) []PresenceStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var res []PresenceStatus
+	for _, b := range r.bodies {
+		if b.UID == uid {
+			res = append(res, b.Status)
+		}
+	}
+	return res
+}
+
+func TestPresenceNodeTimeout(t *testing.T) {
+	events := make(chan PresenceEvent, 10)
+	p := NewPresence(PresenceConfig{Cmd: 60, Node: 2, DC: testDC, Heartbeat: time.Millisecond * 20, NodeTimeout: time.Millisecond * 60,
+		OnChange: func(ev PresenceEvent) { events <- ev }})
+	defer p.Close()
+	rec := new(presenceRecorder)
+	p.setPublisher(rec)
+	p.Attach(newRouterTestClient(2, "ios"))
+	<-events
+
+	remote := NewPresence(PresenceConfig{Cmd: 60, Node: 1, DC: testDC})
+	// 新节点的心跳触发同步本节点的状态
+	assert.True(t, p.HandleMessage(remote.message(0, PresenceOffline, 100)))
+	assert.True(t, p.HandleMessage(remote.message(1, PresenceOnline, 101)))
+	assert.Equal(t, PresenceOnline, (<-events).Status)
+	assert.Eventually(t, func() bool {
+		return len(rec.statuses(2)) == 2
+	}, time.Second, time.Millisecond*10)
+
+	// 节点重启,之前的状态失效
+	assert.True(t, p.HandleMessage(remote.message(0, PresenceOffline, 200)))
+	assert.Equal(t, PresenceEvent{UID: 1, Status: PresenceOffline, Old: PresenceOnline}, <-events)
+	assert.Eventually(t, func() bool {
+		return len(rec.statuses(2)) == 3
+	}, time.Second, time.Millisecond*10)
+
+	// 节点超时,状态清除
+	assert.True(t, p.HandleMessage(remote.message(1, PresenceBusy, 201)))
+	assert.Equal(t, PresenceBusy, (<-events).Status)
+	select {
+	case ev := <-events:
+		assert.Equal(t, PresenceEvent{UID: 1, Status: PresenceOffline, Old: PresenceBusy}, ev)
+	case <-time.After(time.Second):
+		t.Fatal("node not expired")
+	}
+	assert.Equal(t, PresenceOffline, p.Status(1))
+	assert.Equal(t, []PresenceStatus{PresenceOnline, PresenceOnline, PresenceOnline}, rec.statuses(2))
+}
+
+func TestPresenceNotifyOutsideLock(t *testing.T) {
+	var p *Presence
+	var statuses []PresenceStatus
+	block := make(chan struct{})
+	p = NewPresence(PresenceConfig{Cmd: 60,
+		OnChange: func(ev PresenceEvent) {
+			<-block
+			statuses = append(statuses, p.Status(ev.UID))
+		},
+		Notify: func(client *Client, ev PresenceEvent) *Message {
+			p.Subscribers(ev.UID)
+			return nil
+		}})
+	p.Subscribe(newRouterTestClient(2, "ios"), 1)
+
+	attached := make(chan struct{})
+	go func() {
+		p.Attach(newRouterTestClient(1, "ios"))
+		close(attached)
+	}()
+	// 回调阻塞时不影响查询
+	assert.Eventually(t, func() bool { return p.Status(1) == PresenceOnline }, time.Second, time.Millisecond*10)
+	close(block)
+	<-attached
+	assert.Equal(t, []PresenceStatus{PresenceOnline}, statuses)
+}
+
+func TestExchangerPresence(t *testing.T) {
+	broker := new(recordBroker)
+	p := NewPresence(PresenceConfig{Cmd: 60, Node: 1, DC: testDC})
+	defer p.Close()
+	exc := NewMessageExchanger(broker, nil, nil, NewRouter())
+	exc.SetPresence(p)
+	assert.Equal(t, []string{"+" + PresenceTopic}, broker.topics)
+
+	closed := make(chan bool)
+	defer close(closed)
+	go exc.handleWrite(closed)
+	p.Attach(newRouterTestClient(1, "ios"))
+	assert.Eventually(t, func() bool {
+		broker.mu.Lock()
+		defer broker.mu.Unlock()
+		// 心跳和状态
+		return len(broker.sent) == 2 && broker.sent[1].Topic == PresenceTopic && broker.sent[1].Node == 1
+	}, time.Second, time.Millisecond*10)
+
+	// 其他节点的状态,body按原始字节解码
+	b := &PresenceBody{UID: 3, Status: PresenceBusy, Node: 2}
+	data, _ := b.Encode()
+	raw := plainData(data)
+	msg := NewCmdMessage(testDC, 60)
+	msg.Body = &raw
+	assert.True(t, exc.DispatchMessage(&InternalMessage{Message: msg, Node: 2, Topic: PresenceTopic}))
+	assert.Equal(t, PresenceBusy, p.Status(3))
+
+	// 没有配置节点id时使用Exchanger的节点id
+	p2 := NewPresence(PresenceConfig{Cmd: 60})
+	exc.SetPresence(p2)
+	assert.Equal(t, exc.node, p2.cfg.Node)
+}
@@ -0,0 +1,93 @@
+package meim
+
+import "fmt"
+
+// Priority 下发消息的优先级,每个优先级一个发送队列
+type Priority int
+
+const (
+	PriorityControl  Priority = iota // 控制消息,如心跳,踢下线通知
+	PriorityRealtime                 // 实时消息,如聊天消息,EnqueueMessage的默认优先级
+	PriorityBulk                     // 批量消息,如在线状态,广播,EnqueueNonBlockMessage的默认优先级
+
+	priorityCount = 3
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityControl:
+		return "control"
+	case PriorityRealtime:
+		return "realtime"
+	case PriorityBulk:
+		return "bulk"
+	}
+	return fmt.Sprintf("priority-%d", int(p))
+}
+
+func (p Priority) valid() bool {
+	return p >= 0 && p < priorityCount
+}
+
+// SchedulePolicy 写协程在各优先级队列之间的调度策略
+type SchedulePolicy int
+
+const (
+	ScheduleStrict   SchedulePolicy = iota // 严格优先级,高优先级队列为空时才发送低优先级的消息
+	ScheduleWeighted                       // 加权轮询,每轮每个优先级最多发送Weights条消息
+)
+
+// 默认权重,依次为control,realtime,bulk
+var DefaultScheduleWeights = [priorityCount]int{16, 8, 1}
+
+// ScheduleConfig 调度配置
+type ScheduleConfig struct {
+	Policy  SchedulePolicy
+	Weights [priorityCount]int // ScheduleWeighted的权重,不大于0时使用DefaultScheduleWeights
+}
+
+func (cfg *ScheduleConfig) init() {
+	for i, w := range cfg.Weights {
+		if w <= 0 {
+			cfg.Weights[i] = DefaultScheduleWeights[i]
+		}
+	}
+}
+
+// 加权轮询的状态,只在写协程中使用
+type scheduler struct {
+	cfg    ScheduleConfig
+	lane   int // 当前轮到的优先级
+	credit int // 当前优先级剩余可发送的消息数
+}
+
+// 按调度策略取出下一条消息,所有队列为空时返回nil
+func (client *Client) nextMessage() *Message {
+	s := &client.sched
+	if s.cfg.Policy == ScheduleStrict {
+		for _, q := range client.lanes {
+			if msg := q.pop(); msg != nil {
+				return msg
+			}
+		}
+		return nil
+	}
+
+	for i := 0; i <= priorityCount; i++ {
+		if s.credit > 0 {
+			if msg := client.lanes[s.lane].pop(); msg != nil {
+				s.credit--
+				return msg
+			}
+		}
+		s.lane = (s.lane + 1) % priorityCount
+		s.credit = s.cfg.Weights[s.lane]
+	}
+	return nil
+}
+
+// SetSchedule 设置调度策略,只能在Run之前调用,一般在认证时设置
+func (client *Client) SetSchedule(cfg ScheduleConfig) {
+	cfg.init()
+	client.sched = scheduler{cfg: cfg, credit: cfg.Weights[0]}
+}
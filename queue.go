@@ -0,0 +1,331 @@
+package meim
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const DefaultQueueBlockTimeout = time.Second * 10
+
+// OverflowPolicy 客户端发送队列满时的处理策略
+type OverflowPolicy int
+
+const (
+	OverflowBlock      OverflowPolicy = iota // 阻塞等待,超过BlockTimeout后丢弃新消息;非阻塞入队时按DropOldest处理
+	OverflowDropOldest                       // 丢弃最早的消息
+	OverflowDropNewest                       // 丢弃新消息
+	OverflowDisconnect                       // 断开慢客户端,丢弃队列中所有消息
+	OverflowSpill                            // 新消息交给Spill,一般是写入离线存储
+)
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case OverflowBlock:
+		return "block"
+	case OverflowDropOldest:
+		return "drop-oldest"
+	case OverflowDropNewest:
+		return "drop-newest"
+	case OverflowDisconnect:
+		return "disconnect"
+	case OverflowSpill:
+		return "spill"
+	}
+	return fmt.Sprintf("policy-%d", int(p))
+}
+
+// QueueConfig 客户端发送队列配置
+type QueueConfig struct {
+	Policy       OverflowPolicy
+	MaxMessages  int           // 最大消息数,默认MessageQueueLimit
+	MaxBytes     int           // 最大字节数,0表示不限制,消息大小见MessageSize
+	BlockTimeout time.Duration // OverflowBlock的等待时间,默认DefaultQueueBlockTimeout
+
+	// OverflowSpill时处理新消息,返回错误时视为丢弃
+	Spill func(*Client, *Message) error
+	// 消息因队列满被丢弃时回调,可选,业务层可以将消息持久化
+	// 等待确认的可靠消息不会交给Spill和OnOverflow,它们会被重传或交给ReliableConfig.OnUnacked
+	OnOverflow func(client *Client, dropped []*Message, policy OverflowPolicy)
+}
+
+func (cfg *QueueConfig) init() {
+	if cfg.MaxMessages <= 0 {
+		cfg.MaxMessages = MessageQueueLimit
+	}
+	if cfg.BlockTimeout <= 0 {
+		cfg.BlockTimeout = DefaultQueueBlockTimeout
+	}
+}
+
+// Sizer 可以给出编码后长度的body,用于按字节限制发送队列
+type Sizer interface {
+	Size() int
+}
+
+// MessageSize 消息编码后的大致长度
+// body没有实现Sizer时使用header中的body长度
+func MessageSize(msg *Message) int {
+	if msg.Header == nil {
+		return 0
+	}
+	if msg.encoded != nil {
+		return len(msg.encoded)
+	}
+	n := msg.Header.Length()
+	if s, ok := msg.Body.(Sizer); ok {
+		return n + s.Size()
+	}
+	return n + msg.Header.BodyLength()
+}
+
+// 入队结果
+type enqueueResult int
+
+const (
+	enqueueOK enqueueResult = iota
+	enqueueClosed
+	enqueueDropped
+	enqueueDisconnect
+	enqueueOverBudget
+)
+
+type queueItem struct {
+	msg  *Message
+	size int
+}
+
+// 客户端发送队列,多个生产者,写协程消费
+type messageQueue struct {
+	mu       sync.Mutex
+	cfg      QueueConfig
+	items    *list.List
+	bytes    int
+	inflight int // 已出队但还没有写出的字节数,写出后才释放预算
+	closed   bool
+	waiters  int           // 阻塞等待空间的生产者
+	space    chan struct{} // 有空间(广播),出队时关闭并重建
+	notify   chan struct{} // 有消息(信号),由客户端的所有队列共享
+	budget   *memoryBudget // 服务的内存预算,nil表示不限制
+	exempt   bool          // 不受内存预算限制,仍然计入使用量
+}
+
+// notify可以由多个队列共享
+func newMessageQueue(cfg QueueConfig, notify chan struct{}) *messageQueue {
+	cfg.init()
+	return &messageQueue{
+		cfg:    cfg,
+		items:  list.New(),
+		space:  make(chan struct{}),
+		notify: notify,
+	}
+}
+
+func (q *messageQueue) setConfig(cfg QueueConfig) {
+	cfg.init()
+	q.mu.Lock()
+	q.cfg = cfg
+	q.mu.Unlock()
+}
+
+func (q *messageQueue) config() QueueConfig {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.cfg
+}
+
+// 超过单条限制的消息在队列为空时也允许入队
+func (q *messageQueue) fits(size int) bool {
+	if q.items.Len() == 0 {
+		return true
+	}
+	if q.items.Len() >= q.cfg.MaxMessages {
+		return false
+	}
+	return q.cfg.MaxBytes <= 0 || q.bytes+size <= q.cfg.MaxBytes
+}
+
+// 入队,block为false时不会阻塞
+// 返回因溢出丢弃的消息
+func (q *messageQueue) push(msg *Message, block bool, done <-chan struct{}) (enqueueResult, []*Message) {
+	size := MessageSize(msg)
+	var timer *time.Timer
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+
+	q.mu.Lock()
+	for {
+		if q.closed {
+			q.mu.Unlock()
+			return enqueueClosed, nil
+		}
+		if q.fits(size) {
+			if !q.budget.acquire(size, q.exempt) {
+				q.mu.Unlock()
+				return enqueueOverBudget, []*Message{msg}
+			}
+			q.items.PushBack(&queueItem{msg: msg, size: size})
+			q.bytes += size
+			q.mu.Unlock()
+			select {
+			case q.notify <- struct{}{}:
+			default:
+			}
+			return enqueueOK, nil
+		}
+
+		policy := q.cfg.Policy
+		if policy == OverflowBlock && !block {
+			policy = OverflowDropOldest
+		}
+		switch policy {
+		case OverflowBlock:
+			if timer == nil {
+				timer = time.NewTimer(q.cfg.BlockTimeout)
+			}
+			space := q.space
+			q.waiters++
+			q.mu.Unlock()
+			select {
+			case <-space:
+				q.mu.Lock()
+				q.waiters--
+				continue
+			case <-done:
+				q.mu.Lock()
+				q.waiters--
+				q.mu.Unlock()
+				return enqueueClosed, nil
+			case <-timer.C:
+				q.mu.Lock()
+				q.waiters--
+				q.mu.Unlock()
+				return enqueueDropped, []*Message{msg}
+			}
+
+		case OverflowDropOldest:
+			// 先确定需要丢弃的消息,预算不足时不丢弃
+			evict, freed := q.evictCount(size)
+			if !q.budget.acquire(size-freed, q.exempt) {
+				q.mu.Unlock()
+				return enqueueOverBudget, []*Message{msg}
+			}
+			dropped := make([]*Message, 0, evict)
+			for i := 0; i < evict; i++ {
+				// 丢弃的消息占用的预算转给新消息
+				dropped = append(dropped, q.remove(q.items.Front()).msg)
+			}
+			q.items.PushBack(&queueItem{msg: msg, size: size})
+			q.bytes += size
+			q.mu.Unlock()
+			select {
+			case q.notify <- struct{}{}:
+			default:
+			}
+			return enqueueOK, dropped
+
+		case OverflowDisconnect:
+			dropped := q.clearLocked()
+			q.closed = true
+			q.mu.Unlock()
+			return enqueueDisconnect, append(dropped, msg)
+
+		default:
+			q.mu.Unlock()
+			return enqueueDropped, []*Message{msg}
+		}
+	}
+}
+
+// 新消息入队需要丢弃的最早的消息数和它们的字节数
+func (q *messageQueue) evictCount(size int) (n int, bytes int) {
+	count, total := q.items.Len(), q.bytes
+	for e := q.items.Front(); e != nil; e = e.Next() {
+		if count < q.cfg.MaxMessages && (q.cfg.MaxBytes <= 0 || total+size <= q.cfg.MaxBytes) {
+			break
+		}
+		item := e.Value.(*queueItem)
+		count--
+		total -= item.size
+		n++
+		bytes += item.size
+	}
+	return
+}
+
+// 移除消息,不释放预算
+func (q *messageQueue) remove(e *list.Element) *queueItem {
+	item := q.items.Remove(e).(*queueItem)
+	q.bytes -= item.size
+	return item
+}
+
+// 关闭队列,返回队列中剩余的消息
+func (q *messageQueue) close() []*Message {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.budget.release(q.inflight)
+	q.inflight = 0
+	return q.clearLocked()
+}
+
+func (q *messageQueue) clearLocked() []*Message {
+	msgs := make([]*Message, 0, q.items.Len())
+	for q.items.Len() > 0 {
+		item := q.remove(q.items.Front())
+		q.budget.release(item.size)
+		msgs = append(msgs, item.msg)
+	}
+	return msgs
+}
+
+// 出队,没有消息时返回nil
+// 消息占用的预算在written之后才释放
+func (q *messageQueue) pop() *Message {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	e := q.items.Front()
+	if e == nil {
+		return nil
+	}
+	item := q.remove(e)
+	q.inflight += item.size
+	if q.waiters > 0 {
+		close(q.space)
+		q.space = make(chan struct{})
+	}
+	return item.msg
+}
+
+// 出队的消息已写出,释放预算
+func (q *messageQueue) written() {
+	q.mu.Lock()
+	q.budget.release(q.inflight)
+	q.inflight = 0
+	q.mu.Unlock()
+}
+
+// 还有消息时重新发出信号,返回是否还有消息
+func (q *messageQueue) renotify() bool {
+	q.mu.Lock()
+	n := q.items.Len()
+	q.mu.Unlock()
+	if n > 0 {
+		select {
+		case q.notify <- struct{}{}:
+		default:
+		}
+	}
+	return n > 0
+}
+
+func (q *messageQueue) len() (int, int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.items.Len(), q.bytes
+}
@@ -0,0 +1,161 @@
+package meim
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newQueueTestClient(cfg QueueConfig) *Client {
+	server, _ := net.Pipe()
+	client := NewClient(server)
+	client.plugin = newEchoPlugin()
+	client.DC = testDC
+	client.SetQueueConfig(cfg)
+	return client
+}
+
+func queuedCmds(client *Client) []int {
+	var cmds []int
+	for msg := client.nextMessage(); msg != nil; msg = client.nextMessage() {
+		cmds = append(cmds, msg.Header.Cmd())
+	}
+	return cmds
+}
+
+func TestQueueOverflow(t *testing.T) {
+	var overflowed []int
+	onOverflow := func(client *Client, dropped []*Message, policy OverflowPolicy) {
+		for _, msg := range dropped {
+			overflowed = append(overflowed, msg.Header.Cmd())
+		}
+	}
+
+	// 丢弃最早的消息
+	client := newQueueTestClient(QueueConfig{Policy: OverflowDropOldest, MaxMessages: 2, OnOverflow: onOverflow})
+	for i := 1; i <= 3; i++ {
+		assert.True(t, client.EnqueueMessage(newTestMessage(i, "a")))
+	}
+	assert.Equal(t, []int{2, 3}, queuedCmds(client))
+	assert.Equal(t, []int{1}, overflowed)
+
+	// 丢弃新消息
+	overflowed = nil
+	client = newQueueTestClient(QueueConfig{Policy: OverflowDropNewest, MaxMessages: 2, OnOverflow: onOverflow})
+	for i := 1; i <= 3; i++ {
+		assert.Equal(t, i <= 2, client.EnqueueMessage(newTestMessage(i, "a")))
+	}
+	assert.Equal(t, []int{1, 2}, queuedCmds(client))
+	assert.Equal(t, []int{3}, overflowed)
+
+	// 断开慢客户端
+	overflowed = nil
+	client = newQueueTestClient(QueueConfig{Policy: OverflowDisconnect, MaxMessages: 2, OnOverflow: onOverflow})
+	for i := 1; i <= 3; i++ {
+		assert.Equal(t, i <= 2, client.EnqueueMessage(newTestMessage(i, "a")))
+	}
+	assert.Equal(t, []int{1, 2, 3}, overflowed)
+	assert.Equal(t, CloseReasonSlowConsumer, client.CloseReason())
+	assert.False(t, client.EnqueueMessage(newTestMessage(4, "a")))
+
+	// 转存
+	overflowed = nil
+	var spilled []int
+	client = newQueueTestClient(QueueConfig{
+		Policy:      OverflowSpill,
+		MaxMessages: 1,
+		OnOverflow:  onOverflow,
+		Spill: func(client *Client, msg *Message) error {
+			if msg.Header.Cmd() == 3 {
+				return errors.New("store full")
+			}
+			spilled = append(spilled, msg.Header.Cmd())
+			return nil
+		},
+	})
+	for i := 1; i <= 3; i++ {
+		assert.Equal(t, i <= 2, client.EnqueueMessage(newTestMessage(i, "a")))
+	}
+	assert.Equal(t, []int{2}, spilled)
+	assert.Equal(t, []int{3}, overflowed)
+}
+
+func TestQueueMaxBytes(t *testing.T) {
+	size := MessageSize(newTestMessage(1, "0123456789"))
+	assert.Equal(t, 22, size)
+
+	client := newQueueTestClient(QueueConfig{Policy: OverflowDropOldest, MaxBytes: size * 2})
+	for i := 1; i <= 3; i++ {
+		client.EnqueueMessage(newTestMessage(i, "0123456789"))
+	}
+	n, bytes := client.QueueLen()
+	assert.Equal(t, 2, n)
+	assert.Equal(t, size*2, bytes)
+
+	// 超过限制的单条消息在队列为空时仍然可以入队
+	queuedCmds(client)
+	assert.True(t, client.EnqueueMessage(newTestMessage(4, string(make([]byte, size*3)))))
+}
+
+func TestQueueBlock(t *testing.T) {
+	var overflowed int
+	client := newQueueTestClient(QueueConfig{
+		MaxMessages:  1,
+		BlockTimeout: time.Millisecond * 50,
+		OnOverflow: func(client *Client, dropped []*Message, policy OverflowPolicy) {
+			overflowed += len(dropped)
+		},
+	})
+	assert.True(t, client.EnqueueMessage(newTestMessage(1, "a")))
+
+	// 等待出队
+	go func() {
+		time.Sleep(time.Millisecond * 10)
+		client.lanes[PriorityRealtime].pop()
+	}()
+	assert.True(t, client.EnqueueMessage(newTestMessage(2, "a")))
+
+	// 超时丢弃
+	start := time.Now()
+	assert.False(t, client.EnqueueMessage(newTestMessage(3, "a")))
+	assert.True(t, time.Since(start) >= time.Millisecond*50)
+	assert.Equal(t, 1, overflowed)
+
+	// 非阻塞入队丢弃最早的消息
+	assert.True(t, client.EnqueuePriorityMessage(newTestMessage(4, "a"), PriorityRealtime, false))
+	assert.Equal(t, []int{4}, queuedCmds(client))
+	assert.Equal(t, 2, overflowed)
+}
+
+func TestPrioritySchedule(t *testing.T) {
+	client := newQueueTestClient(QueueConfig{})
+	enqueue := func() {
+		for i := 0; i < 3; i++ {
+			client.EnqueueNonBlockMessage(newTestMessage(30+i, "bulk"))
+			client.EnqueueMessage(newTestMessage(20+i, "realtime"))
+			client.EnqueuePriorityMessage(newTestMessage(10+i, "control"), PriorityControl, false)
+		}
+	}
+
+	enqueue()
+	assert.Equal(t, []int{10, 11, 12, 20, 21, 22, 30, 31, 32}, queuedCmds(client))
+
+	client.SetSchedule(ScheduleConfig{Policy: ScheduleWeighted, Weights: [priorityCount]int{1, 2, 1}})
+	enqueue()
+	assert.Equal(t, []int{10, 20, 21, 30, 11, 22, 31, 12, 32}, queuedCmds(client))
+}
+
+func TestPriorityQueueConfig(t *testing.T) {
+	client := newQueueTestClient(QueueConfig{})
+	client.SetPriorityQueueConfig(PriorityBulk, QueueConfig{MaxMessages: 5})
+	assert.Equal(t, 5, client.QueueConfig(PriorityBulk).MaxMessages)
+	assert.Equal(t, MessageQueueLimit, client.QueueConfig(PriorityRealtime).MaxMessages)
+
+	// 无效的优先级
+	client.SetPriorityQueueConfig(Priority(-1), QueueConfig{MaxMessages: 1})
+	assert.Equal(t, QueueConfig{}, client.QueueConfig(Priority(-1)))
+	assert.Equal(t, QueueConfig{}, client.QueueConfig(priorityCount))
+}
@@ -0,0 +1,73 @@
+package meim
+
+import (
+	"github.com/ipiao/meim/log"
+)
+
+// SetReadLimit 设置客户端认证后读取消息body的最大长度,不大于0表示不限制
+// DataCreator或ExternalPlugin实现ReadLimiter时,其指定的限制优先
+func (client *Client) SetReadLimit(n int) {
+	client.readLimit.Store(int64(n))
+}
+
+// ReadLimit 客户端读取指令cmd的body的最大长度,不大于0表示不限制
+// 认证阶段取按指令的限制和认证阶段限制中较小的一个
+func (client *Client) ReadLimit(cmd int) int {
+	n := client.cmdReadLimit(cmd)
+	if !client.Authed() && client.authReadLimit > 0 {
+		if n <= 0 || n > client.authReadLimit {
+			return client.authReadLimit
+		}
+		return n
+	}
+	if n != 0 {
+		return n
+	}
+	return int(client.readLimit.Load())
+}
+
+// DataCreator或ExternalPlugin指定的限制,0表示不指定
+func (client *Client) cmdReadLimit(cmd int) int {
+	if l, ok := client.DC.(ReadLimiter); ok {
+		if n := l.ReadLimit(client, cmd); n != 0 {
+			return n
+		}
+	}
+	if l, ok := client.plugin.(ReadLimiter); ok {
+		if n := l.ReadLimit(client, cmd); n != 0 {
+			return n
+		}
+	}
+	return 0
+}
+
+func (client *Client) headerReadLimit(hdr ProtocolHeader) int {
+	return client.ReadLimit(hdr.Cmd())
+}
+
+func (client *Client) readMessage() (*Message, error) {
+	return client.reader.ReadMessage(client.DC, client.readLimitFn)
+}
+
+// 超过读取限制时回复的消息,可能为nil
+func (client *Client) readLimitReply(e *ReadLimitError) *Message {
+	if h, ok := client.plugin.(ReadLimitHandler); ok {
+		if msg := h.HandleReadLimit(client, e.Header, e.Limit); msg != nil {
+			return msg
+		}
+	}
+	if client.limitReply != nil {
+		return client.limitReply(client, e.Header, e.Limit)
+	}
+	return nil
+}
+
+// 消息超过读取限制,回复后断开,body没有被读取,连接不能继续使用
+func (client *Client) rejectOversize(e *ReadLimitError) {
+	log.Warnf("client %s %s", client.Log(), e)
+	client.setCloseReason(CloseReasonMessageTooLarge)
+	if reply := client.readLimitReply(e); reply != nil {
+		client.EnqueuePriorityMessage(reply, PriorityControl, false)
+	}
+	client.Close()
+}
@@ -0,0 +1,86 @@
+package meim
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadLimit(t *testing.T) {
+	reasons := make(chan CloseReason, 1)
+	s := newTestServer(t, WithReadLimit(16), WithReadLimitErrorCmd(98))
+	defer s.Stop()
+	imp := s.plugin.(*ExternalImp)
+	imp.SetReadLimit(5, 1024)
+	imp.SetOnClientClosed(func(client *Client) {
+		reasons <- client.CloseReason()
+	})
+
+	conn, err := net.Dial("tcp", s.Addrs()[0].String())
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	// 按cmd放宽限制
+	large := strings.Repeat("a", 100)
+	assert.NoError(t, WriteMessage(conn, newTestMessage(5, large)))
+	msg, err := ReadMessage(conn, testDC)
+	assert.NoError(t, err)
+	assert.Equal(t, large, string(*msg.Body.(*plainData)))
+
+	// 超过默认限制,只发送头,收到错误回复后断开
+	hdr := &testHeader{cmd: 3, seq: 7, bodyLen: 100}
+	b, _ := hdr.Encode()
+	_, err = conn.Write(b)
+	assert.NoError(t, err)
+	msg, err = ReadMessage(conn, testDC)
+	assert.NoError(t, err)
+	assert.Equal(t, 98, msg.Header.Cmd())
+	assert.Equal(t, 7, msg.Header.Seq())
+	_, err = ReadMessage(conn, testDC)
+	assert.Error(t, err)
+
+	select {
+	case reason := <-reasons:
+		assert.Equal(t, CloseReasonMessageTooLarge, reason)
+	case <-time.After(time.Second):
+		t.Fatal("client not closed")
+	}
+}
+
+func TestReadMessageFunc(t *testing.T) {
+	data, err := AppendMessage(nil, newTestMessage(3, "0123456789"))
+	assert.NoError(t, err)
+
+	_, err = ReadLimitMessage(strings.NewReader(string(data)), testDC, 5)
+	assert.Equal(t, ErrorReadOutofRange, err)
+
+	_, err = ReadMessageFunc(strings.NewReader(string(data)), testDC, func(hdr ProtocolHeader) int { return 5 })
+	if assert.IsType(t, &ReadLimitError{}, err) {
+		e := err.(*ReadLimitError)
+		assert.Equal(t, 3, e.Header.Cmd())
+		assert.Equal(t, 5, e.Limit)
+	}
+
+	msg, err := ReadMessageFunc(strings.NewReader(string(data)), testDC, func(hdr ProtocolHeader) int { return 10 })
+	assert.NoError(t, err)
+	assert.Equal(t, "0123456789", string(*msg.Body.(*plainData)))
+}
+
+func TestAuthReadLimit(t *testing.T) {
+	client := newQueueTestClient(QueueConfig{})
+	client.plugin.(*ExternalImp).SetReadLimit(5, 1024)
+	client.plugin.(*ExternalImp).SetReadLimit(6, 10)
+	client.authReadLimit = 64
+
+	// 认证阶段按指令的限制不能放宽认证阶段的限制
+	assert.Equal(t, 64, client.ReadLimit(5))
+	assert.Equal(t, 10, client.ReadLimit(6))
+	assert.Equal(t, 64, client.ReadLimit(1))
+
+	client.authed.Store(true)
+	assert.Equal(t, 1024, client.ReadLimit(5))
+	assert.Equal(t, DefaultReadLimit, client.ReadLimit(1))
+}
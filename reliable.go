@@ -0,0 +1,280 @@
+package meim
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ipiao/meim/log"
+)
+
+const (
+	DefaultAckTimeout     = time.Second * 5
+	DefaultMaxRetransmits = 3
+	DefaultMaxUnacked     = 1000
+)
+
+// ReliableConfig 可靠推送配置
+// 通过EnqueueReliableMessage发送的消息按客户端分配从1开始递增的序号,写入header的seq
+// 客户端回复AckCmd消息,header的seq为已连续收到的最大序号(累计确认)
+// 收到的ack由服务端处理,不会交给ExternalPlugin.HandleMessage
+type ReliableConfig struct {
+	AckCmd         int           // ack指令
+	AckTimeout     time.Duration // 从写出开始超时未确认则重传
+	MaxRetransmits int           // 重传次数用完仍未确认则断开客户端
+	MaxUnacked     int           // 最多未确认的消息数,超过时EnqueueReliableMessage返回false
+
+	// 没有被确认的消息,在客户端关闭时调用,可以用于离线存储,可选
+	OnUnacked func(client *Client, msgs []*Message)
+}
+
+func (cfg *ReliableConfig) init() {
+	if cfg.AckTimeout <= 0 {
+		cfg.AckTimeout = DefaultAckTimeout
+	}
+	if cfg.MaxRetransmits <= 0 {
+		cfg.MaxRetransmits = DefaultMaxRetransmits
+	}
+	if cfg.MaxUnacked <= 0 {
+		cfg.MaxUnacked = DefaultMaxUnacked
+	}
+}
+
+// 等待确认的消息
+type pendingMessage struct {
+	msg     *Message
+	sent    time.Time // 最后一次写出的时间,入队失败时为入队的时间
+	queued  bool      // 在发送队列中还没有写出,不重传
+	retries int       // 已重传次数
+}
+
+// 客户端的可靠推送状态
+type reliable struct {
+	cfg     *ReliableConfig
+	mu      sync.Mutex
+	seq     int               // 最后分配的序号
+	acked   int               // 已确认的最大序号
+	pending []*pendingMessage // 按序号排列的未确认消息
+	closed  bool
+}
+
+func newReliable(cfg *ReliableConfig) *reliable {
+	return &reliable{cfg: cfg}
+}
+
+// EnqueueReliableMessage 发送需要客户端确认的消息,未开启可靠推送时同EnqueueMessage
+// 消息的header会被复制并设置序号,使用PriorityRealtime非阻塞入队,入队失败的消息等待重传,不交给溢出回调
+// 返回true表示消息最终会被确认或交给OnUnacked,返回false表示客户端已关闭或未确认消息过多,消息由调用方处理
+func (client *Client) EnqueueReliableMessage(msg *Message) bool {
+	if client.rel == nil {
+		return client.EnqueueMessage(msg)
+	}
+	return client.enqueueReliable(msg, 0)
+}
+
+// offline为离线存储中的id,客户端确认后从存储中删除
+func (client *Client) enqueueReliable(msg *Message, offline uint64) bool {
+	r := client.rel
+	r.mu.Lock()
+	if r.closed || len(r.pending) >= r.cfg.MaxUnacked {
+		closed := r.closed
+		r.mu.Unlock()
+		if !closed {
+			log.Warnf("client %s too many unacked messages", client.Log())
+		}
+		return false
+	}
+	r.seq++
+	hdr := msg.Header.Clone()
+	hdr.SetSeq(r.seq)
+	m := &Message{Header: hdr, Body: msg.Body, pending: true, offline: offline}
+	r.pending = append(r.pending, &pendingMessage{msg: m, queued: true})
+	// 持锁入队保证按序号顺序入队,回调在锁外执行
+	res, dropped := client.lanes[PriorityRealtime].push(m, false, client.closeCh)
+	r.mu.Unlock()
+	client.enqueued(m, PriorityRealtime, res, dropped)
+	return true
+}
+
+// Unacked 未确认的消息数,未开启可靠推送时返回0
+func (client *Client) Unacked() int {
+	if client.rel == nil {
+		return 0
+	}
+	client.rel.mu.Lock()
+	defer client.rel.mu.Unlock()
+	return len(client.rel.pending)
+}
+
+// AckedSeq 客户端已确认的最大序号
+func (client *Client) AckedSeq() int {
+	if client.rel == nil {
+		return 0
+	}
+	client.rel.mu.Lock()
+	defer client.rel.mu.Unlock()
+	return client.rel.acked
+}
+
+// 处理收到的ack,返回是否为ack消息
+func (client *Client) handleAck(msg *Message) bool {
+	if msg.Header.Cmd() != client.rel.cfg.AckCmd {
+		return false
+	}
+	client.ack(msg.Header.Seq())
+	return true
+}
+
+// 确认序号不大于seq的消息,其中的离线消息从存储中删除
+func (client *Client) ack(seq int) {
+	r := client.rel
+	r.mu.Lock()
+	if seq <= r.acked {
+		r.mu.Unlock()
+		return
+	}
+	if seq > r.seq {
+		log.Warnf("client %s ack unknown seq %d, last seq %d", client.Log(), seq, r.seq)
+		seq = r.seq
+	}
+	r.acked = seq
+	var offline uint64
+	i := 0
+	for i < len(r.pending) && r.pending[i].msg.Header.Seq() <= seq {
+		if id := r.pending[i].msg.offline; id > offline {
+			offline = id
+		}
+		r.pending[i] = nil
+		i++
+	}
+	r.pending = r.pending[i:]
+	r.mu.Unlock()
+
+	if offline > 0 && client.offline != nil {
+		if err := client.offline.Ack(client.UID, offline); err != nil {
+			log.Warnf("client %s ack offline messages error: %s", client.Log(), err)
+		}
+	}
+}
+
+// 未确认消息中最大的离线消息id,恢复会话后这些离线消息已经在重发
+func (client *Client) offlineCursor() uint64 {
+	r := client.rel
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var cursor uint64
+	for _, pm := range r.pending {
+		if pm.msg.offline > cursor {
+			cursor = pm.msg.offline
+		}
+	}
+	return cursor
+}
+
+// 找到消息的确认状态,序号是连续的,在锁内调用
+func (r *reliable) findLocked(msg *Message) *pendingMessage {
+	if len(r.pending) == 0 {
+		return nil
+	}
+	i := msg.Header.Seq() - r.pending[0].msg.Header.Seq()
+	if i < 0 || i >= len(r.pending) || r.pending[i].msg != msg {
+		return nil
+	}
+	return r.pending[i]
+}
+
+// 标记消息不在发送队列中,从now开始等待超时,written为true时表示已写出
+func (r *reliable) dequeued(msgs []*Message, written bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	for _, msg := range msgs {
+		if pm := r.findLocked(msg); pm != nil && (pm.queued || written) {
+			pm.queued = false
+			pm.sent = now
+		}
+	}
+}
+
+// 重传超时未确认的消息,在写协程中执行
+// 还在发送队列中的消息不重传,入队失败的重传不计入重传次数,等待下一次超时
+// 返回下一次检查的间隔,返回0表示重传次数用完
+func (client *Client) checkRetransmit() time.Duration {
+	type outcome struct {
+		msg     *Message
+		res     enqueueResult
+		dropped []*Message
+	}
+	var outcomes []outcome
+	defer func() {
+		for _, o := range outcomes {
+			client.enqueued(o.msg, PriorityRealtime, o.res, o.dropped)
+		}
+	}()
+
+	r := client.rel
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	next := r.cfg.AckTimeout
+	for _, pm := range r.pending {
+		if pm.queued {
+			continue
+		}
+		wait := r.cfg.AckTimeout - now.Sub(pm.sent)
+		if wait > 0 {
+			if wait < next {
+				next = wait
+			}
+			continue
+		}
+		if pm.retries >= r.cfg.MaxRetransmits {
+			log.Infof("client %s message %d not acked after %d retransmits", client.Log(), pm.msg.Header.Seq(), pm.retries)
+			return 0
+		}
+		pm.queued = true
+		res, dropped := client.lanes[PriorityRealtime].push(pm.msg, false, client.closeCh)
+		if res == enqueueOK {
+			pm.retries++
+		}
+		outcomes = append(outcomes, outcome{pm.msg, res, dropped})
+	}
+	return next
+}
+
+// 客户端关闭后调用,剩余未确认的消息交给OnUnacked
+func (client *Client) closeReliable() {
+	r := client.rel
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.closed = true
+	msgs := make([]*Message, 0, len(r.pending))
+	for _, pm := range r.pending {
+		msgs = append(msgs, pm.msg)
+	}
+	r.pending = nil
+	r.mu.Unlock()
+	if len(msgs) > 0 {
+		client.unacked(msgs)
+	}
+}
+
+// 离线消息仍在存储中,下次认证时重新投递,不交给OnUnacked
+func (client *Client) unacked(msgs []*Message) {
+	res := msgs[:0]
+	for _, msg := range msgs {
+		if msg.offline == 0 {
+			res = append(res, msg)
+		}
+	}
+	msgs = res
+	if len(msgs) == 0 {
+		return
+	}
+	if client.rel.cfg.OnUnacked != nil {
+		client.rel.cfg.OnUnacked(client, msgs)
+	} else {
+		log.Infof("client %s drop %d unacked messages", client.Log(), len(msgs))
+	}
+}
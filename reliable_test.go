@@ -0,0 +1,184 @@
+package meim
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 取出队列中的消息,模拟写出
+func writeQueued(client *Client) []int {
+	var seqs []int
+	var msgs []*Message
+	for msg := client.nextMessage(); msg != nil; msg = client.nextMessage() {
+		seqs = append(seqs, msg.Header.Seq())
+		msgs = append(msgs, msg)
+	}
+	if client.rel != nil {
+		client.rel.dequeued(msgs, true)
+	}
+	return seqs
+}
+
+func TestReliable(t *testing.T) {
+	var unacked []int
+	cfg := &ReliableConfig{
+		AckCmd:     30,
+		AckTimeout: time.Millisecond * 20,
+		MaxUnacked: 3,
+		OnUnacked: func(client *Client, msgs []*Message) {
+			for _, msg := range msgs {
+				unacked = append(unacked, msg.Header.Seq())
+			}
+		},
+	}
+	cfg.init()
+	client := newQueueTestClient(QueueConfig{})
+	client.rel = newReliable(cfg)
+
+	msg := newTestMessage(1, "a")
+	for i := 0; i < 3; i++ {
+		assert.True(t, client.EnqueueReliableMessage(msg))
+	}
+	// 原消息不被修改
+	assert.Equal(t, 0, msg.Header.Seq())
+	assert.Equal(t, []int{1, 2, 3}, writeQueued(client))
+	// 超过未确认消息上限
+	assert.False(t, client.EnqueueReliableMessage(msg))
+	assert.Empty(t, unacked)
+
+	ack := newTestMessage(30, "")
+	ack.Header.SetSeq(2)
+	assert.True(t, client.handleAck(ack))
+	assert.False(t, client.handleAck(msg))
+	assert.Equal(t, 1, client.Unacked())
+	assert.Equal(t, 2, client.AckedSeq())
+
+	// 超时重传,重传次数用完后返回0
+	time.Sleep(cfg.AckTimeout)
+	for i := 0; i < cfg.MaxRetransmits; i++ {
+		assert.NotZero(t, client.checkRetransmit())
+		assert.Equal(t, []int{3}, writeQueued(client))
+		time.Sleep(cfg.AckTimeout)
+	}
+	assert.Zero(t, client.checkRetransmit())
+
+	unacked = nil
+	client.closeReliable()
+	assert.Equal(t, []int{3}, unacked)
+	assert.False(t, client.EnqueueReliableMessage(msg))
+}
+
+func TestReliableNotWritten(t *testing.T) {
+	cfg := &ReliableConfig{AckCmd: 30, AckTimeout: time.Millisecond * 20}
+	cfg.init()
+	client := newQueueTestClient(QueueConfig{})
+	client.rel = newReliable(cfg)
+
+	// 还在队列中没有写出的消息不重传
+	assert.True(t, client.EnqueueReliableMessage(newTestMessage(1, "a")))
+	time.Sleep(cfg.AckTimeout)
+	assert.NotZero(t, client.checkRetransmit())
+	assert.Equal(t, []int{1}, writeQueued(client))
+	assert.NotZero(t, client.checkRetransmit())
+	assert.Empty(t, writeQueued(client))
+
+	time.Sleep(cfg.AckTimeout)
+	assert.NotZero(t, client.checkRetransmit())
+	assert.Equal(t, []int{1}, writeQueued(client))
+}
+
+func TestReliableOverflow(t *testing.T) {
+	var spilled, overflowed int
+	cfg := &ReliableConfig{AckCmd: 30, AckTimeout: time.Millisecond * 20}
+	cfg.init()
+	client := newQueueTestClient(QueueConfig{
+		Policy:      OverflowSpill,
+		MaxMessages: 1,
+		Spill: func(*Client, *Message) error {
+			spilled++
+			return nil
+		},
+		OnOverflow: func(*Client, []*Message, OverflowPolicy) {
+			overflowed++
+		},
+	})
+	client.rel = newReliable(cfg)
+
+	// 队列满时消息留在未确认列表中等待重传,不交给溢出回调
+	assert.True(t, client.EnqueueReliableMessage(newTestMessage(1, "a")))
+	assert.True(t, client.EnqueueReliableMessage(newTestMessage(1, "b")))
+	assert.Equal(t, 2, client.Unacked())
+	assert.Equal(t, []int{1}, writeQueued(client))
+
+	// 重传时队列已满,不计入重传次数
+	assert.True(t, client.EnqueueMessage(newTestMessage(2, "c")))
+	time.Sleep(cfg.AckTimeout)
+	assert.NotZero(t, client.checkRetransmit())
+	assert.Zero(t, spilled)
+	assert.Zero(t, overflowed)
+	for _, pm := range client.rel.pending {
+		assert.Zero(t, pm.retries)
+	}
+	assert.Equal(t, []int{0}, writeQueued(client))
+
+	time.Sleep(cfg.AckTimeout)
+	assert.NotZero(t, client.checkRetransmit())
+	assert.Equal(t, []int{1}, writeQueued(client))
+	assert.Equal(t, 1, client.rel.pending[0].retries)
+}
+
+func TestReliableServer(t *testing.T) {
+	unacked := make(chan []*Message, 1)
+	reasons := make(chan CloseReason, 1)
+	s := newTestServer(t, WithReliable(&ReliableConfig{
+		AckCmd:         30,
+		AckTimeout:     time.Millisecond * 50,
+		MaxRetransmits: 1,
+		OnUnacked: func(client *Client, msgs []*Message) {
+			unacked <- msgs
+		},
+	}))
+	defer s.Stop()
+	imp := s.plugin.(*ExternalImp)
+	imp.SetDefaultHandler(func(client *Client, msg *Message) {
+		client.EnqueueReliableMessage(msg)
+	})
+	imp.SetOnClientClosed(func(client *Client) {
+		reasons <- client.CloseReason()
+	})
+
+	conn, err := net.Dial("tcp", s.Addrs()[0].String())
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	assert.NoError(t, WriteMessage(conn, newTestMessage(1, "first")))
+	msg, err := ReadMessage(conn, testDC)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, msg.Header.Seq())
+	ack := newTestMessage(30, "")
+	ack.Header.SetSeq(1)
+	assert.NoError(t, WriteMessage(conn, ack))
+
+	// 不确认,重传后断开
+	assert.NoError(t, WriteMessage(conn, newTestMessage(1, "second")))
+	for i := 0; i < 2; i++ {
+		msg, err = ReadMessage(conn, testDC)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, msg.Header.Seq())
+		assert.Equal(t, "second", string(*msg.Body.(*plainData)))
+	}
+
+	select {
+	case reason := <-reasons:
+		assert.Equal(t, CloseReasonAckTimeout, reason)
+	case <-time.After(time.Second):
+		t.Fatal("client not closed")
+	}
+	msgs := <-unacked
+	if assert.Len(t, msgs, 1) {
+		assert.Equal(t, 2, msgs[0].Header.Seq())
+	}
+}
@@ -0,0 +1,131 @@
+//go:build !windows
+// +build !windows
+
+package meim
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/ipiao/meim/log"
+)
+
+// Restart 启动新的进程并传递可继承的监听
+// 调用方需要在之后关闭当前服务,已有连接由当前进程处理完
+func (s *Server) Restart() (*os.Process, error) {
+	files, env := s.inheritFiles()
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	path, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(restartEnv(), env...)
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	log.Infof("server %s restarted, new pid: %d, %d listeners inherited", s.listenerNames(), cmd.Process.Pid, len(files))
+	return cmd.Process, nil
+}
+
+// 复制可以传递的监听fd,返回传给子进程的文件和LISTEN_*环境变量
+func (s *Server) inheritFiles() ([]*os.File, []string) {
+	s.mu.RLock()
+	lns := s.lns
+	s.mu.RUnlock()
+
+	var (
+		files []*os.File
+		names []string
+	)
+	for _, ln := range lns {
+		il, ok := ln.(InheritableListener)
+		if !ok {
+			log.Warnf("listener %s can not be inherited, skipped", ln.Addr())
+			continue
+		}
+		f, err := il.File()
+		if err != nil {
+			log.Warnf("listener %s can not be inherited: %s", il.InheritName(), err)
+			continue
+		}
+		files = append(files, f)
+		names = append(names, url.QueryEscape(il.InheritName()))
+	}
+	return files, []string{
+		envListenFDs + "=" + strconv.Itoa(len(files)),
+		envListenFDNames + "=" + strings.Join(names, ":"),
+	}
+}
+
+// 去掉当前进程的LISTEN_*环境变量
+func restartEnv() []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		if strings.HasPrefix(kv, envListenFDs+"=") ||
+			strings.HasPrefix(kv, envListenFDNames+"=") ||
+			strings.HasPrefix(kv, envListenPID+"=") {
+			continue
+		}
+		env = append(env, kv)
+	}
+	return env
+}
+
+// RunGraceful 启动服务,并处理信号
+// SIGTERM/SIGINT: 优雅关闭服务
+// SIGUSR2: 启动新进程接管监听,当前进程停止accept并处理完已有连接后退出
+// 返回前等待所有客户端处理完成,最多再等待drainTimeout
+func (s *Server) RunGraceful() error {
+	// 整个过程中保持注册,Restart期间收到的信号不会丢失
+	sigCh := make(chan os.Signal, 4)
+	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT, syscall.SIGUSR2)
+	defer signal.Stop(sigCh)
+
+	if err := s.Start(); err != nil {
+		return err
+	}
+	log.Infof("listen at %s, pid: %d", s.listenerNames(), os.Getpid())
+	for sig := range sigCh {
+		log.Infof("listener %s recv signal: %s", s.listenerNames(), sig)
+		if sig == syscall.SIGUSR2 {
+			if _, err := s.Restart(); err != nil {
+				log.Errorf("server %s restart error: %s", s.listenerNames(), err)
+				continue
+			}
+		}
+		break
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.drainTimeout)
+	defer cancel()
+	summary, err := s.Shutdown(ctx)
+	log.Infof("server %s exit, clients: %d, drained: %d, failed: %d, forced: %d",
+		s.listenerNames(), summary.Total, summary.Drained, summary.Failed, summary.Forced)
+
+	// 强制关闭的客户端可能还在处理,等待其完成
+	wctx, wcancel := context.WithTimeout(context.Background(), s.drainTimeout)
+	defer wcancel()
+	if werr := s.waitClients(wctx); werr != nil {
+		log.Warnf("server %s wait clients: %s", s.listenerNames(), werr)
+		if err == nil {
+			err = werr
+		}
+	}
+	return err
+}
@@ -0,0 +1,89 @@
+//go:build !windows
+// +build !windows
+
+package meim
+
+import (
+	"context"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 在同一进程中模拟子进程接管监听
+func TestRestartHandoff(t *testing.T) {
+	lncfg := &ListenerConfig{Network: "tcp", Address: "127.0.0.1:0"}
+	parent := NewServerWithConfig(lncfg, WithExternalPlugin(newEchoPlugin()))
+	assert.NoError(t, parent.Start())
+	addr := parent.Addrs()[0].String()
+
+	files, env := parent.inheritFiles()
+	assert.Len(t, files, 1)
+	getenv := func(k string) string {
+		for _, kv := range env {
+			if strings.HasPrefix(kv, k+"=") {
+				return strings.TrimPrefix(kv, k+"=")
+			}
+		}
+		return ""
+	}
+	n, names := parseListenEnv(getenv, os.Getpid())
+	assert.Equal(t, 1, n)
+	lns := inheritListeners(files, names)
+	assert.Len(t, lns, 1)
+
+	inheritedOnce.Do(loadInherited)
+	inheritedMu.Lock()
+	for name, ln := range lns {
+		inherited[name] = ln
+	}
+	inheritedMu.Unlock()
+
+	// 子进程使用相同的配置,监听同一个地址
+	child := NewServerWithConfig(&ListenerConfig{Network: "tcp", Address: "127.0.0.1:0"}, WithExternalPlugin(newEchoPlugin()))
+	assert.NoError(t, child.Start())
+	defer child.Stop()
+	assert.Equal(t, addr, child.Addrs()[0].String())
+	parent.Stop()
+
+	conn, err := net.Dial("tcp", addr)
+	assert.NoError(t, err)
+	defer conn.Close()
+	assert.NoError(t, WriteMessage(conn, newTestMessage(1, "hello")))
+	msg, err := ReadMessage(conn, testDC)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(*msg.Body.(*plainData)))
+}
+
+func TestRunGraceful(t *testing.T) {
+	s := NewServerWithConfig(&ListenerConfig{Network: "tcp", Address: "127.0.0.1:0"},
+		WithExternalPlugin(newEchoPlugin()), WithDrainTimeout(time.Millisecond*200))
+	res := make(chan error, 1)
+	go func() { res <- s.RunGraceful() }()
+	assert.Eventually(t, func() bool { return len(s.Addrs()) == 1 }, time.Second, time.Millisecond*10)
+
+	conn, client := dialEcho(t, s)
+	defer conn.Close()
+	// 写协程被阻塞,强制关闭后客户端仍在处理
+	release := make(chan struct{})
+	assert.True(t, client.EnqueueEvent(func(*Client) { <-release }))
+	assert.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGTERM))
+
+	select {
+	case <-res:
+		t.Fatal("returned before clients done")
+	case <-time.After(time.Millisecond * 250):
+	}
+	close(release)
+	select {
+	case err := <-res:
+		assert.Equal(t, context.DeadlineExceeded, err)
+	case <-time.After(time.Second):
+		t.Fatal("not returned")
+	}
+}
@@ -0,0 +1,240 @@
+package meim
+
+// 单机的房间/群组成员管理,跨节点分发见Exchanger.SetRooms
+
+import (
+	"sync"
+
+	"github.com/ipiao/meim/util"
+)
+
+type room struct {
+	clients ClientSet   // 直接加入的客户端
+	uids    util.IntSet // 按用户加入,通过Router查找用户的客户端
+	sendMu  sync.Mutex  // 保证房间内的消息按相同顺序入队到所有成员
+}
+
+// Rooms 房间管理,成员可以是客户端或用户
+// 客户端关闭后自动退出所有房间,用户成员需要调用LeaveUser退出
+type Rooms struct {
+	mu       sync.RWMutex
+	router   *Router                 // 查找用户的客户端,为nil时不能按用户加入
+	rooms    map[int64]*room         //
+	joined   map[*Client]util.IntSet // 客户端直接加入的房间,用于关闭时清理
+	onActive func(roomID int64)      // 房间有了第一个成员
+	onIdle   func(roomID int64)      // 房间没有成员,被删除
+	events   []roomEvent             // 等待调用回调的房间创建和删除
+	hookMu   sync.Mutex              // 保证回调按发生顺序串行调用
+}
+
+type roomEvent struct {
+	roomID int64
+	active bool
+}
+
+func NewRooms(router *Router) *Rooms {
+	return &Rooms{
+		router: router,
+		rooms:  make(map[int64]*room),
+		joined: make(map[*Client]util.IntSet),
+	}
+}
+
+// SetHooks 设置房间创建和删除时的回调,在锁外按发生顺序串行调用,
+// 可以阻塞(如订阅Broker),但会阻塞触发回调的Join和Leave等调用,不能再修改Rooms
+func (rs *Rooms) SetHooks(onActive, onIdle func(roomID int64)) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.onActive = onActive
+	rs.onIdle = onIdle
+}
+
+func (rs *Rooms) roomLocked(roomID int64) *room {
+	r, ok := rs.rooms[roomID]
+	if !ok {
+		r = &room{clients: NewClientSet(), uids: util.NewIntSet()}
+		rs.rooms[roomID] = r
+		if rs.onActive != nil {
+			rs.events = append(rs.events, roomEvent{roomID, true})
+		}
+	}
+	return r
+}
+
+// 房间没有成员时删除
+func (rs *Rooms) checkIdleLocked(roomID int64, r *room) {
+	if len(r.clients) == 0 && len(r.uids) == 0 {
+		delete(rs.rooms, roomID)
+		if rs.onIdle != nil {
+			rs.events = append(rs.events, roomEvent{roomID, false})
+		}
+	}
+}
+
+// 在锁外调用回调,其他调用正在处理时由其按顺序处理
+func (rs *Rooms) runHooks() {
+	rs.hookMu.Lock()
+	defer rs.hookMu.Unlock()
+	for {
+		rs.mu.Lock()
+		events := rs.events
+		rs.events = nil
+		onActive, onIdle := rs.onActive, rs.onIdle
+		rs.mu.Unlock()
+		if len(events) == 0 {
+			return
+		}
+		for _, ev := range events {
+			if ev.active && onActive != nil {
+				onActive(ev.roomID)
+			} else if !ev.active && onIdle != nil {
+				onIdle(ev.roomID)
+			}
+		}
+	}
+}
+
+// Join 客户端加入房间,已经加入时返回false
+func (rs *Rooms) Join(roomID int64, client *Client) bool {
+	defer rs.runHooks()
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	r := rs.roomLocked(roomID)
+	if r.clients.IsMember(client) {
+		return false
+	}
+	r.clients.Add(client)
+	ids, ok := rs.joined[client]
+	if !ok {
+		ids = util.NewIntSet()
+		rs.joined[client] = ids
+		go rs.watch(client)
+	}
+	ids.Add(roomID)
+	return true
+}
+
+// 客户端关闭后退出所有房间
+func (rs *Rooms) watch(client *Client) {
+	<-client.Done()
+	rs.LeaveAll(client)
+}
+
+// Leave 客户端退出房间,不在房间中时返回false
+func (rs *Rooms) Leave(roomID int64, client *Client) bool {
+	defer rs.runHooks()
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	r, ok := rs.rooms[roomID]
+	if !ok || !r.clients.IsMember(client) {
+		return false
+	}
+	r.clients.Remove(client)
+	rs.joined[client].Remove(roomID)
+	rs.checkIdleLocked(roomID, r)
+	return true
+}
+
+// LeaveAll 客户端退出所有直接加入的房间
+func (rs *Rooms) LeaveAll(client *Client) {
+	defer rs.runHooks()
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	for roomID := range rs.joined[client] {
+		if r, ok := rs.rooms[roomID]; ok {
+			r.clients.Remove(client)
+			rs.checkIdleLocked(roomID, r)
+		}
+	}
+	delete(rs.joined, client)
+}
+
+// JoinUser 用户加入房间,用户在本节点的所有客户端都会收到房间消息,已经加入时返回false
+func (rs *Rooms) JoinUser(roomID int64, uid int64) bool {
+	defer rs.runHooks()
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	r := rs.roomLocked(roomID)
+	if r.uids.IsMember(uid) {
+		return false
+	}
+	r.uids.Add(uid)
+	return true
+}
+
+// LeaveUser 用户退出房间,不在房间中时返回false
+func (rs *Rooms) LeaveUser(roomID int64, uid int64) bool {
+	defer rs.runHooks()
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	r, ok := rs.rooms[roomID]
+	if !ok || !r.uids.IsMember(uid) {
+		return false
+	}
+	r.uids.Remove(uid)
+	rs.checkIdleLocked(roomID, r)
+	return true
+}
+
+// Members 房间在本节点的所有客户端
+func (rs *Rooms) Members(roomID int64) ClientSet {
+	rs.mu.RLock()
+	r, ok := rs.rooms[roomID]
+	if !ok {
+		rs.mu.RUnlock()
+		return NewClientSet()
+	}
+	set := r.clients.Clone()
+	uids := r.uids.Clone()
+	rs.mu.RUnlock()
+
+	if rs.router != nil {
+		for uid := range uids {
+			for c := range rs.router.FindClientSet(uid) {
+				set.Add(c)
+			}
+		}
+	}
+	return set
+}
+
+// Count 房间在本节点的客户端数
+func (rs *Rooms) Count(roomID int64) int {
+	return rs.Members(roomID).Count()
+}
+
+// UserCount 房间中按用户加入的用户数
+func (rs *Rooms) UserCount(roomID int64) int {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+	if r, ok := rs.rooms[roomID]; ok {
+		return len(r.uids)
+	}
+	return 0
+}
+
+// RoomCount 本节点有成员的房间数
+func (rs *Rooms) RoomCount() int {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+	return len(rs.rooms)
+}
+
+// Broadcast 发送消息给房间在本节点的所有客户端,exclude不为nil时排除发送者
+// 每种DataCreator只编码一次,同一房间的消息在所有成员的发送队列中顺序一致
+// 返回入队成功的客户端数
+func (rs *Rooms) Broadcast(roomID int64, msg *Message, exclude *Client) int {
+	rs.mu.RLock()
+	r, ok := rs.rooms[roomID]
+	rs.mu.RUnlock()
+	if !ok {
+		return 0
+	}
+	r.sendMu.Lock()
+	defer r.sendMu.Unlock()
+	members := rs.Members(roomID)
+	if exclude != nil {
+		members.Remove(exclude)
+	}
+	return newMessageEncodeCache(msg).send(members, PriorityRealtime)
+}
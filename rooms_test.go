@@ -0,0 +1,238 @@
+package meim
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 记录订阅和发送的Broker
+type recordBroker struct {
+	mu     sync.Mutex
+	subs   []int64
+	topics []string // 订阅的主题为+topic,取消为-topic
+	sent   []*InternalMessage
+}
+
+func (b *recordBroker) Connect()                                  {}
+func (b *recordBroker) Close()                                    {}
+func (b *recordBroker) ReceiveMessage() (*InternalMessage, error) { return nil, nil }
+func (b *recordBroker) SyncMessage(msg *InternalMessage) (*InternalMessage, error) {
+	return nil, nil
+}
+
+func (b *recordBroker) Subscribe(uid int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subs = append(b.subs, uid)
+}
+
+func (b *recordBroker) UnSubscribe(uid int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subs = append(b.subs, -uid)
+}
+
+func (b *recordBroker) SubscribeTopic(topic string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.topics = append(b.topics, "+"+topic)
+}
+
+func (b *recordBroker) UnSubscribeTopic(topic string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.topics = append(b.topics, "-"+topic)
+}
+
+func (b *recordBroker) SendMessage(msg *InternalMessage) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.sent = append(b.sent, msg)
+	return nil
+}
+
+func queuedBodies(client *Client) []string {
+	var bodies []string
+	for msg := client.nextMessage(); msg != nil; msg = client.nextMessage() {
+		data, _ := AppendMessage(nil, msg)
+		m, _ := DecodeMessage(data, testDC)
+		bodies = append(bodies, string(*m.Body.(*plainData)))
+	}
+	return bodies
+}
+
+func TestRooms(t *testing.T) {
+	route := NewRouter()
+	rooms := NewRooms(route)
+	var active, idle []int64
+	rooms.SetHooks(func(id int64) { active = append(active, id) }, func(id int64) { idle = append(idle, id) })
+
+	c1 := newRouterTestClient(1, "ios")
+	c2 := newRouterTestClient(2, "ios")
+	c3 := newRouterTestClient(3, "ios")
+	u3 := newRouterTestClient(3, "web")
+	route.AddClient(c3)
+	route.AddClient(u3)
+
+	assert.True(t, rooms.Join(10, c1))
+	assert.False(t, rooms.Join(10, c1))
+	assert.True(t, rooms.Join(10, c2))
+	assert.True(t, rooms.JoinUser(10, 3))
+	assert.True(t, rooms.Join(11, c1))
+	assert.Equal(t, 4, rooms.Count(10))
+	assert.Equal(t, 1, rooms.UserCount(10))
+	assert.Equal(t, 2, rooms.RoomCount())
+
+	// 排除发送者
+	assert.Equal(t, 3, rooms.Broadcast(10, newTestMessage(1, "hi"), c1))
+	assert.Empty(t, queuedBodies(c1))
+	for _, c := range []*Client{c2, c3, u3} {
+		assert.Equal(t, []string{"hi"}, queuedBodies(c))
+	}
+	assert.Equal(t, 0, rooms.Broadcast(12, newTestMessage(1, "hi"), nil))
+
+	assert.True(t, rooms.Leave(10, c2))
+	assert.False(t, rooms.Leave(10, c2))
+	assert.True(t, rooms.LeaveUser(10, 3))
+	assert.Equal(t, 1, rooms.Count(10))
+
+	// 关闭后自动退出所有房间
+	close(c1.done)
+	assert.Eventually(t, func() bool {
+		return rooms.RoomCount() == 0
+	}, time.Second, time.Millisecond*10)
+	assert.Equal(t, []int64{10, 11}, active)
+	assert.ElementsMatch(t, []int64{10, 11}, idle)
+}
+
+// 并发广播时所有成员收到的顺序一致
+func TestRoomsOrdering(t *testing.T) {
+	rooms := NewRooms(nil)
+	var members []*Client
+	for i := 0; i < 5; i++ {
+		c := newQueueTestClient(QueueConfig{MaxMessages: 1000})
+		rooms.Join(1, c)
+		members = append(members, c)
+	}
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				rooms.Broadcast(1, newTestMessage(1, fmt.Sprintf("%d-%d", g, i)), nil)
+			}
+		}(g)
+	}
+	wg.Wait()
+	first := queuedBodies(members[0])
+	assert.Len(t, first, 200)
+	for _, c := range members[1:] {
+		assert.Equal(t, first, queuedBodies(c))
+	}
+}
+
+func TestExchangerRooms(t *testing.T) {
+	broker := new(recordBroker)
+	rooms := NewRooms(nil)
+	exc := NewMessageExchanger(broker, nil, nil, NewRouter())
+	exc.SetNode(7)
+	exc.SetRooms(rooms)
+
+	sender := newRouterTestClient(1, "ios")
+	member := newRouterTestClient(2, "ios")
+	rooms.Join(5, sender)
+	rooms.Join(5, member)
+	assert.Equal(t, []string{"+room:5"}, broker.topics)
+
+	closed := make(chan bool)
+	defer close(closed)
+	go exc.handleWrite(closed)
+	assert.Equal(t, 1, exc.PublishRoomMessage(5, newTestMessage(1, "local"), sender))
+	assert.Equal(t, []string{"local"}, queuedBodies(member))
+	var sent *InternalMessage
+	assert.Eventually(t, func() bool {
+		broker.mu.Lock()
+		defer broker.mu.Unlock()
+		if len(broker.sent) == 1 {
+			sent = broker.sent[0]
+		}
+		return sent != nil
+	}, time.Second, time.Millisecond*10)
+	assert.Equal(t, "room:5", sent.Topic)
+	assert.Equal(t, int64(7), sent.Node)
+	assert.Equal(t, int64(1), sent.Sender)
+	assert.Zero(t, sent.Receiver)
+
+	// 编码后保留主题和节点
+	data, err := EncodeInternalMessage(sent)
+	assert.NoError(t, err)
+	im, err := DecodeInternalMessgae(data, testDC)
+	assert.NoError(t, err)
+	assert.Equal(t, "room:5", im.Topic)
+	assert.Equal(t, int64(7), im.Node)
+	assert.Equal(t, "local", string(*im.Body.(*plainData)))
+
+	// Broker发回本节点的消息被丢弃
+	assert.True(t, exc.DispatchMessage(im))
+	assert.Empty(t, queuedBodies(member))
+
+	// 其他节点的房间消息
+	assert.True(t, exc.DispatchMessage(&InternalMessage{Message: newTestMessage(1, "remote"), Node: 8, Topic: RoomTopic(5)}))
+	assert.Equal(t, []string{"remote"}, queuedBodies(member))
+	assert.Equal(t, []string{"remote"}, queuedBodies(sender))
+
+	rooms.Leave(5, sender)
+	rooms.Leave(5, member)
+	assert.Equal(t, []string{"+room:5", "-room:5"}, broker.topics)
+	assert.Empty(t, broker.subs)
+}
+
+// 回调在锁外调用,可以阻塞和读取Rooms
+func TestRoomsHooksOutsideLock(t *testing.T) {
+	rooms := NewRooms(nil)
+	var counts []int
+	block := make(chan struct{})
+	rooms.SetHooks(func(id int64) {
+		<-block
+		counts = append(counts, rooms.RoomCount())
+	}, nil)
+
+	c := newRouterTestClient(1, "ios")
+	joined := make(chan struct{})
+	go func() {
+		rooms.Join(1, c)
+		close(joined)
+	}()
+	assert.Eventually(t, func() bool { return rooms.Count(1) == 1 }, time.Second, time.Millisecond*10)
+	close(block)
+	<-joined
+	assert.Equal(t, []int{1}, counts)
+}
+
+// 没有设置节点id时也能丢弃发回本节点的消息
+func TestExchangerDefaultNode(t *testing.T) {
+	broker := new(recordBroker)
+	rooms := NewRooms(nil)
+	exc := NewMessageExchanger(broker, nil, nil, NewRouter())
+	assert.NotZero(t, exc.node)
+	exc.SetRooms(rooms)
+	member := newRouterTestClient(2, "ios")
+	rooms.Join(5, member)
+
+	closed := make(chan bool)
+	defer close(closed)
+	go exc.handleWrite(closed)
+	exc.PublishRoomMessage(5, newTestMessage(1, "local"), nil)
+	assert.Eventually(t, func() bool {
+		broker.mu.Lock()
+		defer broker.mu.Unlock()
+		return len(broker.sent) == 1
+	}, time.Second, time.Millisecond*10)
+	assert.True(t, exc.DispatchMessage(broker.sent[0]))
+	assert.Equal(t, []string{"local"}, queuedBodies(member))
+}
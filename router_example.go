@@ -3,6 +3,7 @@ package meim
 // 单机,本地的用户路由
 
 import (
+	"fmt"
 	"sync"
 
 	"github.com/ipiao/meim/log"
@@ -13,6 +14,64 @@ import (
 type Router struct {
 	mu      sync.RWMutex        //
 	clients map[int64]ClientSet // 这个必须有userId,和server.clients的生存周期有所不同
+	login   LoginConfig         // 多端登录策略
+}
+
+// LoginPolicy 多端登录策略
+type LoginPolicy int
+
+const (
+	LoginAllowMulti     LoginPolicy = iota // 不限制
+	LoginOnePerPlatform                    // 同一平台只允许一个客户端
+	LoginSingle                            // 所有平台只允许一个客户端
+)
+
+func (p LoginPolicy) String() string {
+	switch p {
+	case LoginAllowMulti:
+		return "allow-multi"
+	case LoginOnePerPlatform:
+		return "one-per-platform"
+	case LoginSingle:
+		return "single"
+	}
+	return fmt.Sprintf("login-policy-%d", int(p))
+}
+
+// LoginConfig 多端登录配置,按新登录客户端的平台选择策略,冲突的旧客户端被踢下线
+type LoginConfig struct {
+	Default   LoginPolicy            // 默认策略
+	Platforms map[string]LoginPolicy // 按平台的策略
+	KickCmd   int                    // 踢下线前发给旧客户端的消息指令,0时使用WithKickNotice
+	// 踢下线前发给旧客户端的消息,优先于KickCmd,可选
+	KickMessage func(old, new *Client) *Message
+}
+
+func (cfg *LoginConfig) policy(platform string) LoginPolicy {
+	if p, ok := cfg.Platforms[platform]; ok {
+		return p
+	}
+	return cfg.Default
+}
+
+func (cfg *LoginConfig) conflict(old, new *Client) bool {
+	switch cfg.policy(new.Platform) {
+	case LoginOnePerPlatform:
+		return old.Platform == new.Platform
+	case LoginSingle:
+		return true
+	}
+	return false
+}
+
+func (cfg *LoginConfig) kickMessage(old, new *Client) *Message {
+	if cfg.KickMessage != nil {
+		return cfg.KickMessage(old, new)
+	}
+	if cfg.KickCmd != 0 && old.DC != nil {
+		return NewCmdMessage(old.DC, cfg.KickCmd)
+	}
+	return old.kickMessage(CloseReasonKicked)
 }
 
 func NewRouter() *Router {
@@ -21,21 +80,45 @@ func NewRouter() *Router {
 	return route
 }
 
+// SetLoginConfig 设置多端登录策略,只影响之后加入的客户端
+func (route *Router) SetLoginConfig(cfg LoginConfig) {
+	route.mu.Lock()
+	defer route.mu.Unlock()
+	route.login = cfg
+}
+
 // uid 已经设置的情况下才可调用
 // 不允许uid为0
-func (route *Router) AddClient(client *Client) {
+// 按多端登录策略踢掉冲突的旧客户端,返回被踢的客户端,不等待通知写出,不会阻塞新客户端的认证
+func (route *Router) AddClient(client *Client) []*Client {
 	if client.UID == 0 {
 		log.Warnf("router add invalid client %s", client.Log())
-		return
+		return nil
 	}
 	route.mu.Lock()
-	defer route.mu.Unlock()
 	set, ok := route.clients[client.UID]
 	if !ok {
 		set = NewClientSet()
 		route.clients[client.UID] = set
 	}
+	var kicked []*Client
+	for c := range set {
+		if c != client && route.login.conflict(c, client) {
+			set.Remove(c)
+			kicked = append(kicked, c)
+		}
+	}
 	set.Add(client)
+	login := route.login
+	route.mu.Unlock()
+
+	for _, c := range kicked {
+		log.Infof("client %s kicked by %s, platform %s, policy %s", c.Log(), client.Log(), client.Platform, login.policy(client.Platform))
+	}
+	kickClients(kicked, CloseReasonKicked, func(c *Client) *Message {
+		return login.kickMessage(c, client)
+	}, false)
+	return kicked
 }
 
 func (route *Router) RemoveClient(client *Client) bool {
@@ -80,6 +163,19 @@ func (route *Router) FindClient(uid int64) *Client {
 	return nil
 }
 
+// FindPlatformClient 查找一个指定平台的在线client
+func (route *Router) FindPlatformClient(uid int64, platform string) *Client {
+	route.mu.RLock()
+	defer route.mu.RUnlock()
+
+	for c := range route.clients[uid] {
+		if c.Platform == platform && !c.closed.Load() {
+			return c
+		}
+	}
+	return nil
+}
+
 func (route *Router) IsOnline(uid int64) bool {
 	route.mu.RLock()
 	defer route.mu.RUnlock()
@@ -0,0 +1,75 @@
+package meim
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newRouterTestClient(uid int64, platform string) *Client {
+	client := newQueueTestClient(QueueConfig{})
+	client.UID = uid
+	client.Platform = platform
+	// 没有写协程,踢下线时不等待通知写出,通知留在队列中
+	close(client.writeDone)
+	return client
+}
+
+func TestRouterLoginPolicy(t *testing.T) {
+	route := NewRouter()
+	route.SetLoginConfig(LoginConfig{
+		Default:   LoginOnePerPlatform,
+		Platforms: map[string]LoginPolicy{"web": LoginAllowMulti, "tv": LoginSingle},
+		KickCmd:   40,
+	})
+
+	ios := newRouterTestClient(1, "ios")
+	web1 := newRouterTestClient(1, "web")
+	web2 := newRouterTestClient(1, "web")
+	for _, c := range []*Client{ios, web1, web2} {
+		assert.Empty(t, route.AddClient(c))
+	}
+	assert.Equal(t, 3, route.FindClientSet(1).Count())
+
+	// 同平台踢掉旧客户端
+	ios2 := newRouterTestClient(1, "ios")
+	assert.Equal(t, []*Client{ios}, route.AddClient(ios2))
+	assert.Equal(t, CloseReasonKicked, ios.CloseReason())
+	assert.Equal(t, []int{40}, queuedCmds(ios))
+	assert.True(t, ios2 == route.FindPlatformClient(1, "ios"))
+	assert.Nil(t, route.FindPlatformClient(1, "android"))
+	// 被踢的客户端关闭后移除不影响新客户端
+	route.RemoveClient(ios)
+	assert.True(t, route.FindClientSet(1).IsMember(ios2))
+
+	// 其他用户不受影响
+	other := newRouterTestClient(2, "tv")
+	assert.Empty(t, route.AddClient(other))
+
+	// 所有平台只允许一个
+	tv := newRouterTestClient(1, "tv")
+	assert.Len(t, route.AddClient(tv), 3)
+	assert.Equal(t, 1, route.FindClientSet(1).Count())
+	assert.Equal(t, CloseReasonKicked, web1.CloseReason())
+	assert.Equal(t, CloseReasonNone, other.CloseReason())
+	assert.Equal(t, CloseReasonNone, tv.CloseReason())
+}
+
+func TestRouterKickAsync(t *testing.T) {
+	route := NewRouter()
+	route.SetLoginConfig(LoginConfig{Default: LoginOnePerPlatform})
+	server, peer := net.Pipe()
+	defer peer.Close()
+	// 写协程没有运行,通知不会写出
+	old := NewClient(server)
+	old.UID = 1
+	old.Platform = "ios"
+	route.AddClient(old)
+
+	start := time.Now()
+	assert.Equal(t, []*Client{old}, route.AddClient(newRouterTestClient(1, "ios")))
+	assert.Less(t, int64(time.Since(start)), int64(DefaultKickWait/2))
+	assert.Equal(t, CloseReasonKicked, old.CloseReason())
+}
@@ -1,40 +1,85 @@
 package meim
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net"
 	"os"
-	"os/signal"
 	"sync"
 	"syscall"
 	"time"
 
 	"github.com/ipiao/meim/log"
+	"go.uber.org/atomic"
 )
 
 const (
 	DefaultReadTimeout  = time.Minute * 15
 	DefaultWriteTimeout = time.Second * 10
 	DefaultMaxConn      = 65536
+	DefaultDrainTimeout = time.Second * 30
+	DefaultAuthTimeout  = time.Second * 30
+)
+
+var (
+	ErrServerClosed     = errors.New("server closed")
+	ErrPluginNotSet     = errors.New("external plugin not set")
+	ErrNoAuthMsgHandler = errors.New("auth messages need plugin implementing AuthMessageHandler")
+	ErrNeedReliable     = errors.New("session resumption needs reliable push")
+	ErrOfflineReliable  = errors.New("offline store needs reliable push")
 )
 
 // Server 提供一个连接服务
 type Server struct {
-	lncfg        *ListenerConfig // 配置
-	ln           net.Listener    // 单一服务监听
-	readTimeout  time.Duration   // 读超时
-	writeTimeout time.Duration   // 写超时
-	maxConn      int             // 限制最大连接数
+	lncfgs        []*ListenerConfig  // 监听配置,第一个为主配置
+	lns           []net.Listener     // 服务监听,与lncfgs一一对应
+	readTimeout   time.Duration      // 读超时
+	writeTimeout  time.Duration      // 写超时
+	maxConn       int                // 限制最大连接数,所有监听共享
+	drainTimeout  time.Duration      // 重启/关闭时等待客户端清空队列的时间
+	limitCfg      ConnLimitConfig    // 连接限制配置
+	authTimeout   time.Duration      // 认证阶段超时
+	authMsgCount  int                // 认证阶段最多读取的消息数,0表示不读取
+	heartbeat     *HeartbeatConfig   // 心跳配置
+	reliable      *ReliableConfig    // 可靠推送配置
+	sessionCfg    *SessionConfig     // 会话恢复配置
+	sessions      *sessionManager    // 会话管理,nil表示不开启
+	offline       OfflineStore       // 离线消息存储,认证后投递
+	batchSize     int                // 一次合并写出的最大字节数
+	queueCfg      *QueueConfig       // 客户端发送队列配置,nil使用默认配置
+	schedule      ScheduleConfig     // 客户端发送队列的调度策略
+	budgetCfg     MemoryBudgetConfig // 所有客户端发送队列的内存预算
+	budget        *memoryBudget      // 内存预算,nil表示不限制
+	readLimit     int                // 认证后读取body的最大长度
+	readBufSize   int                // 每个连接的读缓冲大小,见NewMessageReader
+	authReadLimit int                // 认证阶段读取body的最大长度,0表示与认证后相同
+	limiter       *connLimiter       // 连接限制
+
+	prepareOnce sync.Once
+	prepareErr  error
 
 	mu        sync.RWMutex // 锁
 	clients   ClientSet    // 客户端集
 	clientsMu sync.RWMutex // 客户端锁
 
-	closeSig  chan bool      // 服务结束信号
+	closed    atomic.Bool    // 服务是否已关闭
 	wgLn      sync.WaitGroup // listener的等待组
 	wgClients sync.WaitGroup // clients的等待组
 
-	plugin ExternalPlugin
+	plugin    ExternalPlugin
+	goingAway func(*Client) *Message // 服务关闭时给客户端的最后一条消息
+
+	limitReply func(*Client, ProtocolHeader, int) *Message // 消息超过读取限制时的回复
+	kickNotice func(*Client, CloseReason) *Message         // 踢下线的通知消息
+}
+
+// ShutdownSummary 服务关闭结果统计
+type ShutdownSummary struct {
+	Total   int // 关闭时的客户端数
+	Drained int // 期限内清空队列并正常关闭的客户端数
+	Failed  int // 期限内关闭但没有写完队列的客户端数,如写错误,认证阶段的连接
+	Forced  int // 超过期限被强制关闭的客户端数
 }
 
 // 新建服务
@@ -44,23 +89,27 @@ func NewServer(options ...OptionFn) *Server {
 
 // 新建服务
 func NewServerWithConfig(cfg *ListenerConfig, options ...OptionFn) *Server {
+	if cfg == nil {
+		return NewServerWithConfigs(nil, options...)
+	}
+	return NewServerWithConfigs([]*ListenerConfig{cfg}, options...)
+}
+
+// 新建服务,同时监听多个地址
+func NewServerWithConfigs(cfgs []*ListenerConfig, options ...OptionFn) *Server {
 	s := new(Server)
-	s.lncfg = cfg
+	s.lncfgs = append(s.lncfgs, cfgs...)
 
 	s.init()
 	for _, op := range options {
 		op(s)
 	}
+	s.listenerConfig() // 至少有一个监听
 	return s
 }
 
 // 初始化默认配置
 func (s *Server) init() {
-	if s.lncfg == nil {
-		s.lncfg = &ListenerConfig{
-			Network: "tcp",
-		}
-	}
 	if s.readTimeout == 0 {
 		s.readTimeout = DefaultReadTimeout
 	}
@@ -70,78 +119,253 @@ func (s *Server) init() {
 	if s.maxConn == 0 {
 		s.maxConn = DefaultMaxConn
 	}
+	if s.drainTimeout == 0 {
+		s.drainTimeout = DefaultDrainTimeout
+	}
+	if s.authTimeout == 0 {
+		s.authTimeout = DefaultAuthTimeout
+	}
+	if s.readLimit == 0 {
+		s.readLimit = DefaultReadLimit
+	}
+	if s.batchSize == 0 {
+		s.batchSize = DefaultWriteBatchSize
+	}
 
 	if s.clients == nil {
 		s.clients = NewClientSet()
 	}
+}
 
-	if s.closeSig == nil {
-		s.closeSig = make(chan bool)
+// 主监听配置,未配置时使用默认tcp
+func (s *Server) listenerConfig() *ListenerConfig {
+	if len(s.lncfgs) == 0 {
+		s.lncfgs = append(s.lncfgs, &ListenerConfig{
+			Network: "tcp",
+		})
 	}
+	return s.lncfgs[0]
 }
 
-// 监听中断信号
-func (s *Server) startShutdownListener() {
-	go func() {
-		log.Infof("listen at %s, pid: %d", s.lncfg.Address, os.Getpid())
-		c := make(chan os.Signal, 1)
-		signal.Notify(c, syscall.SIGTERM, syscall.SIGINT)
-		sig := <-c
-		log.Infof("listener %s recv signal: %s", s.lncfg.Address, sig)
-		s.closeSig <- true
-	}()
+func (s *Server) listenerNames() []string {
+	names := make([]string, 0, len(s.lncfgs))
+	for _, cfg := range s.lncfgs {
+		names = append(names, cfg.String())
+	}
+	return names
 }
 
-func (s *Server) makeListener() (ln net.Listener, err error) {
-	ml := makeListeners[s.lncfg.Network]
+func (s *Server) makeListener(cfg *ListenerConfig) (ln net.Listener, err error) {
+	ml := makeListeners[cfg.Network]
 	if ml == nil {
-		return nil, fmt.Errorf("can not make listener for %s", s.lncfg.Network)
+		return nil, fmt.Errorf("can not make listener for %s", cfg.Network)
 	}
-	return ml(s.lncfg)
+	return ml(cfg)
 }
 
-func (s *Server) Run() {
-	if s.plugin == nil {
-		log.Fatalf("external plugin not set")
+// 创建所有监听,任何一个失败都会关闭已创建的监听
+func (s *Server) makeListeners() ([]net.Listener, error) {
+	lns := make([]net.Listener, 0, len(s.lncfgs))
+	for _, cfg := range s.lncfgs {
+		ln, err := s.makeListener(cfg)
+		if err != nil {
+			for _, l := range lns {
+				l.Close()
+			}
+			return nil, fmt.Errorf("listen %s: %s", cfg, err)
+		}
+		lns = append(lns, ln)
 	}
+	return lns, nil
+}
 
-	s.startShutdownListener()
+// Run 启动服务,收到SIGTERM/SIGINT后关闭服务
+func (s *Server) Run() error {
+	if err := s.Start(); err != nil {
+		return err
+	}
+	log.Infof("listen at %s, pid: %d", s.listenerNames(), os.Getpid())
+	sig := WaitSignal(syscall.SIGTERM, syscall.SIGINT)
+	log.Infof("listener %s recv signal: %s", s.listenerNames(), sig)
+	s.Stop()
+	return nil
+}
 
-	ln, err := s.makeListener()
+// 服务开始前的检查和准备
+func (s *Server) prepare() error {
+	if s.plugin == nil {
+		return ErrPluginNotSet
+	}
+	if _, ok := s.plugin.(AuthMessageHandler); s.authMsgCount > 0 && !ok {
+		return ErrNoAuthMsgHandler
+	}
+	s.prepareOnce.Do(func() {
+		s.limiter, s.prepareErr = newConnLimiter(s.limitCfg)
+		if s.budgetCfg.MaxBytes > 0 {
+			s.budget = newMemoryBudget(s.budgetCfg, s.shedClients)
+		}
+		if s.sessionCfg != nil {
+			if s.reliable == nil {
+				s.prepareErr = ErrNeedReliable
+				return
+			}
+			s.sessions = newSessionManager(s.sessionCfg, s.budget)
+		}
+		if s.offline != nil && s.reliable == nil {
+			s.prepareErr = ErrOfflineReliable
+		}
+	})
+	return s.prepareErr
+}
+
+// Start 创建所有配置的监听并开始服务,不阻塞
+func (s *Server) Start() error {
+	if err := s.prepare(); err != nil {
+		return err
+	}
+	lns, err := s.makeListeners()
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	for i, ln := range lns {
+		if err := s.addListener(ln); err != nil {
+			// 已经开始服务的监听也一起关闭
+			for _, l := range lns {
+				l.Close()
+			}
+			return err
+		}
+		go s.serveListener(ln, s.lncfgs[i])
+	}
+	return nil
+}
+
+// Serve 在给定的监听上提供服务,阻塞直到监听关闭
+// 服务关闭时返回ErrServerClosed,返回时ln已关闭
+func (s *Server) Serve(ln net.Listener) error {
+	if err := s.prepare(); err != nil {
+		ln.Close()
+		return err
+	}
+	if err := s.addListener(ln); err != nil {
+		ln.Close()
+		return err
 	}
-	s.ln = ln
-	go s.serveListener()
+	cfg := &ListenerConfig{
+		Network: ln.Addr().Network(),
+		Address: ln.Addr().String(),
+	}
+	return s.serveListener(ln, cfg)
+}
 
-	// 结束服务
-	<-s.closeSig
+// Stop 关闭服务,等待所有客户端处理完成
+func (s *Server) Stop() {
 	s.Close()
 }
 
+// 记录监听,服务关闭后不再接受新的监听
+func (s *Server) addListener(ln net.Listener) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed.Load() {
+		return ErrServerClosed
+	}
+	s.lns = append(s.lns, ln)
+	s.wgLn.Add(1)
+	return nil
+}
+
+// Addrs 返回正在服务的监听地址
+func (s *Server) Addrs() []net.Addr {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	addrs := make([]net.Addr, 0, len(s.lns))
+	for _, ln := range s.lns {
+		addrs = append(addrs, ln.Addr())
+	}
+	return addrs
+}
+
+// Close 关闭服务,最多等待drainTimeout后强制关闭剩余的连接,等待所有客户端处理完成
 func (s *Server) Close() {
+	ctx, cancel := context.WithTimeout(context.Background(), s.drainTimeout)
+	defer cancel()
+	s.Shutdown(ctx)
+	s.wgClients.Wait()
+	log.Infof("server %s wait all client onclose done", s.listenerNames())
+}
+
+// 等待所有客户端处理完成,ctx结束时返回ctx.Err()
+func (s *Server) waitClients(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.wgClients.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Shutdown 优雅关闭服务
+// 停止accept,发送goingAway消息并写完客户端队列中的消息后关闭连接,
+// ctx结束时强制关闭剩余的连接
+func (s *Server) Shutdown(ctx context.Context) (ShutdownSummary, error) {
 	//关闭listener
 	s.closeListener()
-	// 处理ConnClose
-	s.clientsMu.Lock()
-	for client := range s.clients {
-		client.Close()
-		//if client.closed.CAS(false, true) {
-		//	client.conn.Close() //要直接断开连接
-		//}
+
+	s.clientsMu.RLock()
+	clients := s.clients.Clone()
+	s.clientsMu.RUnlock()
+
+	summary := ShutdownSummary{Total: len(clients)}
+	for client := range clients {
+		if !client.authed.Load() {
+			// 认证阶段的连接直接关闭
+			client.drain(nil)
+			client.conn.Close()
+			continue
+		}
+		var last *Message
+		if s.goingAway != nil && client.DC != nil {
+			last = s.goingAway(client)
+		}
+		client.drain(last)
 	}
-	s.clientsMu.Unlock()
-	s.wgClients.Wait()
-	log.Infof("server %s wait all client onclose done", s.lncfg.Address)
+
+	for client := range clients {
+		select {
+		case <-client.done:
+			if client.drained.Load() {
+				summary.Drained++
+			} else {
+				summary.Failed++
+			}
+			delete(clients, client)
+		case <-ctx.Done():
+			// 超时,强制关闭剩余连接
+			for client := range clients {
+				client.conn.Close()
+			}
+			summary.Forced = len(clients)
+			log.Warnf("server %s shutdown: %d clients forced to close", s.listenerNames(), summary.Forced)
+			return summary, ctx.Err()
+		}
+	}
+	log.Infof("server %s shutdown: %d clients drained, %d failed", s.listenerNames(), summary.Drained, summary.Failed)
+	return summary, nil
 }
 
-func (s *Server) serveListener() {
-	s.wgLn.Add(1)
+// 每个监听一个accept循环
+func (s *Server) serveListener(ln net.Listener, cfg *ListenerConfig) error {
 	defer s.wgLn.Done()
 
 	var tempDelay time.Duration
 	for {
-		conn, err := s.ln.Accept()
+		conn, err := ln.Accept()
 		if err != nil {
 			if ne, ok := err.(net.Error); ok && ne.Temporary() {
 				if tempDelay == 0 {
@@ -152,64 +376,196 @@ func (s *Server) serveListener() {
 				if max := 1 * time.Second; tempDelay > max {
 					tempDelay = max
 				}
-				log.Warnf("server accept error: %v\nretrying in %s", err, tempDelay)
+				log.Warnf("server %s accept error: %v\nretrying in %s", cfg, err, tempDelay)
 				time.Sleep(tempDelay)
 				continue
 			}
 			// 这里一般是主动断开程序造成的错误
-			//log.Warnf("server listener error: %s", err)
-			return
+			if s.closed.Load() {
+				return ErrServerClosed
+			}
+			log.Warnf("server %s listener error: %s", cfg, err)
+			return err
 		}
 		tempDelay = 0
 
-		s.handleConn(conn)
+		s.handleConn(conn, cfg)
 	}
 }
 
 // 处理连接
-func (s *Server) handleConn(conn net.Conn) {
+func (s *Server) handleConn(conn net.Conn, cfg *ListenerConfig) {
+	ip := remoteIP(conn.RemoteAddr())
 	s.clientsMu.Lock()
 	// 如果连接数量超过限制,直接返回
 	// 理论上在auth时候就要避免
-	if count := len(s.clients); count >= s.maxConn {
+	count := len(s.clients)
+	if reason := s.limiter.admit(ip, count, s.maxConn); reason != rejectNone {
 		s.clientsMu.Unlock()
 		conn.Close()
-		log.Warnf("too many connections: %d", count)
+		log.Warnf("reject conn %s: %s, connections: %d", conn.RemoteAddr(), reason, count)
 		return
 	}
 
+	if an, ok := conn.(admitNotifier); ok {
+		an.admit()
+	}
+
 	netConn := NewNetConn(conn, s.readTimeout, s.writeTimeout)
 	client := NewClient(netConn)
+	client.reader = NewMessageReader(netConn, s.readBufSize)
 	client.plugin = s.plugin
+	client.lncfg = cfg
+	client.batchSize = s.batchSize
+	if s.queueCfg != nil {
+		client.SetQueueConfig(*s.queueCfg)
+	}
+	client.SetSchedule(s.schedule)
+	client.setBudget(s.budget)
+	client.SetReadLimit(s.readLimit)
+	client.authReadLimit = s.authReadLimit
+	client.limitReply = s.limitReply
+	client.kickNotice = s.kickNotice
+	if s.heartbeat != nil {
+		client.hb = s.heartbeat
+		client.hbInterval.Store(int64(s.heartbeat.Interval))
+	}
+	if s.reliable != nil {
+		client.rel = newReliable(s.reliable)
+		client.offline = s.offline
+	}
+	if s.sessions != nil {
+		client.sessions = s.sessions
+		client.sessionToken = newSessionToken()
+	}
 	s.clients.Add(client)
 	s.clientsMu.Unlock()
 
 	s.wgClients.Add(1)
-	log.Debugf("new conn: %s", conn.RemoteAddr())
+	log.Debugf("new conn: %s, listener: %s", conn.RemoteAddr(), cfg)
 
 	go func() {
-		if !s.plugin.HandleAuthClient(client) {
-			log.Errorf("client %s auth failed", client.Log())
-			return
-		} else {
+		authed := s.authClient(client)
+		if authed {
+			if s.sessions != nil {
+				s.sessions.attach(client)
+			}
+			if s.offline != nil {
+				s.deliverOffline(client)
+			}
 			client.Run() // 这里面进行Conn消息收发处理等,阻塞
 		}
 		// 阻塞条件结束
 		netConn.Close()
+		queued := client.closeQueues()
+		if s.sessions != nil {
+			s.sessions.detach(client, queued)
+		} else {
+			client.closeReliable()
+		}
 		s.clientsMu.Lock()
 		s.clients.Remove(client)
 		s.clientsMu.Unlock()
+		s.limiter.release(ip)
 
-		s.plugin.HandleClientClosed(client)
+		if authed {
+			s.plugin.HandleClientClosed(client)
+		}
+		close(client.done)
 		s.wgClients.Done()
 	}()
 }
 
+// 认证阶段,超时后直接关闭连接
+func (s *Server) authClient(client *Client) bool {
+	timer := time.AfterFunc(s.authTimeout, func() {
+		log.Warnf("client %s auth timeout", client.Log())
+		client.conn.Close()
+	})
+	ok := s.plugin.HandleAuthClient(client) && s.authMessages(client)
+	if !timer.Stop() {
+		ok = false
+	}
+	if !ok {
+		log.Errorf("client %s auth failed", client.Log())
+		return false
+	}
+	client.authed.Store(true)
+	return true
+}
+
+// 读取认证消息交给AuthMessageHandler处理,最多读取authMsgCount条
+func (s *Server) authMessages(client *Client) bool {
+	if s.authMsgCount <= 0 {
+		return true
+	}
+	handler, ok := s.plugin.(AuthMessageHandler)
+	if !ok {
+		// prepare中已检查,不能在没有认证的情况下放行
+		log.Errorf("auth messages configured, but plugin is not an AuthMessageHandler")
+		return false
+	}
+	if client.DC == nil {
+		return false
+	}
+	for i := 0; i < s.authMsgCount; i++ {
+		msg, err := client.readMessage()
+		if e, ok := err.(*ReadLimitError); ok {
+			// 写协程还未启动,直接回复
+			log.Warnf("client %s auth %s", client.Log(), e)
+			client.setCloseReason(CloseReasonMessageTooLarge)
+			if reply := client.readLimitReply(e); reply != nil {
+				WriteMessage(client.conn, reply)
+			}
+			return false
+		}
+		if err != nil {
+			log.Infof("client %s read auth message error: %s", client.Log(), err)
+			return false
+		}
+		done, err := handler.HandleAuthMessage(client, msg)
+		if err != nil {
+			log.Infof("client %s auth rejected: %s", client.Log(), err)
+			if ae, ok := err.(*AuthError); ok && ae.Reply != nil {
+				WriteMessage(client.conn, ae.Reply)
+			}
+			return false
+		}
+		if done {
+			return true
+		}
+	}
+	log.Infof("client %s auth not finished in %d messages", client.Log(), s.authMsgCount)
+	return false
+}
+
 func (s *Server) closeListener() {
-	s.ln.Close()
+	s.mu.Lock()
+	s.closed.Store(true)
+	lns := s.lns
+	s.lns = nil
+	s.mu.Unlock()
+	for _, ln := range lns {
+		ln.Close()
+	}
 	s.wgLn.Wait()
 }
 
+// RejectStats 返回被拒绝的连接数
+func (s *Server) RejectStats() RejectStats {
+	if s.limiter == nil {
+		return RejectStats{}
+	}
+	return s.limiter.stats()
+}
+
+// ListenerConfigs 返回服务的所有监听配置
+func (s *Server) ListenerConfigs() []*ListenerConfig {
+	cfgs := make([]*ListenerConfig, len(s.lncfgs))
+	copy(cfgs, s.lncfgs)
+	return cfgs
+}
+
 func (s *Server) ClientSet() ClientSet {
 	s.clientsMu.RLock()
 	defer s.clientsMu.RUnlock()
@@ -1,25 +1,230 @@
 package meim
 
 import (
+	"encoding/binary"
+	"fmt"
 	"net"
+	"reflect"
 	"testing"
 	"time"
+
+	"github.com/stretchr/testify/assert"
 )
 
-func TestServer(t *testing.T) {
+// 测试用的协议头, cmd(4) + seq(4) + bodyLen(4)
+type testHeader struct {
+	cmd     int
+	seq     int
+	bodyLen int
+}
+
+func (h *testHeader) Decode(b []byte) error {
+	h.cmd = int(binary.BigEndian.Uint32(b[:4]))
+	h.seq = int(binary.BigEndian.Uint32(b[4:8]))
+	h.bodyLen = int(binary.BigEndian.Uint32(b[8:12]))
+	return nil
+}
+
+func (h *testHeader) Encode() ([]byte, error) {
+	b := make([]byte, 12)
+	binary.BigEndian.PutUint32(b[:4], uint32(h.cmd))
+	binary.BigEndian.PutUint32(b[4:8], uint32(h.seq))
+	binary.BigEndian.PutUint32(b[8:12], uint32(h.bodyLen))
+	return b, nil
+}
+
+func (h *testHeader) Length() int             { return 12 }
+func (h *testHeader) Cmd() int                { return h.cmd }
+func (h *testHeader) SetCmd(cmd int)          { h.cmd = cmd }
+func (h *testHeader) Seq() int                { return h.seq }
+func (h *testHeader) SetSeq(seq int)          { h.seq = seq }
+func (h *testHeader) BodyLength() int         { return h.bodyLen }
+func (h *testHeader) SetBodyLength(n int)     { h.bodyLen = n }
+func (h *testHeader) Ver() int                { return 0 }
+func (h *testHeader) SetVer(v int)            {}
+func (h *testHeader) Clone() ProtocolHeader   { c := *h; return &c }
+func (h *testHeader) ReuseDecodeBuffer() bool { return true }
+func (h *testHeader) String() string          { return fmt.Sprintf("cmd: %d, seq: %d", h.cmd, h.seq) }
+
+type testDataCreator struct{}
+
+func (dc *testDataCreator) CreateHeader() ProtocolHeader        { return new(testHeader) }
+func (dc *testDataCreator) CreateBody(cmd int) ProtocolBody     { return new(plainData) }
+func (dc *testDataCreator) GetCmd(body interface{}) (int, bool) { return 0, false }
+func (dc *testDataCreator) GetCmd2(t reflect.Type) (int, bool)  { return 0, false }
+func (dc *testDataCreator) GetDescription(cmd int) string       { return fmt.Sprintf("CMD-%d", cmd) }
+
+var testDC = new(testDataCreator)
+
+func newTestMessage(cmd int, body string) *Message {
+	hdr := testDC.CreateHeader()
+	hdr.SetCmd(cmd)
+	data := plainData(body)
+	return &Message{Header: hdr, Body: &data}
+}
+
+// 回写消息的插件
+func newEchoPlugin() *ExternalImp {
+	imp := NewExternalImp()
+	imp.SetOnAuthClient(func(client *Client) bool {
+		client.DC = testDC
+		return true
+	})
+	imp.SetDefaultHandler(func(client *Client, msg *Message) {
+		client.EnqueueMessage(msg)
+	})
+	return imp
+}
+
+func newTestServer(t *testing.T, options ...OptionFn) *Server {
 	lncfg := &ListenerConfig{
 		Network: "tcp",
-		Address: "0.0.0.0:1234",
+		Address: "127.0.0.1:0",
 	}
+	options = append([]OptionFn{WithExternalPlugin(newEchoPlugin())}, options...)
+	s := NewServerWithConfig(lncfg, options...)
+	assert.NoError(t, s.Start())
+	return s
+}
 
-	s := NewServerWithConfig(lncfg)
-	s.plugin = NewExternalImp()
-	//SetExternalPlugin(NewExternalImp())
-	s.Run()
+func TestServer(t *testing.T) {
+	s := NewServerWithConfig(&ListenerConfig{Network: "tcp", Address: "127.0.0.1:0"})
+	assert.Equal(t, ErrPluginNotSet, s.Start())
+
+	s = newTestServer(t, WithListenerConfig(&ListenerConfig{
+		Name:    "second",
+		Network: "tcp",
+		Address: "127.0.0.1:0",
+	}))
+	addrs := s.Addrs()
+	assert.Len(t, addrs, 2)
+
+	for _, addr := range addrs {
+		conn, err := net.Dial("tcp", addr.String())
+		assert.NoError(t, err)
+		assert.NoError(t, WriteMessage(conn, newTestMessage(1, "hello")))
+		msg, err := ReadMessage(conn, testDC)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, msg.Header.Cmd())
+		conn.Close()
+	}
+
+	s.Stop()
+	assert.Empty(t, s.Addrs())
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	assert.Equal(t, ErrServerClosed, s.Serve(ln))
+	_, err = ln.Accept()
+	assert.Error(t, err)
+}
+
+func TestServerStartFailed(t *testing.T) {
+	used, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer used.Close()
+
+	s := NewServerWithConfigs([]*ListenerConfig{
+		{Network: "tcp", Address: "127.0.0.1:0"},
+		{Network: "tcp", Address: used.Addr().String()},
+	}, WithExternalPlugin(newEchoPlugin()))
+	assert.Error(t, s.Start())
+	assert.Empty(t, s.Addrs())
+}
+
+func TestServerListenerOptions(t *testing.T) {
+	extra := &ListenerConfig{Name: "extra", Network: "ws"}
+	// 额外的监听与选项顺序无关,总是在主监听之后
+	for _, s := range []*Server{
+		NewServer(WithListenerConfig(extra), WithListenAddr(":1")),
+		NewServer(WithListenAddr(":1"), WithListenerConfig(extra)),
+	} {
+		cfgs := s.ListenerConfigs()
+		if assert.Len(t, cfgs, 2) {
+			assert.Equal(t, "tcp", cfgs[0].Network)
+			assert.Equal(t, ":1", cfgs[0].Address)
+			assert.Equal(t, "extra", cfgs[1].Name)
+		}
+	}
+
+	primary := &ListenerConfig{Network: "ws", Address: ":2"}
+	s := NewServer(WithListenerConfig(extra), WithPrimaryListener(primary))
+	assert.Equal(t, []string{":2", ""}, []string{s.ListenerConfigs()[0].Address, s.ListenerConfigs()[1].Address})
+
+	// 选项不修改调用方的配置
+	hb := &HeartbeatConfig{PingCmd: 1, PongCmd: 2}
+	NewServer(WithHeartbeat(hb))
+	assert.Zero(t, hb.Interval)
 }
 
 func TestClient(t *testing.T) {
-	conn, _ := net.Dial("tcp", "127.0.0.1:1234")
-	time.Sleep(time.Second * 5)
-	conn.Close()
+	s := newTestServer(t)
+	defer s.Stop()
+
+	conn, err := net.Dial("tcp", s.Addrs()[0].String())
+	assert.NoError(t, err)
+	defer conn.Close()
+	assert.NoError(t, WriteMessage(conn, newTestMessage(2, "ping")))
+	msg, err := ReadMessage(conn, testDC)
+	assert.NoError(t, err)
+	assert.Equal(t, "ping", string(*msg.Body.(*plainData)))
+
+	var client *Client
+	for c := range s.ClientSet() {
+		client = c
+	}
+	if assert.NotNil(t, client) {
+		assert.Equal(t, s.ListenerConfigs()[0], client.ListenerConfig())
+	}
+}
+
+func TestServerAuthMessagesNoHandler(t *testing.T) {
+	// 只实现ExternalPlugin,没有AuthMessageHandler
+	plugin := struct{ ExternalPlugin }{newEchoPlugin()}
+	s := NewServerWithConfig(&ListenerConfig{Network: "tcp", Address: "127.0.0.1:0"},
+		WithExternalPlugin(plugin), WithAuthMessages(1))
+	assert.Equal(t, ErrNoAuthMsgHandler, s.Start())
+	assert.Empty(t, s.Addrs())
+}
+
+func TestServerAuthMessages(t *testing.T) {
+	s := newTestServer(t, WithAuthMessages(1), WithAuthTimeout(time.Millisecond*200))
+	defer s.Stop()
+	s.plugin.(*ExternalImp).SetOnAuthMessage(func(client *Client, msg *Message) (bool, error) {
+		if string(*msg.Body.(*plainData)) != "token" {
+			return false, &AuthError{Reason: "invalid token", Reply: NewCmdMessage(client.DC, 11)}
+		}
+		return true, nil
+	})
+	addr := s.Addrs()[0].String()
+
+	// 认证成功
+	conn, err := net.Dial("tcp", addr)
+	assert.NoError(t, err)
+	defer conn.Close()
+	assert.NoError(t, WriteMessage(conn, newTestMessage(10, "token")))
+	assert.NoError(t, WriteMessage(conn, newTestMessage(1, "hello")))
+	msg, err := ReadMessage(conn, testDC)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, msg.Header.Cmd())
+
+	// 认证失败,收到回复后断开
+	conn2, err := net.Dial("tcp", addr)
+	assert.NoError(t, err)
+	defer conn2.Close()
+	assert.NoError(t, WriteMessage(conn2, newTestMessage(10, "bad")))
+	msg, err = ReadMessage(conn2, testDC)
+	assert.NoError(t, err)
+	assert.Equal(t, 11, msg.Header.Cmd())
+	_, err = ReadMessage(conn2, testDC)
+	assert.Error(t, err)
+
+	// 认证超时
+	conn3, err := net.Dial("tcp", addr)
+	assert.NoError(t, err)
+	defer conn3.Close()
+	_, err = ReadMessage(conn3, testDC)
+	assert.Error(t, err)
+
+	time.Sleep(time.Millisecond * 50)
+	assert.Len(t, s.ClientSet(), 1)
 }
@@ -0,0 +1,287 @@
+package meim
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/ipiao/meim/log"
+)
+
+const (
+	DefaultSessionGracePeriod = time.Minute * 2
+	DefaultSessionMaxBuffered = 1000
+)
+
+// SessionConfig 会话恢复配置,需要同时开启可靠推送(WithReliable)
+// 服务端为每个连接分配会话token,客户端异常断开后会话保留GracePeriod,
+// 期间新连接在认证时通过Client.ResumeSession提交token和最后收到的序号,恢复序号并重发未收到的消息
+// 会话保留的消息计入内存预算(WithMemoryBudget),超出预算时最早的消息交给ReliableConfig.OnUnacked
+type SessionConfig struct {
+	GracePeriod time.Duration // 断开后会话的保留时间
+	MaxBuffered int           // 会话保留的最多消息数,超过时最早的消息交给ReliableConfig.OnUnacked
+}
+
+func (cfg *SessionConfig) init() {
+	if cfg.GracePeriod <= 0 {
+		cfg.GracePeriod = DefaultSessionGracePeriod
+	}
+	if cfg.MaxBuffered <= 0 {
+		cfg.MaxBuffered = DefaultSessionMaxBuffered
+	}
+}
+
+// 断开后可以保留会话的关闭原因
+func (r CloseReason) resumable() bool {
+	switch r {
+	case CloseReasonReadError, CloseReasonWriteError, CloseReasonIdleTimeout,
+		CloseReasonAckTimeout, CloseReasonSessionTakeover:
+		return true
+	}
+	return false
+}
+
+type session struct {
+	token   string
+	uid     int64
+	client  *Client     // 当前连接的客户端,断开后为nil
+	last    *Client     // 最后连接的客户端,过期时传给OnUnacked
+	seq     int         // 断开时最后分配的序号
+	pending []*Message  // 断开时未确认的可靠消息
+	queued  []*Message  // 断开时未写出的其他消息
+	bytes   int         // 暂存消息占用的内存预算
+	timer   *time.Timer // 过期计时
+}
+
+// 丢弃最早的n条消息,先丢弃未确认的消息
+func (sess *session) dropFront(n int) []*Message {
+	np := n
+	if np > len(sess.pending) {
+		np = len(sess.pending)
+	}
+	dropped := append([]*Message(nil), sess.pending[:np]...)
+	sess.pending = sess.pending[np:]
+	dropped = append(dropped, sess.queued[:n-np]...)
+	sess.queued = sess.queued[n-np:]
+	return dropped
+}
+
+// 会话管理,所有方法都可以并发调用
+type sessionManager struct {
+	cfg      *SessionConfig
+	budget   *memoryBudget // 暂存的消息计入服务的内存预算,nil表示不限制
+	mu       sync.Mutex
+	sessions map[string]*session
+}
+
+func newSessionManager(cfg *SessionConfig, budget *memoryBudget) *sessionManager {
+	return &sessionManager{cfg: cfg, budget: budget, sessions: make(map[string]*session)}
+}
+
+func newSessionToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Warnf("generate session token error: %s", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// SessionToken 客户端的会话token,在认证时即可获取并发送给客户端,未开启会话恢复时为空
+// 恢复会话后为原会话的token
+func (client *Client) SessionToken() string {
+	return client.sessionToken
+}
+
+// ResumeSession 恢复断开的会话,只能在认证时设置UID之后调用
+// lastSeq为客户端最后收到的可靠消息序号,之后的消息在认证成功后重发
+// 原连接尚未断开时先将其关闭,token不存在、已过期或UID不一致时返回false
+// 认证成功后才绑定会话,认证失败时会话保持不变
+func (client *Client) ResumeSession(token string, lastSeq int) bool {
+	if client.sessions == nil || client.rel == nil {
+		return false
+	}
+	return client.sessions.resume(client, token, lastSeq)
+}
+
+// EndSession 客户端关闭后不保留会话,一般在客户端主动登出时调用
+func (client *Client) EndSession() {
+	client.endSession.Store(true)
+}
+
+// 认证成功后调用,绑定请求恢复的会话并重发消息,否则新建会话
+func (m *sessionManager) attach(client *Client) {
+	m.mu.Lock()
+	var replay []*Message
+	if sess := client.resume; sess != nil {
+		client.resume = nil
+		if m.sessions[sess.token] == sess && sess.client == nil {
+			replay = m.bind(client, sess, client.resumeSeq)
+		} else {
+			// 认证期间会话已过期或被其他连接恢复
+			log.Warnf("client %s session to resume is gone", client.Log())
+			client.sessionToken = newSessionToken()
+		}
+	}
+	if client.session == nil {
+		sess := &session{token: client.sessionToken, uid: client.UID, client: client}
+		m.sessions[sess.token] = sess
+		client.session = sess
+	}
+	m.mu.Unlock()
+
+	for _, msg := range replay {
+		client.enqueue(msg, PriorityRealtime, false)
+	}
+}
+
+func (m *sessionManager) resume(client *Client, token string, lastSeq int) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sess, ok := m.sessions[token]
+	if !ok || sess.uid != client.UID || client.session != nil {
+		return false
+	}
+	if old := sess.client; old != nil {
+		// 原连接还没有被发现断开
+		m.mu.Unlock()
+		old.closeWithReason(CloseReasonSessionTakeover)
+		select {
+		case <-old.Done():
+		case <-time.After(time.Second * 3):
+			log.Warnf("client %s session takeover timeout", old.Log())
+		}
+		m.mu.Lock()
+		if m.sessions[token] != sess || sess.client != nil {
+			return false
+		}
+	}
+	client.resume = sess
+	client.resumeSeq = lastSeq
+	client.sessionToken = token
+	return true
+}
+
+// 将会话绑定到认证成功的客户端,恢复序号,返回需要重发的消息
+func (m *sessionManager) bind(client *Client, sess *session, lastSeq int) []*Message {
+	if sess.timer != nil {
+		sess.timer.Stop()
+	}
+	sess.client = client
+	client.session = sess
+	client.sessionToken = sess.token
+
+	var replay []*Message
+	r := client.rel
+	r.mu.Lock()
+	if lastSeq > sess.seq {
+		lastSeq = sess.seq
+	}
+	r.seq = sess.seq
+	r.acked = lastSeq
+	for _, msg := range sess.pending {
+		if msg.Header.Seq() > lastSeq {
+			r.pending = append(r.pending, &pendingMessage{msg: msg, queued: true})
+			replay = append(replay, msg)
+		}
+	}
+	r.mu.Unlock()
+	replay = append(replay, sess.queued...)
+	sess.pending, sess.queued = nil, nil
+	// 重发的消息入队时重新计入预算
+	m.budget.release(sess.bytes)
+	sess.bytes = 0
+	log.Infof("client %s resume session, last seq %d, replay %d messages", client.Log(), lastSeq, len(replay))
+	return replay
+}
+
+// 客户端关闭后调用,queued为发送队列中未写出的消息
+// 会话可以保留时暂存未确认和未写出的消息,否则交给closeReliable
+func (m *sessionManager) detach(client *Client, queued []*Message) {
+	m.mu.Lock()
+	sess := client.session
+	if sess == nil || sess.client != client {
+		m.mu.Unlock()
+		client.closeReliable()
+		return
+	}
+	if client.endSession.Load() || !client.CloseReason().resumable() {
+		delete(m.sessions, sess.token)
+		sess.client = nil
+		m.mu.Unlock()
+		client.closeReliable()
+		return
+	}
+
+	r := client.rel
+	r.mu.Lock()
+	r.closed = true
+	reliable := make(map[*Message]bool, len(r.pending))
+	for _, pm := range r.pending {
+		sess.pending = append(sess.pending, pm.msg)
+		reliable[pm.msg] = true
+	}
+	r.pending = nil
+	sess.seq = r.seq
+	r.mu.Unlock()
+	for _, msg := range queued {
+		if !reliable[msg] {
+			sess.queued = append(sess.queued, msg)
+		}
+	}
+
+	var dropped []*Message
+	if over := len(sess.pending) + len(sess.queued) - m.cfg.MaxBuffered; over > 0 {
+		dropped = sess.dropFront(over)
+	}
+	dropped = append(dropped, m.charge(sess)...)
+	sess.client = nil
+	sess.last = client
+	sess.timer = time.AfterFunc(m.cfg.GracePeriod, func() {
+		m.expire(sess)
+	})
+	m.mu.Unlock()
+
+	if len(dropped) > 0 {
+		client.unacked(dropped)
+	}
+}
+
+// 会话过期,剩余消息交给OnUnacked
+func (m *sessionManager) expire(sess *session) {
+	m.mu.Lock()
+	if m.sessions[sess.token] != sess || sess.client != nil {
+		m.mu.Unlock()
+		return
+	}
+	delete(m.sessions, sess.token)
+	msgs := append(sess.pending, sess.queued...)
+	sess.pending, sess.queued = nil, nil
+	m.budget.release(sess.bytes)
+	sess.bytes = 0
+	m.mu.Unlock()
+
+	log.Infof("session of client %s expired", sess.last.Log())
+	if len(msgs) > 0 {
+		sess.last.unacked(msgs)
+	}
+}
+
+// 暂存的消息计入内存预算,超出预算时丢弃最早的消息,返回丢弃的消息
+func (m *sessionManager) charge(sess *session) []*Message {
+	var dropped []*Message
+	size := 0
+	for _, msg := range sess.pending {
+		size += MessageSize(msg)
+	}
+	for _, msg := range sess.queued {
+		size += MessageSize(msg)
+	}
+	for size > 0 && !m.budget.acquire(size, false) {
+		msgs := sess.dropFront(1)
+		size -= MessageSize(msgs[0])
+		dropped = append(dropped, msgs...)
+	}
+	sess.bytes = size
+	return dropped
+}
@@ -0,0 +1,228 @@
+package meim
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionNeedReliable(t *testing.T) {
+	s := NewServer(WithExternalPlugin(newEchoPlugin()), WithSession(&SessionConfig{}))
+	assert.Equal(t, ErrNeedReliable, s.prepare())
+}
+
+func TestSessionResume(t *testing.T) {
+	unacked := make(chan []*Message, 1)
+	reasons := make(chan CloseReason, 4)
+	s := newTestServer(t, WithAuthMessages(1),
+		WithReliable(&ReliableConfig{
+			AckCmd: 30,
+			OnUnacked: func(client *Client, msgs []*Message) {
+				unacked <- msgs
+			},
+		}),
+		WithSession(&SessionConfig{GracePeriod: time.Millisecond * 200}))
+	defer s.Stop()
+	imp := s.plugin.(*ExternalImp)
+	// 认证消息body为new或resume:token,header的seq为最后收到的序号
+	imp.SetOnAuthMessage(func(client *Client, msg *Message) (bool, error) {
+		client.UID = 1
+		body := string(*msg.Body.(*plainData))
+		if strings.HasPrefix(body, "resume:") {
+			client.ResumeSession(strings.TrimPrefix(body, "resume:"), msg.Header.Seq())
+		}
+		reply := plainData(client.SessionToken())
+		client.EnqueueMessage(&Message{Header: NewCmdMessage(client.DC, 12).Header, Body: &reply})
+		return true, nil
+	})
+	imp.SetOnClientClosed(func(client *Client) {
+		reasons <- client.CloseReason()
+	})
+
+	addr := s.Addrs()[0].String()
+	auth := func(body string, seq int) (net.Conn, string) {
+		conn, err := net.Dial("tcp", addr)
+		assert.NoError(t, err)
+		msg := newTestMessage(10, body)
+		msg.Header.SetSeq(seq)
+		assert.NoError(t, WriteMessage(conn, msg))
+		msg, err = ReadMessage(conn, testDC)
+		assert.NoError(t, err)
+		assert.Equal(t, 12, msg.Header.Cmd())
+		return conn, string(*msg.Body.(*plainData))
+	}
+	readSeqs := func(conn net.Conn, n int) []int {
+		var seqs []int
+		for i := 0; i < n; i++ {
+			msg, err := ReadMessage(conn, testDC)
+			assert.NoError(t, err)
+			seqs = append(seqs, msg.Header.Seq())
+		}
+		return seqs
+	}
+	push := func(n int) {
+		var client *Client
+		assert.Eventually(t, func() bool {
+			for c := range s.ClientSet() {
+				if c.Authed() {
+					client = c
+				}
+			}
+			return client != nil
+		}, time.Second, time.Millisecond*10)
+		for i := 0; i < n; i++ {
+			client.EnqueueReliableMessage(newTestMessage(1, "push"))
+		}
+	}
+
+	conn, token := auth("new", 0)
+	assert.Len(t, token, 32)
+	push(3)
+	assert.Equal(t, []int{1, 2, 3}, readSeqs(conn, 3))
+	conn.Close()
+	assert.Equal(t, CloseReasonReadError, <-reasons)
+
+	// 恢复会话,重发未收到的消息
+	conn, resumed := auth("resume:"+token, 2)
+	assert.Equal(t, token, resumed)
+	assert.Equal(t, []int{3}, readSeqs(conn, 1))
+	push(1)
+	assert.Equal(t, []int{4}, readSeqs(conn, 1))
+
+	// 原连接未断开时被新连接接管
+	conn2, resumed := auth("resume:"+token, 4)
+	assert.Equal(t, token, resumed)
+	assert.Equal(t, CloseReasonSessionTakeover, <-reasons)
+	_, err := ReadMessage(conn, testDC)
+	assert.Error(t, err)
+	conn.Close()
+
+	// 无效的token分配新的会话
+	conn3, other := auth("resume:invalid", 0)
+	assert.NotEqual(t, token, other)
+	conn3.Close()
+	<-reasons
+
+	// 过期后未确认的消息交给OnUnacked
+	push(1)
+	assert.Equal(t, []int{5}, readSeqs(conn2, 1))
+	conn2.Close()
+	assert.Equal(t, CloseReasonReadError, <-reasons)
+	select {
+	case msgs := <-unacked:
+		if assert.Len(t, msgs, 1) {
+			assert.Equal(t, 5, msgs[0].Header.Seq())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("session not expired")
+	}
+	_, other = auth("resume:"+token, 5)
+	assert.NotEqual(t, token, other)
+}
+
+func TestSessionResumeAuthFailed(t *testing.T) {
+	reasons := make(chan CloseReason, 4)
+	s := newTestServer(t, WithAuthMessages(2),
+		WithReliable(&ReliableConfig{AckCmd: 30}),
+		WithSession(&SessionConfig{}))
+	defer s.Stop()
+	imp := s.plugin.(*ExternalImp)
+	// 第一条认证消息body为new或resume:token,第二条为ok时认证成功
+	imp.SetOnAuthMessage(func(client *Client, msg *Message) (bool, error) {
+		client.UID = 1
+		body := string(*msg.Body.(*plainData))
+		if strings.HasPrefix(body, "resume:") {
+			client.ResumeSession(strings.TrimPrefix(body, "resume:"), msg.Header.Seq())
+		}
+		switch body {
+		case "fail":
+			return false, errors.New("auth failed")
+		case "ok":
+			reply := plainData(client.SessionToken())
+			client.EnqueueMessage(&Message{Header: NewCmdMessage(client.DC, 12).Header, Body: &reply})
+			return true, nil
+		}
+		return false, nil
+	})
+	imp.SetOnClientClosed(func(client *Client) {
+		reasons <- client.CloseReason()
+	})
+
+	addr := s.Addrs()[0].String()
+	dial := func(bodies ...string) net.Conn {
+		conn, err := net.Dial("tcp", addr)
+		assert.NoError(t, err)
+		for _, body := range bodies {
+			assert.NoError(t, WriteMessage(conn, newTestMessage(10, body)))
+		}
+		return conn
+	}
+
+	conn := dial("new", "ok")
+	msg, err := ReadMessage(conn, testDC)
+	assert.NoError(t, err)
+	token := string(*msg.Body.(*plainData))
+	var client *Client
+	assert.Eventually(t, func() bool {
+		for c := range s.ClientSet() {
+			client = c
+		}
+		return client != nil && client.Authed()
+	}, time.Second, time.Millisecond*10)
+	assert.True(t, client.EnqueueReliableMessage(newTestMessage(1, "push")))
+	_, err = ReadMessage(conn, testDC)
+	assert.NoError(t, err)
+	conn.Close()
+	assert.Equal(t, CloseReasonReadError, <-reasons)
+
+	// 恢复后认证失败,会话保持不变
+	failed := dial("resume:"+token, "fail")
+	_, err = ReadMessage(failed, testDC)
+	assert.Error(t, err)
+	failed.Close()
+
+	conn = dial("resume:"+token, "ok")
+	defer conn.Close()
+	msg, err = ReadMessage(conn, testDC)
+	assert.NoError(t, err)
+	assert.Equal(t, token, string(*msg.Body.(*plainData)))
+	msg, err = ReadMessage(conn, testDC)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, msg.Header.Seq())
+}
+
+func TestSessionBudget(t *testing.T) {
+	var unacked []*Message
+	cfg := &ReliableConfig{
+		AckCmd: 30,
+		OnUnacked: func(client *Client, msgs []*Message) {
+			unacked = append(unacked, msgs...)
+		},
+	}
+	cfg.init()
+	size := MessageSize(newTestMessage(1, "a"))
+	budget := newMemoryBudget(MemoryBudgetConfig{MaxBytes: int64(size * 2)}, nil)
+	m := newSessionManager(&SessionConfig{GracePeriod: time.Minute, MaxBuffered: 10}, budget)
+
+	client := newQueueTestClient(QueueConfig{})
+	client.rel = newReliable(cfg)
+	client.UID = 1
+	client.sessionToken = "token"
+	m.attach(client)
+	client.closeWithReason(CloseReasonReadError)
+
+	// 超出预算时丢弃最早的消息
+	queued := []*Message{newTestMessage(1, "a"), newTestMessage(1, "b"), newTestMessage(1, "c")}
+	m.detach(client, queued)
+	assert.Equal(t, queued[:1], unacked)
+	assert.Equal(t, int64(size*2), budget.stats().Used)
+
+	// 过期后释放预算
+	m.expire(client.session)
+	assert.Equal(t, queued, unacked)
+	assert.Zero(t, budget.stats().Used)
+}
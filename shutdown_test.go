@@ -0,0 +1,101 @@
+package meim
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerShutdown(t *testing.T) {
+	s := newTestServer(t, WithGoingAwayCmd(99))
+
+	conn, err := net.Dial("tcp", s.Addrs()[0].String())
+	assert.NoError(t, err)
+	defer conn.Close()
+	assert.NoError(t, WriteMessage(conn, newTestMessage(1, "a")))
+	_, err = ReadMessage(conn, testDC)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	summary, err := s.Shutdown(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, ShutdownSummary{Total: 1, Drained: 1}, summary)
+
+	msg, err := ReadMessage(conn, testDC)
+	assert.NoError(t, err)
+	assert.Equal(t, 99, msg.Header.Cmd())
+}
+
+// 连接后完成一次回写,返回服务端的客户端
+func dialEcho(t *testing.T, s *Server) (net.Conn, *Client) {
+	conn, err := net.Dial("tcp", s.Addrs()[0].String())
+	assert.NoError(t, err)
+	assert.NoError(t, WriteMessage(conn, newTestMessage(1, "a")))
+	_, err = ReadMessage(conn, testDC)
+	assert.NoError(t, err)
+	var client *Client
+	for c := range s.ClientSet() {
+		client = c
+	}
+	return conn, client
+}
+
+func TestServerShutdownForced(t *testing.T) {
+	s := newTestServer(t)
+	conn, client := dialEcho(t, s)
+	defer conn.Close()
+
+	// 写协程被阻塞,不能清空队列
+	release := make(chan struct{})
+	defer close(release)
+	assert.True(t, client.EnqueueEvent(func(*Client) { <-release }))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	summary, err := s.Shutdown(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, ShutdownSummary{Total: 1, Forced: 1}, summary)
+	_, err = ReadMessage(conn, testDC)
+	assert.Error(t, err)
+}
+
+func TestServerCloseTimeout(t *testing.T) {
+	s := newTestServer(t, WithDrainTimeout(time.Millisecond*100))
+	conn, client := dialEcho(t, s)
+	defer conn.Close()
+
+	release := make(chan struct{})
+	assert.True(t, client.EnqueueEvent(func(*Client) { <-release }))
+	closed := make(chan struct{})
+	go func() {
+		s.Close()
+		close(closed)
+	}()
+
+	// 超过drainTimeout后连接被强制关闭
+	_, err := ReadMessage(conn, testDC)
+	assert.Error(t, err)
+	close(release)
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("close not returned")
+	}
+}
+
+func TestServerShutdownFailed(t *testing.T) {
+	// 认证阶段的连接没有清空队列
+	s := newTestServer(t, WithAuthMessages(1))
+	conn, err := net.Dial("tcp", s.Addrs()[0].String())
+	assert.NoError(t, err)
+	defer conn.Close()
+	assert.Eventually(t, func() bool { return len(s.ClientSet()) == 1 }, time.Second, time.Millisecond*10)
+
+	summary, err := s.Shutdown(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, ShutdownSummary{Total: 1, Failed: 1}, summary)
+}
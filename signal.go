@@ -0,0 +1,15 @@
+package meim
+
+import (
+	"os"
+	"os/signal"
+)
+
+// WaitSignal 阻塞直到收到指定信号中的任意一个
+// 服务本身不处理信号,需要时由调用方选择使用
+func WaitSignal(sigs ...os.Signal) os.Signal {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, sigs...)
+	defer signal.Stop(c)
+	return <-c
+}
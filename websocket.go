@@ -0,0 +1,358 @@
+package meim
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ipiao/meim/log"
+)
+
+// websocket(RFC 6455)服务端实现
+// 每个二进制帧承载一个完整的meim消息,读取时按字节流处理,支持分片
+
+const (
+	wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xa
+
+	wsFinBit  = 0x80
+	wsRsvBits = 0x70
+	wsMaskBit = 0x80
+
+	wsCloseNormal      = 1000
+	wsCloseProtocol    = 1002
+	wsCloseUnsupported = 1003
+
+	wsMaxControlPayload = 125
+	wsHandshakeTimeout  = time.Second * 10
+)
+
+var (
+	ErrorWSHandshake      = errors.New("websocket: bad handshake")
+	ErrorWSProtocol       = errors.New("websocket: protocol error")
+	ErrorWSUnsupported    = errors.New("websocket: unsupported data")
+	ErrorWSListenerClosed = errors.New("websocket: listener closed")
+)
+
+// WSConn websocket连接,实现了net.Conn
+type WSConn struct {
+	net.Conn
+	br *bufio.Reader
+
+	// 读状态,只在读协程中使用
+	remaining int64   // 当前帧剩余的payload
+	mask      [4]byte // 当前帧的掩码
+	maskPos   int     //
+	fragment  bool    // 是否在分片消息中
+	header    [14]byte
+
+	wmu       sync.Mutex // 写锁,读协程也会回复pong和close
+	closeOnce sync.Once  //
+	closeSent bool       //
+}
+
+// Upgrade 将http请求升级为websocket连接
+// subprotocols为服务端支持的子协议,选择客户端请求中第一个支持的
+func Upgrade(w http.ResponseWriter, r *http.Request, subprotocols ...string) (*WSConn, error) {
+	if r.Method != http.MethodGet ||
+		!headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "websocket upgrade required", http.StatusBadRequest)
+		return nil, ErrorWSHandshake
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported websocket version", http.StatusUpgradeRequired)
+		return nil, ErrorWSHandshake
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "missing websocket key", http.StatusBadRequest)
+		return nil, ErrorWSHandshake
+	}
+	protocol := selectSubprotocol(r.Header, subprotocols)
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket not supported", http.StatusInternalServerError)
+		return nil, ErrorWSHandshake
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + wsAcceptKey(key) + "\r\n"
+	if protocol != "" {
+		resp += "Sec-WebSocket-Protocol: " + protocol + "\r\n"
+	}
+	resp += "\r\n"
+	conn.SetDeadline(time.Now().Add(wsHandshakeTimeout))
+	if _, err := conn.Write([]byte(resp)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return &WSConn{Conn: conn, br: rw.Reader}, nil
+}
+
+func wsAcceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// header中是否包含token,不区分大小写
+func headerContains(h http.Header, name, token string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func selectSubprotocol(h http.Header, supported []string) string {
+	if len(supported) == 0 {
+		return ""
+	}
+	for _, v := range h[http.CanonicalHeaderKey("Sec-WebSocket-Protocol")] {
+		for _, p := range strings.Split(v, ",") {
+			p = strings.TrimSpace(p)
+			for _, s := range supported {
+				if p == s {
+					return p
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// Read 读取二进制帧的payload,控制帧在内部处理
+func (c *WSConn) Read(b []byte) (int, error) {
+	for c.remaining == 0 {
+		if err := c.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+	if int64(len(b)) > c.remaining {
+		b = b[:c.remaining]
+	}
+	n, err := c.br.Read(b)
+	c.unmask(b[:n])
+	c.remaining -= int64(n)
+	return n, err
+}
+
+func (c *WSConn) unmask(b []byte) {
+	for i := range b {
+		b[i] ^= c.mask[c.maskPos&3]
+		c.maskPos++
+	}
+}
+
+// 读取下一个帧头,处理控制帧
+func (c *WSConn) nextFrame() error {
+	hdr := c.header[:2]
+	if _, err := io.ReadFull(c.br, hdr); err != nil {
+		return err
+	}
+	fin := hdr[0]&wsFinBit != 0
+	opcode := hdr[0] & 0x0f
+	masked := hdr[1]&wsMaskBit != 0
+	length := int64(hdr[1] & 0x7f)
+
+	if hdr[0]&wsRsvBits != 0 || !masked {
+		// 客户端的帧必须有掩码
+		return c.fail(wsCloseProtocol, ErrorWSProtocol)
+	}
+	switch length {
+	case 126:
+		if _, err := io.ReadFull(c.br, c.header[2:4]); err != nil {
+			return err
+		}
+		length = int64(binary.BigEndian.Uint16(c.header[2:4]))
+	case 127:
+		if _, err := io.ReadFull(c.br, c.header[2:10]); err != nil {
+			return err
+		}
+		length = int64(binary.BigEndian.Uint64(c.header[2:10]))
+		if length < 0 {
+			return c.fail(wsCloseProtocol, ErrorWSProtocol)
+		}
+	}
+	if _, err := io.ReadFull(c.br, c.mask[:]); err != nil {
+		return err
+	}
+	c.maskPos = 0
+
+	switch opcode {
+	case wsOpBinary:
+		if c.fragment {
+			return c.fail(wsCloseProtocol, ErrorWSProtocol)
+		}
+	case wsOpContinuation:
+		if !c.fragment {
+			return c.fail(wsCloseProtocol, ErrorWSProtocol)
+		}
+	case wsOpText:
+		return c.fail(wsCloseUnsupported, ErrorWSUnsupported)
+	case wsOpClose, wsOpPing, wsOpPong:
+		if !fin || length > wsMaxControlPayload {
+			return c.fail(wsCloseProtocol, ErrorWSProtocol)
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.br, payload); err != nil {
+			return err
+		}
+		c.unmask(payload)
+		return c.handleControl(opcode, payload)
+	default:
+		return c.fail(wsCloseProtocol, ErrorWSProtocol)
+	}
+
+	c.fragment = !fin
+	c.remaining = length
+	return nil
+}
+
+func (c *WSConn) handleControl(opcode byte, payload []byte) error {
+	switch opcode {
+	case wsOpPing:
+		return c.writeFrame(wsOpPong, payload)
+	case wsOpClose:
+		code := wsCloseNormal
+		if len(payload) >= 2 {
+			code = int(binary.BigEndian.Uint16(payload))
+		}
+		c.sendClose(code)
+		return io.EOF
+	}
+	return nil
+}
+
+// 协议错误,发送close后返回错误
+func (c *WSConn) fail(code int, err error) error {
+	c.sendClose(code)
+	return err
+}
+
+func (c *WSConn) sendClose(code int) {
+	c.closeOnce.Do(func() {
+		payload := make([]byte, 2)
+		binary.BigEndian.PutUint16(payload, uint16(code))
+		if err := c.writeFrame(wsOpClose, payload); err != nil {
+			log.Debugf("websocket write close error: %s, addr: %s", err, c.RemoteAddr())
+		}
+	})
+}
+
+// Write 每次写入一个完整的二进制帧
+func (c *WSConn) Write(b []byte) (int, error) {
+	if err := c.writeFrame(wsOpBinary, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Ping 发送ping帧
+func (c *WSConn) Ping(data []byte) error {
+	return c.writeFrame(wsOpPing, data)
+}
+
+// 服务端的帧不加掩码
+func (c *WSConn) writeFrame(opcode byte, payload []byte) error {
+	var hdr [10]byte
+	hdr[0] = wsFinBit | opcode
+	n := 2
+	switch l := len(payload); {
+	case l <= 125:
+		hdr[1] = byte(l)
+	case l <= 0xffff:
+		hdr[1] = 126
+		binary.BigEndian.PutUint16(hdr[2:], uint16(l))
+		n = 4
+	default:
+		hdr[1] = 127
+		binary.BigEndian.PutUint64(hdr[2:], uint64(l))
+		n = 10
+	}
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closeSent {
+		return ErrorWSProtocol
+	}
+	if opcode == wsOpClose {
+		c.closeSent = true
+	}
+	bufs := net.Buffers{hdr[:n], payload}
+	_, err := bufs.WriteTo(c.Conn)
+	return err
+}
+
+// Close 发送close帧后关闭连接
+func (c *WSConn) Close() error {
+	c.sendClose(wsCloseNormal)
+	return c.Conn.Close()
+}
+
+// websocket监听,http升级成功的连接通过Accept返回
+type wsHandler struct {
+	ln           *httpListener
+	path         string
+	subprotocols []string
+}
+
+// Options:
+// "Path": string, 升级的路径,默认所有路径
+// "Subprotocols": []string, 支持的子协议
+func wsMakeListener(secure bool) MakeListener {
+	return func(cfg *ListenerConfig) (net.Listener, error) {
+		h := new(wsHandler)
+		if cfg.Options != nil {
+			h.path, _ = cfg.Options["Path"].(string)
+			h.subprotocols, _ = cfg.Options["Subprotocols"].([]string)
+		}
+		return makeHTTPListener(cfg, secure, func(ln *httpListener) http.Handler {
+			h.ln = ln
+			ln.errClosed = ErrorWSListenerClosed
+			return h
+		})
+	}
+}
+
+func (h *wsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.path != "" && r.URL.Path != h.path {
+		http.NotFound(w, r)
+		return
+	}
+	conn, err := Upgrade(w, r, h.subprotocols...)
+	if err != nil {
+		log.Debugf("websocket upgrade error: %s, addr: %s", err, r.RemoteAddr)
+		return
+	}
+	if !h.ln.deliver(conn) {
+		conn.Close()
+	}
+}
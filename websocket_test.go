@@ -0,0 +1,138 @@
+package meim
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 测试用的websocket客户端帧,带掩码
+func writeClientFrame(w io.Writer, fin bool, opcode byte, payload []byte) error {
+	b0 := opcode
+	if fin {
+		b0 |= wsFinBit
+	}
+	frame := []byte{b0}
+	switch l := len(payload); {
+	case l <= 125:
+		frame = append(frame, wsMaskBit|byte(l))
+	default:
+		frame = append(frame, wsMaskBit|126, byte(l>>8), byte(l))
+	}
+	mask := []byte{1, 2, 3, 4}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	_, err := w.Write(frame)
+	return err
+}
+
+// 读取服务端的帧
+func readServerFrame(r io.Reader) (byte, []byte, error) {
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return 0, nil, err
+	}
+	length := int(hdr[1] & 0x7f)
+	if length == 126 {
+		ext := make([]byte, 2)
+		if _, err := io.ReadFull(r, ext); err != nil {
+			return 0, nil, err
+		}
+		length = int(binary.BigEndian.Uint16(ext))
+	}
+	payload := make([]byte, length)
+	_, err := io.ReadFull(r, payload)
+	return hdr[0] & 0x0f, payload, err
+}
+
+func dialWS(t *testing.T, addr string) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", addr)
+	assert.NoError(t, err)
+	req, _ := http.NewRequest("GET", "http://"+addr+"/im", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	assert.NoError(t, req.Write(conn))
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", resp.Header.Get("Sec-WebSocket-Accept"))
+	return conn, br
+}
+
+func TestWebSocket(t *testing.T) {
+	s := newTestServer(t, WithListenerConfig(&ListenerConfig{
+		Network: "ws",
+		Address: "127.0.0.1:0",
+		Options: map[string]interface{}{"Path": "/im"},
+	}))
+	defer s.Stop()
+
+	conn, br := dialWS(t, s.Addrs()[1].String())
+	defer conn.Close()
+
+	data, err := EncodeMessage(newTestMessage(3, "hello websocket"))
+	assert.NoError(t, err)
+	data = append([]byte(nil), data...)
+
+	// 分片发送,中间插入ping
+	assert.NoError(t, writeClientFrame(conn, false, wsOpBinary, data[:5]))
+	assert.NoError(t, writeClientFrame(conn, true, wsOpPing, []byte("p")))
+	assert.NoError(t, writeClientFrame(conn, true, wsOpContinuation, data[5:]))
+
+	op, payload, err := readServerFrame(br)
+	assert.NoError(t, err)
+	assert.Equal(t, byte(wsOpPong), op)
+	assert.Equal(t, "p", string(payload))
+
+	op, payload, err = readServerFrame(br)
+	assert.NoError(t, err)
+	assert.Equal(t, byte(wsOpBinary), op)
+	msg, err := DecodeMessage(payload, testDC)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, msg.Header.Cmd())
+	assert.Equal(t, "hello websocket", string(*msg.Body.(*plainData)))
+
+	// 关闭
+	assert.NoError(t, writeClientFrame(conn, true, wsOpClose, []byte{0x03, 0xe8}))
+	op, _, err = readServerFrame(br)
+	assert.NoError(t, err)
+	assert.Equal(t, byte(wsOpClose), op)
+}
+
+func TestWebSocketProtocolError(t *testing.T) {
+	s := newTestServer(t, WithListenerConfig(&ListenerConfig{
+		Network: "ws",
+		Address: "127.0.0.1:0",
+	}))
+	defer s.Stop()
+
+	conn, br := dialWS(t, s.Addrs()[1].String())
+	defer conn.Close()
+
+	// 未加掩码的帧
+	_, err := conn.Write([]byte{wsFinBit | wsOpBinary, 1, 0})
+	assert.NoError(t, err)
+	op, payload, err := readServerFrame(br)
+	assert.NoError(t, err)
+	assert.Equal(t, byte(wsOpClose), op)
+	assert.Equal(t, wsCloseProtocol, int(binary.BigEndian.Uint16(payload)))
+}
+
+func TestWSListenerClosed(t *testing.T) {
+	ln, err := wsMakeListener(false)(&ListenerConfig{Network: "ws", Address: "127.0.0.1:0"})
+	assert.NoError(t, err)
+	ln.Close()
+	_, err = ln.Accept()
+	assert.Equal(t, ErrorWSListenerClosed, err)
+}